@@ -0,0 +1,179 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket is a lookup budget. Prefetch lookups wait for tokens; live
+// lookups take one without waiting and may leave the bucket in debt by up to
+// one burst, which delays prefetching instead of Postfix.
+type tokenBucket struct {
+	last   time.Time
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	waited atomic.Int64 // nanoseconds prefetch lookups spent waiting
+	mu     sync.Mutex
+}
+
+// newTokenBucket returns nil, an unlimited budget, if rate is not positive.
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refillLocked(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.tokens+elapsed.Seconds()*b.rate, b.burst)
+		b.last = now
+	}
+}
+
+// take spends a token for a live lookup.
+func (b *tokenBucket) take() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.refillLocked(time.Now())
+	b.tokens = max(b.tokens-1, min(b.tokens, -b.burst))
+	b.mu.Unlock()
+}
+
+// waitN reserves n tokens for prefetch lookups and sleeps until they are due.
+// It fails with errLookupBudgetExhausted, without reserving, if they would not
+// be due a request timeout before the deadline of ctx. The reservation is
+// returned if ctx ends first.
+func (b *tokenBucket) waitN(ctx context.Context, n float64) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	b.refillLocked(time.Now())
+	delay := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	if deadline, ok := ctx.Deadline(); ok && delay > time.Until(deadline)-REQUEST_TIMEOUT {
+		b.mu.Unlock()
+		return errLookupBudgetExhausted
+	}
+	b.tokens -= n
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	start := time.Now()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		b.waited.Add(int64(time.Since(start)))
+		return nil
+	case <-ctx.Done():
+		b.waited.Add(int64(time.Since(start)))
+		b.mu.Lock()
+		b.tokens += n
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (b *tokenBucket) waitedSeconds() float64 {
+	if b == nil {
+		return 0
+	}
+	return time.Duration(b.waited.Load()).Seconds()
+}
+
+type lookupBudget struct {
+	dns   *tokenBucket
+	https *tokenBucket
+}
+
+var prefetchBudget atomic.Pointer[lookupBudget]
+
+func configurePrefetchBudget(cfg PrefetchConfig) {
+	prefetchBudget.Store(&lookupBudget{
+		dns:   newTokenBucket(cfg.DnsRate),
+		https: newTokenBucket(cfg.HttpsRate),
+	})
+}
+
+// errLookupBudgetExhausted fails a prefetch lookup whose budget would not be
+// due before its deadline. The domain is deferred instead of failed.
+var errLookupBudgetExhausted = errors.New("prefetch lookup budget exhausted")
+
+// prefetchAllowance is the budget reserved for one prefetched domain before
+// its lookup deadline starts.
+type prefetchAllowance struct {
+	dns      atomic.Int32 // reserved DNS queries left
+	deferred atomic.Bool  // a lookup ran out of budget
+}
+
+type prefetchAllowanceContextKey struct{}
+
+func withPrefetchAllowance(ctx context.Context, a *prefetchAllowance) context.Context {
+	return context.WithValue(ctx, prefetchAllowanceContextKey{}, a)
+}
+
+func prefetchAllowanceOf(ctx context.Context) *prefetchAllowance {
+	a, _ := ctx.Value(prefetchAllowanceContextKey{}).(*prefetchAllowance)
+	return a
+}
+
+// reservePrefetchBudget waits for the DNS budget of one prefetched domain.
+func reservePrefetchBudget(ctx context.Context) (*prefetchAllowance, error) {
+	a := &prefetchAllowance{}
+	if budget := prefetchBudget.Load(); budget != nil && budget.dns != nil {
+		if err := budget.dns.waitN(ctx, PREFETCH_QUERIES_PER_DOMAIN); err != nil {
+			return nil, err
+		}
+		a.dns.Store(PREFETCH_QUERIES_PER_DOMAIN)
+	}
+	return a, nil
+}
+
+// spendDNSBudget accounts for a DNS query about to be sent on behalf of ctx.
+// Prefetch queries are paid from their allowance and never wait within the
+// lookup deadline.
+func spendDNSBudget(ctx context.Context) error {
+	budget := prefetchBudget.Load()
+	if budget == nil {
+		return nil
+	}
+	if a := prefetchAllowanceOf(ctx); a != nil && a.dns.Add(-1) >= 0 {
+		return nil
+	}
+	budget.dns.take()
+	return nil
+}
+
+// spendHTTPSBudget accounts for an MTA-STS fetch about to be sent on behalf
+// of ctx. Prefetch fetches wait for a token while their deadline allows.
+func spendHTTPSBudget(ctx context.Context) error {
+	budget := prefetchBudget.Load()
+	if budget == nil {
+		return nil
+	}
+	if !isPrefetchLookup(ctx) {
+		budget.https.take()
+		return nil
+	}
+	err := budget.https.waitN(ctx, 1)
+	if errors.Is(err, errLookupBudgetExhausted) {
+		if a := prefetchAllowanceOf(ctx); a != nil {
+			a.deferred.Store(true)
+		}
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+)
+
+func TestTokenBucketDelaysPrefetchButNotLiveLookups(t *testing.T) {
+	if newTokenBucket(0) != nil {
+		t.Fatal("expected a zero rate to disable the budget")
+	}
+	var unlimited *tokenBucket
+	unlimited.take()
+	if err := unlimited.waitN(context.Background(), 1); err != nil {
+		t.Fatalf("unlimited wait: %v", err)
+	}
+
+	b := newTokenBucket(20)
+	for range 20 {
+		if err := b.waitN(context.Background(), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.waitedSeconds() != 0 {
+		t.Fatalf("expected the burst to pass without waiting, waited %.3fs", b.waitedSeconds())
+	}
+
+	// Live lookups never wait but push the budget into debt.
+	start := time.Now()
+	for range 100 {
+		b.take()
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("live lookups were delayed by %s", elapsed)
+	}
+	b.mu.Lock()
+	tokens := b.tokens
+	b.mu.Unlock()
+	if tokens < -b.burst {
+		t.Fatalf("live debt %.2f exceeds one burst", tokens)
+	}
+
+	start = time.Now()
+	if err := b.waitN(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("expected prefetch to wait for live debt, waited %s", elapsed)
+	}
+
+	// A wait past the deadline fails at once without reserving.
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT+time.Second)
+	defer cancel()
+	b.mu.Lock()
+	before := b.tokens
+	b.mu.Unlock()
+	if err := b.waitN(ctx, 2*b.rate); !errors.Is(err, errLookupBudgetExhausted) {
+		t.Fatalf("wait = %v, want budget exhausted", err)
+	}
+	b.mu.Lock()
+	after := b.tokens
+	b.mu.Unlock()
+	if after < before {
+		t.Fatalf("expected no reservation past the deadline, tokens %.2f -> %.2f", before, after)
+	}
+
+	// A cancelled wait returns its reservation and counts only the time waited.
+	waited := b.waitedSeconds()
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := b.waitN(ctx, b.rate); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait = %v, want canceled", err)
+	}
+	b.mu.Lock()
+	after = b.tokens
+	b.mu.Unlock()
+	if after < before {
+		t.Fatalf("expected cancelled reservation to be returned, tokens %.2f -> %.2f", before, after)
+	}
+	if delta := b.waitedSeconds() - waited; delta > 0.5 {
+		t.Fatalf("expected only the time actually waited to count, counted %.3fs", delta)
+	}
+}
+
+func TestPrefetchKeepsPolicyWhenBudgetIsDrained(t *testing.T) {
+	oldPolCache := polCache
+	oldScheduler := activePrefetchScheduler.Load()
+	oldSemaphore := semaphore
+	oldBudget := prefetchBudget.Load()
+	origDane := checkDanePolicy
+	origMtaSts := checkMtaStsPolicy
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
+	scheduler := newPrefetchScheduler()
+	activePrefetchScheduler.Store(scheduler)
+	semaphore = make(chan struct{}, 1)
+	defer func() {
+		polCache.Close()
+		polCache = oldPolCache
+		activePrefetchScheduler.Store(oldScheduler)
+		semaphore = oldSemaphore
+		prefetchBudget.Store(oldBudget)
+		checkDanePolicy = origDane
+		checkMtaStsPolicy = origMtaSts
+	}()
+
+	configurePrefetchBudget(PrefetchConfig{DnsRate: 20, HttpsRate: 0.05})
+	budget := prefetchBudget.Load()
+	for range 100 {
+		budget.dns.take()
+		budget.https.take()
+	}
+
+	lookupStart := make(chan time.Duration, 1)
+	checkDanePolicy = func(ctx context.Context, _ string, _ bool) (string, uint32) {
+		deadline, _ := ctx.Deadline()
+		lookupStart <- time.Until(deadline)
+		for range 2 * PREFETCH_QUERIES_PER_DOMAIN {
+			if err := spendDNSBudget(ctx); err != nil {
+				return "TEMP", 0
+			}
+		}
+		return "", 0
+	}
+	checkMtaStsPolicy = func(ctx context.Context, _ string, _ bool) (string, string, uint32) {
+		if err := spendHTTPSBudget(ctx); err != nil {
+			return "TEMP", "", 0
+		}
+		return "secure match=mx.example servername=hostname", "policy_type=sts", 600
+	}
+
+	now := time.Now()
+	key := "prefetch-budget.example"
+	cachedPolicy := "secure match=mx.cached.example servername=hostname"
+	polCache.Set(key, &CacheStruct{
+		Expirable: &cache.Expirable{ExpiresAt: now.Add(20 * time.Second)},
+		MtaSts: PolicyBranch{
+			Policy:    cachedPolicy,
+			Report:    "policy_type=sts policy_domain=example.com",
+			TTL:       600,
+			ExpiresAt: now.Add(20 * time.Second),
+		},
+	})
+	scheduler.schedule(key, now.Add(-time.Second))
+
+	start := time.Now()
+	prefetchDuePolicies(scheduler)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("expected drained budget to defer the prefetch, took %s", elapsed)
+	}
+	if budget.dns.waitedSeconds() < 1 {
+		t.Fatalf("expected the DNS budget to be reserved before the lookup, waited %.3fs", budget.dns.waitedSeconds())
+	}
+	select {
+	case remaining := <-lookupStart:
+		if remaining < time.Duration(POLICY_ATTEMPTS)*REQUEST_TIMEOUT {
+			t.Fatalf("expected the lookup deadline to start after the budget wait, %s left", remaining)
+		}
+	default:
+		t.Fatal("expected DANE to be looked up")
+	}
+
+	stored, found := polCache.Get(key)
+	if !found || stored.MtaSts.Policy != cachedPolicy {
+		t.Fatalf("expected drained budget to keep cached policy, found=%v entry=%+v", found, stored)
+	}
+	if failure, found := scheduler.failures[key]; found {
+		t.Fatalf("expected drained budget not to count as a prefetch failure, got %+v", failure)
+	}
+	due, ok := scheduler.nextDue()
+	if !ok || due.Before(now.Add(PREFETCH_SLOT_INTERVAL)) {
+		t.Fatalf("expected deferred prefetch in a later batch, due=%s ok=%v", due, ok)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
 	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
 	"github.com/Zuplu/postfix-tlspol/internal/utils/valid"
 )
@@ -91,17 +92,76 @@ func flagCliConnFunc(f *flag.Flag) {
 	case "query":
 		cliConnMode = true
 		value = (*f).Value.String()
-		if len(value) == 0 || !valid.IsDNSName(value) {
+		if _, ok := normalizePolicyKey(value); !ok {
 			recordCliError(fmt.Errorf("invalid domain %q", value))
 			return
 		}
-	case "dump", "export", "purge":
+	case "inspect", "refresh", "history", "rules-test":
 		cliConnMode = true
+		key, ok := normalizePolicyKey((*f).Value.String())
+		if !ok {
+			recordCliError(fmt.Errorf("invalid domain %q", (*f).Value.String()))
+			return
+		}
+		value = key
+	case "purge-domain":
+		cliConnMode = true
+		value = strings.TrimSpace((*f).Value.String())
+		suffix, wildcard := strings.CutPrefix(value, "*.")
+		if _, ok := normalizePolicyKey(suffix); !ok || wildcard && !valid.IsDNSName(normalizeDomain(suffix)) {
+			recordCliError(fmt.Errorf("invalid domain pattern %q", value))
+			return
+		}
+	case "dump":
+		cliConnMode = true
+		if format := strings.ToLower(flag.Lookup("format").Value.String()); format != DUMP_FORMAT_TEXT && format != DUMP_FORMAT_JSON && format != DUMP_FORMAT_CSV {
+			recordCliError(fmt.Errorf("invalid -format %q", format))
+			return
+		}
+	case "export", "purge":
+		cliConnMode = true
+	case "prefetch-status":
+		cliConnMode = true
+		value = flag.Lookup("prefetch-limit").Value.String()
+		if _, err := parsePrefetchStatusLimit(value); err != nil {
+			recordCliError(err)
+			return
+		}
+	case "cache-export", "cache-import", "warm":
+		cliConnMode = true
+		value = (*f).Value.String()
+		if len(value) == 0 {
+			recordCliError(fmt.Errorf("-%s requires a file name", (*f).Name))
+			return
+		}
 	default:
 		return
 	}
+	warmRate := flag.Lookup("warm-rate").Value.String()
+	if (*f).Name == "warm" {
+		if _, err := parseWarmRate(warmRate); err != nil {
+			recordCliError(err)
+			return
+		}
+	}
+	importMode := flag.Lookup("import-mode").Value.String()
+	if (*f).Name == "cache-import" && importMode != CACHE_IMPORT_MERGE && importMode != CACHE_IMPORT_REPLACE {
+		recordCliError(fmt.Errorf("invalid -import-mode %q", importMode))
+		return
+	}
 	conn, dialedEndpoint, err := dialConfiguredOrDetectedSocketmap()
 	if err != nil {
+		switch (*f).Name {
+		case "cache-export":
+			// Without a running instance, read the cache file directly.
+			fmt.Fprintf(os.Stderr, "No socketmap instance reachable, exporting %s\n", config.Server.CacheFile)
+			recordCliError(cliCacheExportOffline(value))
+			return
+		case "cache-import":
+			fmt.Fprintf(os.Stderr, "No socketmap instance reachable, importing into %s\n", config.Server.CacheFile)
+			recordCliError(cliCacheImportOffline(value, importMode))
+			return
+		}
 		recordCliError(fmt.Errorf("connect to socketmap instance using %s: %w", dialedEndpoint, err))
 		return
 	}
@@ -111,11 +171,33 @@ func flagCliConnFunc(f *flag.Flag) {
 	case "query":
 		recordCliError(cliQuery(conn, value))
 	case "dump":
-		recordCliError(cliDump(conn, false))
+		if format := strings.ToLower(flag.Lookup("format").Value.String()); format != DUMP_FORMAT_TEXT {
+			recordCliError(cliDumpAs(conn, format))
+		} else {
+			recordCliError(cliDump(conn, false))
+		}
 	case "export":
 		recordCliError(cliDump(conn, true))
 	case "purge":
 		recordCliError(cliPurge(conn))
+	case "inspect":
+		recordCliError(cliInspect(conn, "INSPECT", value))
+	case "refresh":
+		recordCliError(cliInspect(conn, "REFRESH", value))
+	case "history":
+		recordCliError(cliHistory(conn, value))
+	case "rules-test":
+		recordCliError(cliRulesTest(conn, value))
+	case "purge-domain":
+		recordCliError(cliPurgeDomain(conn, value))
+	case "cache-export":
+		recordCliError(cliCacheExport(conn, value))
+	case "cache-import":
+		recordCliError(cliCacheImport(conn, value, importMode))
+	case "warm":
+		recordCliError(cliWarm(conn, value, warmRate))
+	case "prefetch-status":
+		recordCliError(cliPrefetchStatus(conn, value))
 	}
 }
 
@@ -131,6 +213,15 @@ func cliQuery(conn net.Conn, value string) error {
 	if err := json.Unmarshal(raw, &result); err != nil {
 		return fmt.Errorf("decode query response for %q: %w", value, err)
 	}
+	if err := writeCliJSON(result); err != nil {
+		return fmt.Errorf("write query result for %q: %w", value, err)
+	}
+	return nil
+}
+
+// writeCliJSON pretty-prints v on a terminal, through jq if available, and
+// writes compact JSON otherwise.
+func writeCliJSON(v any) error {
 	o, err := os.Stdout.Stat()
 	if err == nil && o.Mode()&os.ModeCharDevice != 0 {
 		var buf io.WriteCloser
@@ -153,7 +244,7 @@ func cliQuery(conn net.Conn, value string) error {
 		}
 		enc := json.NewEncoder(buf)
 		enc.SetIndent("", "  ")
-		err = enc.Encode(result)
+		err = enc.Encode(v)
 		closeErr := buf.Close()
 		if err == nil {
 			err = closeErr
@@ -166,12 +257,9 @@ func cliQuery(conn net.Conn, value string) error {
 		}
 	} else {
 		enc := json.NewEncoder(os.Stdout)
-		err = enc.Encode(result)
+		err = enc.Encode(v)
 	}
-	if err != nil {
-		return fmt.Errorf("write query result for %q: %w", value, err)
-	}
-	return nil
+	return err
 }
 
 type nopWriteCloser struct {
@@ -210,6 +298,22 @@ func cliDump(conn net.Conn, export bool) error {
 	return nil
 }
 
+func cliDumpAs(conn net.Conn, format string) error {
+	command := "DUMP " + strings.ToUpper(format)
+	if err := writeConnection(conn, netstring.Marshal(command)); err != nil {
+		return fmt.Errorf("request cached policies with %s: %w", command, err)
+	}
+	reader := bufio.NewReader(conn)
+	if prefix, err := reader.Peek(len("ERROR: ")); err == nil && string(prefix) == "ERROR: " {
+		line, _ := reader.ReadString('\n')
+		return fmt.Errorf("dump cached policies: %s", strings.TrimSpace(strings.TrimPrefix(line, "ERROR: ")))
+	}
+	if _, err := io.Copy(os.Stdout, reader); err != nil {
+		return fmt.Errorf("read cached policies: %w", err)
+	}
+	return nil
+}
+
 func isPagerCancellation(err error) bool {
 	var exitErr *exec.ExitError
 	if !errors.As(err, &exitErr) {
@@ -228,3 +332,265 @@ func cliPurge(conn net.Conn) error {
 	}
 	return nil
 }
+
+func cliInspect(conn net.Conn, command string, domain string) error {
+	if err := writeConnection(conn, netstring.Marshal(command+" "+domain)); err != nil {
+		return fmt.Errorf("inspect domain %q: %w", domain, err)
+	}
+	raw, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("read inspect response for %q: %w", domain, err)
+	}
+	var result InspectResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return fmt.Errorf("decode inspect response for %q: %w", domain, err)
+	}
+	if err := writeCliJSON(result); err != nil {
+		return fmt.Errorf("write inspect result for %q: %w", domain, err)
+	}
+	if result.Error != "" {
+		return fmt.Errorf("refresh %q: %s", domain, result.Error)
+	}
+	return nil
+}
+
+func cliHistory(conn net.Conn, domain string) error {
+	if err := writeConnection(conn, netstring.Marshal("HISTORY "+domain)); err != nil {
+		return fmt.Errorf("request history of %q: %w", domain, err)
+	}
+	raw, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("read history of %q: %w", domain, err)
+	}
+	var result PolicyHistory
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return fmt.Errorf("decode history of %q: %w", domain, err)
+	}
+	if err := writeCliJSON(result); err != nil {
+		return fmt.Errorf("write history of %q: %w", domain, err)
+	}
+	return nil
+}
+
+func cliRulesTest(conn net.Conn, domain string) error {
+	if err := writeConnection(conn, netstring.Marshal("RULESTEST "+domain)); err != nil {
+		return fmt.Errorf("request rules test of %q: %w", domain, err)
+	}
+	raw, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("read rules test of %q: %w", domain, err)
+	}
+	var result RulesTestResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return fmt.Errorf("decode rules test of %q: %w", domain, err)
+	}
+	if err := writeCliJSON(result); err != nil {
+		return fmt.Errorf("write rules test of %q: %w", domain, err)
+	}
+	return nil
+}
+
+func cliPrefetchStatus(conn net.Conn, limit string) error {
+	if err := writeConnection(conn, netstring.Marshal("PREFETCH "+limit)); err != nil {
+		return fmt.Errorf("request prefetch status: %w", err)
+	}
+	raw, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return fmt.Errorf("read prefetch status: %w", err)
+	}
+	if msg, ok := strings.CutPrefix(string(raw), "ERROR: "); ok {
+		return errors.New(strings.TrimSpace(msg))
+	}
+	var status PrefetchStatus
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return fmt.Errorf("decode prefetch status: %w", err)
+	}
+	if err := writeCliJSON(status); err != nil {
+		return fmt.Errorf("write prefetch status: %w", err)
+	}
+	return nil
+}
+
+func cliPurgeDomain(conn net.Conn, pattern string) error {
+	if err := writeConnection(conn, netstring.Marshal("PURGE "+pattern)); err != nil {
+		return fmt.Errorf("request purge of %q: %w", pattern, err)
+	}
+	raw, err := io.ReadAll(io.LimitReader(conn, SOCKETMAP_MAX_REPLY_BYTES))
+	if err != nil {
+		return fmt.Errorf("read purge result for %q: %w", pattern, err)
+	}
+	result := strings.TrimSpace(string(raw))
+	if !strings.HasPrefix(result, "OK") {
+		return fmt.Errorf("purge %q failed: %s", pattern, strings.TrimPrefix(result, "ERROR: "))
+	}
+	fmt.Println(result)
+	return nil
+}
+
+func openCliFile(path string, write bool) (*os.File, error) {
+	if path == "-" {
+		if write {
+			return os.Stdout, nil
+		}
+		return os.Stdin, nil
+	}
+	if write {
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	}
+	return os.Open(path)
+}
+
+func closeCliFile(f *os.File) error {
+	if f == os.Stdout || f == os.Stdin {
+		return nil
+	}
+	return f.Close()
+}
+
+func cliCacheExport(conn net.Conn, path string) error {
+	if err := writeConnection(conn, netstring.Marshal("CACHEEXPORT")); err != nil {
+		return fmt.Errorf("request cache export: %w", err)
+	}
+	f, err := openCliFile(path, true)
+	if err != nil {
+		return fmt.Errorf("create cache export: %w", err)
+	}
+	_, err = io.Copy(f, conn)
+	if closeErr := closeCliFile(f); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write cache export: %w", err)
+	}
+	return nil
+}
+
+func cliCacheImport(conn net.Conn, path string, mode string) error {
+	f, err := openCliFile(path, false)
+	if err != nil {
+		return fmt.Errorf("open cache import: %w", err)
+	}
+	defer closeCliFile(f)
+	if err := writeConnection(conn, netstring.Marshal("CACHEIMPORT "+mode)); err != nil {
+		return fmt.Errorf("request cache import: %w", err)
+	}
+	if _, err := io.Copy(conn, f); err != nil {
+		return fmt.Errorf("send cache import: %w", err)
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return fmt.Errorf("send cache import: %w", err)
+		}
+	}
+	return cliImportResult(bufio.NewReader(conn))
+}
+
+func cliWarm(conn net.Conn, path string, rate string) error {
+	f, err := openCliFile(path, false)
+	if err != nil {
+		return fmt.Errorf("open warm-up list: %w", err)
+	}
+	defer closeCliFile(f)
+	if err := writeConnection(conn, netstring.Marshal("WARM "+rate)); err != nil {
+		return fmt.Errorf("request cache warm-up: %w", err)
+	}
+	if _, err := io.Copy(conn, f); err != nil {
+		return fmt.Errorf("send warm-up list: %w", err)
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return fmt.Errorf("send warm-up list: %w", err)
+		}
+	}
+	return cliWarmResult(bufio.NewReader(conn))
+}
+
+// cliWarmResult prints PROGRESS lines to stderr until the final result.
+func cliWarmResult(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if progress, ok := strings.CutPrefix(line, WARM_PROGRESS_LINE_HEAD); ok {
+			fmt.Fprintf(os.Stderr, "Warming cache: %s\n", progress)
+			continue
+		}
+		if strings.HasPrefix(line, "OK") {
+			fmt.Println(line)
+			return nil
+		}
+		if line != "" {
+			return fmt.Errorf("cache warm-up failed: %s", strings.TrimPrefix(line, "ERROR: "))
+		}
+		if err != nil {
+			return fmt.Errorf("read cache warm-up result: %w", err)
+		}
+	}
+}
+
+func cliImportResult(r io.Reader) error {
+	raw, err := io.ReadAll(io.LimitReader(r, SOCKETMAP_MAX_REPLY_BYTES))
+	if err != nil {
+		return fmt.Errorf("read cache import result: %w", err)
+	}
+	result := strings.TrimSpace(string(raw))
+	if !strings.HasPrefix(result, "OK") {
+		return fmt.Errorf("cache import failed: %s", strings.TrimPrefix(result, "ERROR: "))
+	}
+	fmt.Println(result)
+	return nil
+}
+
+func openOfflineCache(opts ...cache.Option) (*cache.Cache[*CacheStruct], error) {
+	key, err := config.Server.GetCacheKey()
+	if err != nil {
+		return nil, err
+	}
+	return cache.New[*CacheStruct](config.Server.CacheFile, CACHE_SNAPSHOT_INTERVAL, append(opts, cache.WithHMACKey(key))...)
+}
+
+func cliCacheExportOffline(path string) error {
+	c, err := openOfflineCache(cache.ReadOnly())
+	if err != nil {
+		return fmt.Errorf("open cache file: %w", err)
+	}
+	defer c.Close()
+	f, err := openCliFile(path, true)
+	if err != nil {
+		return fmt.Errorf("create cache export: %w", err)
+	}
+	err = writeCacheExport(f, c.Items(false))
+	if closeErr := closeCliFile(f); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write cache export: %w", err)
+	}
+	return nil
+}
+
+func cliCacheImportOffline(path string, mode string) error {
+	f, err := openCliFile(path, false)
+	if err != nil {
+		return fmt.Errorf("open cache import: %w", err)
+	}
+	defer closeCliFile(f)
+	now := time.Now()
+	entries, skipped, err := readCacheImport(f, now, nil)
+	if err != nil {
+		return fmt.Errorf("cache import failed: %w", err)
+	}
+	c, err := openOfflineCache()
+	if err != nil {
+		return fmt.Errorf("open cache file: %w", err)
+	}
+	polCache = c
+	imported, kept, err := applyCacheImport(entries, mode, now)
+	if closeErr := c.CloseWithError(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cache import failed: %w", err)
+	}
+	fmt.Printf("OK imported=%d kept=%d skipped=%d\n", imported, kept, skipped)
+	return nil
+}
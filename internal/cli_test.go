@@ -26,6 +26,30 @@ func TestCliCommandsReturnWriteErrors(t *testing.T) {
 		{name: "purge", run: func() error {
 			return cliPurge(&partialWriteConn{writeErr: io.ErrClosedPipe})
 		}},
+		{name: "inspect", run: func() error {
+			return cliInspect(&partialWriteConn{writeErr: io.ErrClosedPipe}, "INSPECT", "example.com")
+		}},
+		{name: "history", run: func() error {
+			return cliHistory(&partialWriteConn{writeErr: io.ErrClosedPipe}, "example.com")
+		}},
+		{name: "rules-test", run: func() error {
+			return cliRulesTest(&partialWriteConn{writeErr: io.ErrClosedPipe}, "example.com")
+		}},
+		{name: "purge-domain", run: func() error {
+			return cliPurgeDomain(&partialWriteConn{writeErr: io.ErrClosedPipe}, "*.example.com")
+		}},
+		{name: "cache-export", run: func() error {
+			return cliCacheExport(&partialWriteConn{writeErr: io.ErrClosedPipe}, "-")
+		}},
+		{name: "dump-json", run: func() error {
+			return cliDumpAs(&partialWriteConn{writeErr: io.ErrClosedPipe}, DUMP_FORMAT_JSON)
+		}},
+		{name: "warm", run: func() error {
+			return cliWarm(&partialWriteConn{writeErr: io.ErrClosedPipe}, "-", "10")
+		}},
+		{name: "prefetch-status", run: func() error {
+			return cliPrefetchStatus(&partialWriteConn{writeErr: io.ErrClosedPipe}, "10")
+		}},
 	} {
 		t.Run(test.name, func(t *testing.T) {
 			if err := test.run(); !errors.Is(err, io.ErrClosedPipe) {
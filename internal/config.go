@@ -11,6 +11,7 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
@@ -18,6 +19,8 @@ import (
 	"sync"
 	"unsafe"
 
+	"github.com/Zuplu/postfix-tlspol/internal/utils/valid"
+
 	"codeberg.org/miekg/dns/dnsconf"
 	"go.yaml.in/yaml/v4"
 	"golang.org/x/sys/unix"
@@ -27,12 +30,46 @@ var defaultConfig = Config{}
 
 const CONFIG_MAX_SIZE = 1 << 20
 
+// POLICY_TTL_TYPES are the keys of cache.ttl: the served policies, "none" for
+// domains without a policy and "temp" for temporary lookup failures.
+var POLICY_TTL_TYPES = []string{"dane-only", "dane", "secure", "none", "temp"}
+
+var defaultPolicyTTLBounds = map[string][2]uint32{
+	"dane-only": {CACHE_MIN_TTL, CACHE_MAX_TTL},
+	"dane":      {CACHE_MIN_TTL, CACHE_MAX_TTL},
+	"secure":    {0, CACHE_MAX_TTL},
+	"none":      {CACHE_MIN_TTL, CACHE_MAX_TTL},
+	"temp":      {0, CACHE_MAX_TTL},
+}
+
+// SERVER_MODES are the values of server.mode. In shadow mode Postfix gets
+// the shadow baseline while the evaluated policies are only logged and
+// counted.
+const (
+	SERVER_MODE_ENFORCE = "enforce"
+	SERVER_MODE_SHADOW  = "shadow"
+)
+
+// SHADOW_BASELINE_LEVELS are the Postfix TLS security levels accepted as
+// server.shadow-baseline.
+var SHADOW_BASELINE_LEVELS = []string{"none", "may", "encrypt", "dane", "dane-only", "fingerprint", "verify", "secure"}
+
+const (
+	CACHE_KEY_CREDENTIAL = "cache-key"
+	CACHE_KEY_MIN_SIZE   = 16
+	CACHE_KEY_MAX_SIZE   = 4096
+)
+
 type ServerConfig struct {
 	Address           string `yaml:"address"`
 	MetricsAddress    string `yaml:"metrics-address"`
 	CacheFile         string `yaml:"cache-file"`
+	CacheKeyFile      string `yaml:"cache-key-file"`
 	NamedLogLevel     string `yaml:"log-level"`
 	LogFormat         string `yaml:"log-format"`
+	Mode              string `yaml:"mode"`
+	ShadowBaseline    string `yaml:"shadow-baseline"`
+	RulesFile         string `yaml:"rules-file"`
 	LogLevel          slog.Level
 	SocketPermissions os.FileMode `yaml:"socket-permissions"`
 	TlsRpt            bool        `yaml:"tlsrpt"`
@@ -47,9 +84,13 @@ func (c *ServerConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	c.SocketPermissions = defaultConfig.Server.SocketPermissions
 	c.NamedLogLevel = defaultConfig.Server.NamedLogLevel
 	c.LogFormat = defaultConfig.Server.LogFormat
+	c.Mode = defaultConfig.Server.Mode
+	c.ShadowBaseline = defaultConfig.Server.ShadowBaseline
+	c.RulesFile = defaultConfig.Server.RulesFile
 	c.TlsRpt = false
 	c.Prefetch = defaultConfig.Server.Prefetch
 	c.CacheFile = defaultConfig.Server.CacheFile
+	c.CacheKeyFile = defaultConfig.Server.CacheKeyFile
 	type alias ServerConfig
 	if err := unmarshal((*alias)(c)); err != nil {
 		return err
@@ -58,7 +99,7 @@ func (c *ServerConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	if err := unmarshal(&fields); err != nil {
 		return err
 	}
-	warnUnknownConfigKeys(fields, "server", "address", "metrics-address", "cache-file", "log-level", "log-format", "socket-permissions", "tlsrpt", "prefetch")
+	warnUnknownConfigKeys(fields, "server", "address", "metrics-address", "cache-file", "cache-key-file", "log-level", "log-format", "socket-permissions", "tlsrpt", "prefetch", "mode", "shadow-baseline", "rules-file")
 	_, c.addressConfigured = fields["address"]
 	var lvl slog.Level
 	if err := lvl.UnmarshalText([]byte(strings.ToLower(c.NamedLogLevel))); err != nil {
@@ -68,6 +109,36 @@ func (c *ServerConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	return nil
 }
 
+// GetCacheKey returns the key authenticating the cache file, read from
+// cache-key-file or else from the systemd credential CACHE_KEY_CREDENTIAL.
+// A nil key without error leaves the cache file unauthenticated.
+func (c *ServerConfig) GetCacheKey() ([]byte, error) {
+	path := c.CacheKeyFile
+	if path == "" {
+		dir, ok := os.LookupEnv("CREDENTIALS_DIRECTORY")
+		if !ok || dir == "" {
+			return nil, nil
+		}
+		path = filepath.Join(dir, CACHE_KEY_CREDENTIAL)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read cache key: %w", err)
+	}
+	defer f.Close()
+	key, err := io.ReadAll(io.LimitReader(f, CACHE_KEY_MAX_SIZE+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read cache key: %w", err)
+	}
+	if len(key) < CACHE_KEY_MIN_SIZE || len(key) > CACHE_KEY_MAX_SIZE {
+		return nil, fmt.Errorf("cache key %q must be between %d and %d bytes", path, CACHE_KEY_MIN_SIZE, CACHE_KEY_MAX_SIZE)
+	}
+	return key, nil
+}
+
 type DnsConfig struct {
 	Address *string `yaml:"address"`
 }
@@ -113,6 +184,9 @@ func (rc *ResolvConf) Get() *dnsconf.Config {
 	return rc.config
 }
 
+// onResolverChange is called after a reload changed the nameservers.
+var onResolverChange = func() {}
+
 func (rc *ResolvConf) load(successMessage string) bool {
 	cfg, err := dnsconf.FromFile(rc.path)
 	if err != nil {
@@ -120,9 +194,13 @@ func (rc *ResolvConf) load(successMessage string) bool {
 		return false
 	}
 	rc.Lock()
+	previous := rc.config
 	rc.config = cfg
 	rc.Unlock()
 	slog.Info(successMessage, "path", rc.path)
+	if previous != nil && !slices.Equal(previous.Servers, cfg.Servers) {
+		go onResolverChange()
+	}
 	return true
 }
 
@@ -251,12 +329,412 @@ func (c *DnsConfig) UnmarshalYAML(unmarshal func(any) error) error {
 	return nil
 }
 
+// TTLBounds clamps the TTL of one policy type. Unset bounds fall back to the
+// built-in defaults in defaultPolicyTTLBounds.
+type TTLBounds struct {
+	Min *uint32 `yaml:"min"`
+	Max *uint32 `yaml:"max"`
+}
+
+type CacheTTLConfig struct {
+	DaneOnly TTLBounds `yaml:"dane-only"`
+	Dane     TTLBounds `yaml:"dane"`
+	Secure   TTLBounds `yaml:"secure"`
+	None     TTLBounds `yaml:"none"`
+	Temp     TTLBounds `yaml:"temp"`
+}
+
+type CacheConfig struct {
+	TTL CacheTTLConfig `yaml:"ttl"`
+}
+
+func (c *CacheConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	// Unset bounds keep the built-in defaults, see CacheTTLConfig.bounds
+	type alias CacheConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	warnUnknownConfigKeys(fields, "cache", "ttl")
+	return nil
+}
+
+func (c *CacheTTLConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	type alias CacheTTLConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	warnUnknownConfigKeys(fields, "cache.ttl", POLICY_TTL_TYPES...)
+	return nil
+}
+
+// bounds returns the configured TTL bounds of a policy type in seconds.
+func (c *CacheTTLConfig) bounds(kind string) (uint32, uint32) {
+	var b TTLBounds
+	switch kind {
+	case "dane-only":
+		b = c.DaneOnly
+	case "dane":
+		b = c.Dane
+	case "secure":
+		b = c.Secure
+	case "none":
+		b = c.None
+	case "temp":
+		b = c.Temp
+	}
+	def := defaultPolicyTTLBounds[kind]
+	lo, hi := def[0], def[1]
+	if b.Min != nil {
+		lo = *b.Min
+	}
+	if b.Max != nil {
+		hi = *b.Max
+	}
+	return lo, hi
+}
+
+// PrefetchConfig limits the lookups sent by prefetching, per second, and the
+// seconds a domain may go unqueried before it is no longer prefetched. Zero
+// disables a limit.
+type PrefetchConfig struct {
+	DnsRate    float64 `yaml:"dns-rate"`
+	HttpsRate  float64 `yaml:"https-rate"`
+	IdleWindow uint32  `yaml:"idle-window"`
+}
+
+func (c *PrefetchConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	// Set default values
+	*c = defaultConfig.Prefetch
+	type alias PrefetchConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	warnUnknownConfigKeys(fields, "prefetch", "dns-rate", "https-rate", "idle-window")
+	return nil
+}
+
+// PinningConfig holds back downgrades seen during refresh until
+// ConfirmLookups consistent lookups spanning at least ConfirmPeriod seconds
+// returned the weaker policy.
+type PinningConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	ConfirmLookups uint32 `yaml:"confirm-lookups"`
+	ConfirmPeriod  uint32 `yaml:"confirm-period"`
+}
+
+func (c *PinningConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	// Set default values
+	*c = defaultConfig.Pinning
+	type alias PinningConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	warnUnknownConfigKeys(fields, "pinning", "enabled", "confirm-lookups", "confirm-period")
+	return nil
+}
+
+// ProbationConfig serves the opportunistic form of a policy a domain newly
+// moved to, dane for dane-only and encrypt for secure, for Period seconds
+// before the policy is enforced.
+type ProbationConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Period  uint32 `yaml:"period"`
+}
+
+func (c *ProbationConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	// Set default values
+	*c = defaultConfig.Probation
+	type alias ProbationConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	warnUnknownConfigKeys(fields, "probation", "enabled", "period")
+	return nil
+}
+
+// FAILURE_POLICIES are the replies failure-policy may choose for temporary
+// lookup failures.
+var FAILURE_POLICIES = []string{"temp", "notfound", "encrypt", "may"}
+
+// FailurePolicyConfig answers temporary lookup failures of domains without a
+// usable cached policy. Once a domain failed more than MaxFailures times in a
+// row, the policy of the longest matching suffix in Domains, or Default,
+// replaces TEMP.
+type FailurePolicyConfig struct {
+	Domains     map[string]string `yaml:"domains"`
+	Default     string            `yaml:"default"`
+	MaxFailures uint32            `yaml:"max-failures"`
+}
+
+func (c *FailurePolicyConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	// Set default values
+	*c = defaultConfig.FailurePolicy
+	type alias FailurePolicyConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	warnUnknownConfigKeys(fields, "failure-policy", "default", "max-failures", "domains")
+	return nil
+}
+
+// validate normalizes the policies and domain suffixes of c.
+func (c *FailurePolicyConfig) validate(prefix string) error {
+	c.Default = strings.ToLower(strings.TrimSpace(c.Default))
+	if c.Default == "" {
+		c.Default = "temp"
+	}
+	if !slices.Contains(FAILURE_POLICIES, c.Default) {
+		return fmt.Errorf("invalid %s.default %q", prefix, c.Default)
+	}
+	domains := make(map[string]string, len(c.Domains))
+	for suffix, policy := range c.Domains {
+		key := normalizeDomain(strings.TrimPrefix(strings.TrimSpace(suffix), "."))
+		if !valid.IsDNSName(key) {
+			return fmt.Errorf("invalid %s.domains suffix %q", prefix, suffix)
+		}
+		policy = strings.ToLower(strings.TrimSpace(policy))
+		if !slices.Contains(FAILURE_POLICIES, policy) {
+			return fmt.Errorf("invalid %s.domains policy %q for %q", prefix, policy, suffix)
+		}
+		domains[key] = policy
+	}
+	c.Domains = domains
+	return nil
+}
+
+// POLICY_MAPPING_KEYS are the keys of the global and per-domain policy
+// mapping.
+var POLICY_MAPPING_KEYS = []string{"dane-only", "dane", "secure", "mta-sts-testing", "attributes"}
+
+// POLICY_MAPPING_TARGETS lists what each outcome of a lookup may be replied
+// as. A DANE policy cannot be served without TLSA records, nor secure without
+// the MX patterns of an MTA-STS policy.
+var POLICY_MAPPING_TARGETS = map[string][]string{
+	"dane-only":       {"dane-only", "dane", "encrypt", "may"},
+	"dane":            {"dane", "encrypt", "may"},
+	"secure":          {"secure", "encrypt", "may"},
+	"mta-sts-testing": {"none", "secure"},
+}
+
+// PolicyMapping decides what the outcomes of a lookup are replied as. Empty
+// fields keep the outcome, Attributes are appended to every policy replied.
+type PolicyMapping struct {
+	DaneOnly      string `yaml:"dane-only"`
+	Dane          string `yaml:"dane"`
+	Secure        string `yaml:"secure"`
+	MtaStsTesting string `yaml:"mta-sts-testing"`
+	Attributes    string `yaml:"attributes"`
+}
+
+// PolicyMappingConfig is the global policy mapping and the mappings of
+// domain suffixes, whose fields take precedence where set.
+type PolicyMappingConfig struct {
+	PolicyMapping `yaml:",inline"`
+	Domains       map[string]PolicyMapping `yaml:"domains"`
+}
+
+func (c *PolicyMappingConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	// Set default values
+	*c = defaultConfig.PolicyMapping
+	type alias PolicyMappingConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	warnUnknownConfigKeys(fields, "policy-mapping", append([]string{"domains"}, POLICY_MAPPING_KEYS...)...)
+	if domains, ok := fields["domains"].(map[string]any); ok {
+		for suffix, entry := range domains {
+			if entry, ok := entry.(map[string]any); ok {
+				warnUnknownConfigKeys(entry, "policy-mapping.domains."+suffix, POLICY_MAPPING_KEYS...)
+			}
+		}
+	}
+	return nil
+}
+
+// validate normalizes the targets and attributes of m.
+func (m *PolicyMapping) validate(prefix string) error {
+	for _, target := range []struct {
+		key   string
+		value *string
+	}{
+		{"dane-only", &m.DaneOnly},
+		{"dane", &m.Dane},
+		{"secure", &m.Secure},
+		{"mta-sts-testing", &m.MtaStsTesting},
+	} {
+		*target.value = strings.ToLower(strings.TrimSpace(*target.value))
+		if *target.value != "" && !slices.Contains(POLICY_MAPPING_TARGETS[target.key], *target.value) {
+			return fmt.Errorf("invalid %s.%s %q", prefix, target.key, *target.value)
+		}
+	}
+	m.Attributes = strings.Join(strings.Fields(m.Attributes), " ")
+	for attribute := range strings.FieldsSeq(m.Attributes) {
+		name, value, ok := strings.Cut(attribute, "=")
+		if !ok || value == "" || !isPolicyAttributeName(name) || name == "match" || name == "servername" {
+			return fmt.Errorf("invalid %s.attributes %q", prefix, attribute)
+		}
+		for _, r := range value {
+			if r < '!' || r > '~' {
+				return fmt.Errorf("invalid %s.attributes %q", prefix, attribute)
+			}
+		}
+	}
+	return nil
+}
+
+// isPolicyAttributeName reports whether name looks like a Postfix TLS policy
+// attribute such as protocols or connection_reuse.
+func isPolicyAttributeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// validate normalizes the global mapping and the domain suffixes of c.
+func (c *PolicyMappingConfig) validate(prefix string) error {
+	if err := c.PolicyMapping.validate(prefix); err != nil {
+		return err
+	}
+	domains := make(map[string]PolicyMapping, len(c.Domains))
+	for suffix, mapping := range c.Domains {
+		key := normalizeDomain(strings.TrimPrefix(strings.TrimSpace(suffix), "."))
+		if !valid.IsDNSName(key) {
+			return fmt.Errorf("invalid %s.domains suffix %q", prefix, suffix)
+		}
+		if err := mapping.validate(prefix + ".domains." + key); err != nil {
+			return err
+		}
+		domains[key] = mapping
+	}
+	c.Domains = domains
+	return nil
+}
+
+const (
+	PROFILE_BRANCHES_BOTH   = "both"
+	PROFILE_BRANCHES_DANE   = "dane"
+	PROFILE_BRANCHES_MTASTS = "mta-sts"
+)
+
+// ProfileConfig is a policy profile, selected by Postfix with the socketmap
+// map name, e.g. socketmap:inet:127.0.0.1:8642:STRICT.
+// Branches restricts the served policy to DANE or MTA-STS. Unset keys take
+// the server settings, a failure-policy or policy-mapping replaces the global
+// one.
+type ProfileConfig struct {
+	TlsRpt         *bool                `yaml:"tlsrpt"`
+	FailurePolicy  *FailurePolicyConfig `yaml:"failure-policy"`
+	PolicyMapping  *PolicyMappingConfig `yaml:"policy-mapping"`
+	Mode           string               `yaml:"mode"`
+	ShadowBaseline string               `yaml:"shadow-baseline"`
+	Branches       string               `yaml:"branches"`
+}
+
+// WebhookConfig is the HTTP endpoint policy events are posted to. A failed
+// delivery is retried up to Retries times, each request times out after
+// Timeout seconds.
+type WebhookConfig struct {
+	URL     string `yaml:"url"`
+	Retries uint32 `yaml:"retries"`
+	Timeout uint32 `yaml:"timeout"`
+}
+
+func (c *WebhookConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	// Set default values
+	*c = defaultConfig.Events.Webhook
+	type alias WebhookConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	warnUnknownConfigKeys(fields, "events.webhook", "url", "retries", "timeout")
+	return nil
+}
+
+// EventsConfig selects the sinks policy change events are delivered to.
+// Changes of a domain are collected for Debounce seconds first.
+type EventsConfig struct {
+	Webhook  WebhookConfig `yaml:"webhook"`
+	Command  []string      `yaml:"command"`
+	Debounce uint32        `yaml:"debounce"`
+	Syslog   bool          `yaml:"syslog"`
+}
+
+func (c *EventsConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	// Set default values
+	*c = defaultConfig.Events
+	type alias EventsConfig
+	if err := unmarshal((*alias)(c)); err != nil {
+		return err
+	}
+	var fields map[string]any
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	warnUnknownConfigKeys(fields, "events", "webhook", "command", "debounce", "syslog")
+	return nil
+}
+
 type Config struct {
-	Dns    DnsConfig    `yaml:"dns"`
-	Server ServerConfig `yaml:"server"`
+	Dns           DnsConfig                `yaml:"dns"`
+	Server        ServerConfig             `yaml:"server"`
+	Cache         CacheConfig              `yaml:"cache"`
+	Prefetch      PrefetchConfig           `yaml:"prefetch"`
+	Pinning       PinningConfig            `yaml:"pinning"`
+	Probation     ProbationConfig          `yaml:"probation"`
+	FailurePolicy FailurePolicyConfig      `yaml:"failure-policy"`
+	PolicyMapping PolicyMappingConfig      `yaml:"policy-mapping"`
+	Events        EventsConfig             `yaml:"events"`
+	Profiles      map[string]ProfileConfig `yaml:"profiles"`
+	rules         *policyRules             // compiled from server.rules-file
+	profiles      map[string]*queryProfile // by upper-case map name
 }
 
 func (c *Config) UnmarshalYAML(unmarshal func(any) error) error {
+	// Sections left out entirely keep their defaults
+	c.Prefetch = defaultConfig.Prefetch
+	c.Pinning = defaultConfig.Pinning
+	c.Probation = defaultConfig.Probation
+	c.FailurePolicy = defaultConfig.FailurePolicy
+	c.PolicyMapping = defaultConfig.PolicyMapping
+	c.Events = defaultConfig.Events
 	type alias Config
 	if err := unmarshal((*alias)(c)); err != nil {
 		return err
@@ -265,7 +743,14 @@ func (c *Config) UnmarshalYAML(unmarshal func(any) error) error {
 	if err := unmarshal(&fields); err != nil {
 		return err
 	}
-	warnUnknownConfigKeys(fields, "", "dns", "server")
+	warnUnknownConfigKeys(fields, "", "dns", "server", "cache", "prefetch", "pinning", "probation", "failure-policy", "policy-mapping", "events", "profiles")
+	if profiles, ok := fields["profiles"].(map[string]any); ok {
+		for name, profile := range profiles {
+			if profile, ok := profile.(map[string]any); ok {
+				warnUnknownConfigKeys(profile, "profiles."+name, "tlsrpt", "failure-policy", "policy-mapping", "mode", "shadow-baseline", "branches")
+			}
+		}
+	}
 	return nil
 }
 
@@ -320,6 +805,7 @@ func validateConfig(config *Config) error {
 	config.Server.Address = strings.TrimSpace(config.Server.Address)
 	config.Server.MetricsAddress = strings.TrimSpace(config.Server.MetricsAddress)
 	config.Server.CacheFile = strings.TrimSpace(config.Server.CacheFile)
+	config.Server.CacheKeyFile = strings.TrimSpace(config.Server.CacheKeyFile)
 	// An empty address is valid for systemd-only deployments. startServer rejects
 	// it when no socket-activated listener is available.
 	if err := validateListenAddress("server.address", config.Server.Address, true); err != nil {
@@ -338,6 +824,80 @@ func validateConfig(config *Config) error {
 	if config.Server.LogFormat != "text" && config.Server.LogFormat != "json" {
 		return fmt.Errorf("invalid server.log-format %q", config.Server.LogFormat)
 	}
+	config.Server.Mode = strings.ToLower(strings.TrimSpace(config.Server.Mode))
+	if config.Server.Mode == "" {
+		config.Server.Mode = SERVER_MODE_ENFORCE
+	}
+	if config.Server.Mode != SERVER_MODE_ENFORCE && config.Server.Mode != SERVER_MODE_SHADOW {
+		return fmt.Errorf("invalid server.mode %q", config.Server.Mode)
+	}
+	config.Server.ShadowBaseline = strings.TrimSpace(config.Server.ShadowBaseline)
+	if baseline := config.Server.ShadowBaseline; baseline != "" && !validCachedPolicy(baseline, SHADOW_BASELINE_LEVELS...) {
+		return fmt.Errorf("invalid server.shadow-baseline %q", baseline)
+	}
+	config.Server.RulesFile = strings.TrimSpace(config.Server.RulesFile)
+	config.rules = nil
+	if config.Server.RulesFile != "" {
+		rules, err := loadPolicyRules(config.Server.RulesFile)
+		if err != nil {
+			return fmt.Errorf("load server.rules-file: %w", err)
+		}
+		config.rules = rules
+	}
+	for _, kind := range POLICY_TTL_TYPES {
+		lo, hi := config.Cache.TTL.bounds(kind)
+		if hi > CACHE_MAX_TTL {
+			return fmt.Errorf("cache.ttl.%s.max must not exceed %d", kind, CACHE_MAX_TTL)
+		}
+		if lo > hi {
+			return fmt.Errorf("cache.ttl.%s.min %d exceeds max %d", kind, lo, hi)
+		}
+		if kind != "temp" && hi == 0 {
+			return fmt.Errorf("cache.ttl.%s.max must be positive", kind)
+		}
+	}
+	if config.Prefetch.DnsRate < 0 || config.Prefetch.HttpsRate < 0 {
+		return fmt.Errorf("prefetch rates must not be negative")
+	}
+	if config.Pinning.Enabled && config.Pinning.ConfirmLookups == 0 {
+		return fmt.Errorf("pinning.confirm-lookups must be positive")
+	}
+	if config.Pinning.ConfirmPeriod > CACHE_MAX_TTL {
+		return fmt.Errorf("pinning.confirm-period must not exceed %d", CACHE_MAX_TTL)
+	}
+	if config.Probation.Enabled && config.Probation.Period == 0 {
+		return fmt.Errorf("probation.period must be positive")
+	}
+	if config.Probation.Period > CACHE_MAX_TTL {
+		return fmt.Errorf("probation.period must not exceed %d", CACHE_MAX_TTL)
+	}
+	if err := config.FailurePolicy.validate("failure-policy"); err != nil {
+		return err
+	}
+	if err := config.PolicyMapping.validate("policy-mapping"); err != nil {
+		return err
+	}
+	profiles, err := buildQueryProfiles(config)
+	if err != nil {
+		return err
+	}
+	config.profiles = profiles
+	config.Events.Webhook.URL = strings.TrimSpace(config.Events.Webhook.URL)
+	if config.Events.Webhook.URL != "" {
+		u, err := url.Parse(config.Events.Webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid events.webhook.url %q", config.Events.Webhook.URL)
+		}
+		if config.Events.Webhook.Timeout == 0 {
+			return fmt.Errorf("events.webhook.timeout must be positive")
+		}
+	}
+	if len(config.Events.Command) != 0 && strings.TrimSpace(config.Events.Command[0]) == "" {
+		return fmt.Errorf("events.command must name a program")
+	}
+	if config.Events.Debounce > CACHE_MAX_TTL {
+		return fmt.Errorf("events.debounce must not exceed %d", CACHE_MAX_TTL)
+	}
 	if config.Dns.Address != nil {
 		address := strings.TrimSpace(*config.Dns.Address)
 		if _, _, err := net.SplitHostPort(address); err != nil {
@@ -111,6 +111,42 @@ func TestLoadConfigRejectsInvalidValues(t *testing.T) {
 			name: "unsupported permission bits",
 			body: "server:\n  address: 127.0.0.1:8642\n  socket-permissions: 01777\n",
 		},
+		{
+			name: "ttl min above max",
+			body: "server:\n  address: 127.0.0.1:8642\ncache:\n  ttl:\n    dane-only:\n      min: 7200\n      max: 3600\n",
+		},
+		{
+			name: "ttl max above limit",
+			body: "server:\n  address: 127.0.0.1:8642\ncache:\n  ttl:\n    none:\n      max: 99999999\n",
+		},
+		{
+			name: "negative prefetch rate",
+			body: "server:\n  address: 127.0.0.1:8642\nprefetch:\n  dns-rate: -1\n",
+		},
+		{
+			name: "probation without period",
+			body: "server:\n  address: 127.0.0.1:8642\nprobation:\n  enabled: true\n  period: 0\n",
+		},
+		{
+			name: "unknown server mode",
+			body: "server:\n  address: 127.0.0.1:8642\n  mode: audit\n",
+		},
+		{
+			name: "invalid shadow baseline",
+			body: "server:\n  address: 127.0.0.1:8642\n  mode: shadow\n  shadow-baseline: always\n",
+		},
+		{
+			name: "dane mapped to secure",
+			body: "server:\n  address: 127.0.0.1:8642\npolicy-mapping:\n  dane: secure\n",
+		},
+		{
+			name: "attribute replacing match",
+			body: "server:\n  address: 127.0.0.1:8642\npolicy-mapping:\n  domains:\n    example.com:\n      attributes: match=mx.example.com\n",
+		},
+		{
+			name: "webhook url without scheme",
+			body: "server:\n  address: 127.0.0.1:8642\nevents:\n  webhook:\n    url: alerts.example.com/hook\n",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -125,6 +161,99 @@ func TestLoadConfigRejectsInvalidValues(t *testing.T) {
 	}
 }
 
+func TestLoadConfigCacheTTLBounds(t *testing.T) {
+	initializeTestDefaultConfig(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+server:
+  address: 127.0.0.1:8642
+cache:
+  ttl:
+    dane-only:
+      max: 14400
+    none:
+      min: 86400
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("config with cache.ttl is not parseable: %v", err)
+	}
+	for _, tt := range []struct {
+		kind   string
+		lo, hi uint32
+	}{
+		{"dane-only", CACHE_MIN_TTL, 14400},
+		{"dane", CACHE_MIN_TTL, CACHE_MAX_TTL},
+		{"none", 86400, CACHE_MAX_TTL},
+	} {
+		if lo, hi := cfg.Cache.TTL.bounds(tt.kind); lo != tt.lo || hi != tt.hi {
+			t.Fatalf("%s bounds = %d..%d, want %d..%d", tt.kind, lo, hi, tt.lo, tt.hi)
+		}
+	}
+
+	original := config
+	t.Cleanup(func() { config = original })
+	config = cfg
+	if got := branchFromResult("dane-only", "", 86400); got.TTL != 14400 {
+		t.Fatalf("dane-only ttl = %d, want 14400", got.TTL)
+	}
+	if got := branchFromResult("", "", 0); got.TTL != 86400 {
+		t.Fatalf("no-policy ttl = %d, want 86400", got.TTL)
+	}
+	if got := mtaStsBranchFromResult("", "", 0); got.TTL != 86400 {
+		t.Fatalf("MTA-STS no-policy ttl = %d, want 86400", got.TTL)
+	}
+	if got := mtaStsBranchFromResult("", "", 60); got.TTL != 86400 {
+		t.Fatalf("MTA-STS no-policy ttl with configured minimum = %d, want 86400", got.TTL)
+	}
+	if got := mtaStsBranchFromResult("TEMP", "", 0); got.HasData() {
+		t.Fatalf("temporary failure was cached: %+v", got)
+	}
+}
+
+func TestMtaStsNoPolicyTTLHasNoDefaultMinimum(t *testing.T) {
+	original := config
+	t.Cleanup(func() { config = original })
+	config.Cache = CacheConfig{}
+	if got := mtaStsBranchFromResult("", "", 60); got.TTL != 60 {
+		t.Fatalf("MTA-STS no-policy ttl = %d, want 60", got.TTL)
+	}
+	if got := mtaStsBranchFromResult("", "", 0); got.TTL != CACHE_NOTFOUND_TTL {
+		t.Fatalf("MTA-STS no-policy ttl without TTL = %d, want %d", got.TTL, CACHE_NOTFOUND_TTL)
+	}
+	if got := branchFromResult("", "", 60); got.TTL != CACHE_MIN_TTL {
+		t.Fatalf("DANE no-policy ttl = %d, want %d", got.TTL, CACHE_MIN_TTL)
+	}
+}
+
+func TestLoadConfigPrefetchBudget(t *testing.T) {
+	initializeTestDefaultConfig(t)
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		body           string
+		dnsRate, https float64
+	}{
+		{"server:\n  address: 127.0.0.1:8642\n", 50, 10},
+		{"server:\n  address: 127.0.0.1:8642\nprefetch:\n  dns-rate: 2.5\n", 2.5, 10},
+		{"server:\n  address: 127.0.0.1:8642\nprefetch:\n  dns-rate: 0\n  https-rate: 1\n", 0, 1},
+	} {
+		path := filepath.Join(dir, "config.yaml")
+		if err := os.WriteFile(path, []byte(tt.body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadConfig(path)
+		if err != nil {
+			t.Fatalf("config %q is not parseable: %v", tt.body, err)
+		}
+		if cfg.Prefetch.DnsRate != tt.dnsRate || cfg.Prefetch.HttpsRate != tt.https {
+			t.Fatalf("config %q: prefetch = %+v, want %v/%v", tt.body, cfg.Prefetch, tt.dnsRate, tt.https)
+		}
+	}
+}
+
 func TestLoadConfigAllowsEmptyAddressForSystemdActivation(t *testing.T) {
 	initializeTestDefaultConfig(t)
 	path := filepath.Join(t.TempDir(), "config.yaml")
@@ -190,6 +319,36 @@ func TestLoadConfigRejectsOversizedInput(t *testing.T) {
 	}
 }
 
+func TestGetCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CREDENTIALS_DIRECTORY", "")
+	cfg := ServerConfig{}
+	if key, err := cfg.GetCacheKey(); err != nil || key != nil {
+		t.Fatalf("expected no key by default, got %q err=%v", key, err)
+	}
+
+	credential := []byte("credential-key-0123456789\n")
+	if err := os.WriteFile(filepath.Join(dir, CACHE_KEY_CREDENTIAL), credential, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	if key, err := cfg.GetCacheKey(); err != nil || !bytes.Equal(key, credential) {
+		t.Fatalf("expected systemd credential key, got %q err=%v", key, err)
+	}
+
+	cfg.CacheKeyFile = filepath.Join(dir, "short.key")
+	if err := os.WriteFile(cfg.CacheKeyFile, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.GetCacheKey(); err == nil {
+		t.Fatal("expected short cache key to be rejected")
+	}
+	cfg.CacheKeyFile = filepath.Join(dir, "missing.key")
+	if _, err := cfg.GetCacheKey(); err == nil {
+		t.Fatal("expected missing cache-key-file to be an error")
+	}
+}
+
 func initializeTestDefaultConfig(t *testing.T) {
 	t.Helper()
 	data, err := os.ReadFile("../configs/config.default.yaml")
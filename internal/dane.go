@@ -10,6 +10,7 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -45,7 +46,19 @@ func getMxRecords(ctx context.Context, domain string, resolverAddress string) ([
 	if err != nil || len(records) == 0 {
 		return nil, 0, err, incompl
 	}
+	return secureMxHosts(ctx, records, incompl, resolverAddress)
+}
+
+// getNextHopRecords is getMxRecords for a bracketed next-hop, whose host is
+// used as is. Only the TLSA records limit its TTL.
+func getNextHopRecords(ctx context.Context, h nextHop, resolverAddress string) ([]string, uint32, error, bool) {
+	return secureMxHosts(ctx, []mxRecord{{host: dnsutil.Fqdn(h.host), ttl: CACHE_MAX_TTL}}, false, resolverAddress)
+}
 
+// secureMxHosts returns the hosts of records with DNSSEC-signed addresses and
+// their minimum TTL. Hosts without are left out and mark the result
+// incomplete.
+func secureMxHosts(ctx context.Context, records []mxRecord, incompl bool, resolverAddress string) ([]string, uint32, error, bool) {
 	cctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	var lookupErr error
@@ -370,8 +383,8 @@ func isTlsaUsable(r *dns.TLSA) bool {
 	return true
 }
 
-func checkTlsa(ctx context.Context, mx string, resolverAddress string) ResultWithTTL {
-	m := newDNSQuery("_25._tcp."+mx, dns.TypeTLSA, true)
+func checkTlsa(ctx context.Context, mx string, port uint16, resolverAddress string) ResultWithTTL {
+	m := newDNSQuery("_"+strconv.Itoa(int(port))+"._tcp."+mx, dns.TypeTLSA, true)
 	r, err := exchangeDNS(ctx, m, resolverAddress)
 	if err != nil {
 		return ResultWithTTL{Result: "", TTL: 0, Err: err}
@@ -446,7 +459,24 @@ func checkDane(ctx context.Context, domain string, mayRetry bool) (string, uint3
 }
 
 func checkDaneOnce(ctx context.Context, domain string, resolverAddress string) (string, uint32, error) {
-	mxRecords, ttl, err, incompl := getMxRecords(ctx, domain, resolverAddress)
+	var (
+		mxRecords []string
+		ttl       uint32
+		err       error
+		incompl   bool
+	)
+	port := uint16(SMTP_PORT)
+	if h, ok := parseNextHop(domain); ok {
+		port = h.port
+		if h.bracketed {
+			// Postfix does not look up MX records for [host]
+			mxRecords, ttl, err, incompl = getNextHopRecords(ctx, h, resolverAddress)
+		} else {
+			mxRecords, ttl, err, incompl = getMxRecords(ctx, h.host, resolverAddress)
+		}
+	} else {
+		mxRecords, ttl, err, incompl = getMxRecords(ctx, domain, resolverAddress)
+	}
 	if err != nil {
 		return "", 0, err
 	}
@@ -455,11 +485,11 @@ func checkDaneOnce(ctx context.Context, domain string, resolverAddress string) (
 		return "", 0, nil
 	}
 	cctx, cancel := context.WithCancel(ctx)
-	tlsaResults := checkTlsaRecords(cctx, mxRecords, resolverAddress)
+	tlsaResults := checkTlsaRecords(cctx, mxRecords, port, resolverAddress)
 	return getDanePolicy(cctx, cancel, ttl, incompl, numRecords, tlsaResults)
 }
 
-func checkTlsaRecords(ctx context.Context, mxRecords []string, resolverAddress string) <-chan ResultWithTTL {
+func checkTlsaRecords(ctx context.Context, mxRecords []string, port uint16, resolverAddress string) <-chan ResultWithTTL {
 	results := make(chan ResultWithTTL, len(mxRecords))
 	if len(mxRecords) == 0 {
 		close(results)
@@ -467,7 +497,7 @@ func checkTlsaRecords(ctx context.Context, mxRecords []string, resolverAddress s
 	}
 	if len(mxRecords) == 1 {
 		if ctx.Err() == nil {
-			results <- checkTlsa(ctx, mxRecords[0], resolverAddress)
+			results <- checkTlsa(ctx, mxRecords[0], port, resolverAddress)
 		}
 		close(results)
 		return results
@@ -488,7 +518,7 @@ func checkTlsaRecords(ctx context.Context, mxRecords []string, resolverAddress s
 					if !ok {
 						return
 					}
-					result := checkTlsa(ctx, mx, resolverAddress)
+					result := checkTlsa(ctx, mx, port, resolverAddress)
 					select {
 					case results <- result:
 					case <-ctx.Done():
@@ -316,7 +316,7 @@ func TestCheckTlsaRecordsLimitsConcurrentLookups(t *testing.T) {
 		"mx3.tlsa.test.",
 		"mx4.tlsa.test.",
 		"mx5.tlsa.test.",
-	}, packetConn.LocalAddr().String())
+	}, SMTP_PORT, packetConn.LocalAddr().String())
 
 	count := 0
 	for result := range results {
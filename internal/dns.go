@@ -7,10 +7,67 @@ package tlspol
 
 import (
 	"context"
+	"log/slog"
+	"time"
 
 	"codeberg.org/miekg/dns"
 )
 
+// DNS_VALIDATION_AD is the only validation mode so far: the resolver validates
+// DNSSEC and its AD flag is trusted.
+const DNS_VALIDATION_AD = "resolver-ad"
+
+func init() {
+	onResolverChange = revalidateDaneBranches
+}
+
+// currentResolverIdentity names the resolver policy lookups are sent to.
+func currentResolverIdentity() string {
+	address, err := config.Dns.GetResolverAddress()
+	if err != nil {
+		return ""
+	}
+	return address
+}
+
+func withResolverProvenance(branch PolicyBranch, resolver string) PolicyBranch {
+	if branch.HasData() {
+		branch.Resolver = resolver
+		branch.Validation = DNS_VALIDATION_AD
+	}
+	return branch
+}
+
+// daneNeedsRevalidation reports whether a DANE branch was looked up through
+// another resolver or validation mode than the current one. Branches cached
+// before provenance was recorded are left to expire normally.
+func daneNeedsRevalidation(branch PolicyBranch, resolver string) bool {
+	if !branch.HasData() || branch.Resolver == "" || resolver == "" {
+		return false
+	}
+	return branch.Resolver != resolver || branch.Validation != DNS_VALIDATION_AD
+}
+
+// revalidateDaneBranches schedules every DANE branch obtained from another
+// resolver for the next prefetch batch. They are served until then.
+func revalidateDaneBranches() {
+	if polCache == nil || activePrefetchScheduler.Load() == nil {
+		return
+	}
+	resolver := currentResolverIdentity()
+	now := time.Now()
+	count := 0
+	for _, entry := range polCache.Items(false) {
+		if daneNeedsRevalidation(entry.Value.Dane, resolver) {
+			scheduleCachedPolicyPrefetch(entry.Key, entry.Value, now)
+			count++
+		}
+	}
+	if count != 0 {
+		slog.Info("Scheduled DANE revalidation after resolver change", "resolver", resolver, "domains", count)
+	}
+}
+
 func newDNSQuery(name string, qtype uint16, dnssecOK bool) *dns.Msg {
 	m := dns.NewMsg(name, qtype)
 	m.UDPSize = DNS_UDP_PAYLOAD_SIZE
@@ -19,6 +76,9 @@ func newDNSQuery(name string, qtype uint16, dnssecOK bool) *dns.Msg {
 }
 
 func exchangeDNS(ctx context.Context, m *dns.Msg, resolverAddress string) (*dns.Msg, error) {
+	if err := spendDNSBudget(ctx); err != nil {
+		return nil, err
+	}
 	r, _, err := client.Exchange(ctx, m, "udp", resolverAddress)
 	if err != nil {
 		return nil, err
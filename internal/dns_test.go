@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"codeberg.org/miekg/dns"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
 )
 
 type observedDNSQuery struct {
@@ -186,3 +187,54 @@ func TestExchangeDNSRetriesTruncatedUDPOverTCP(t *testing.T) {
 		t.Fatalf("expected one UDP query and one TCP retry, got udp=%d tcp=%d", udpQueries.Load(), tcpQueries.Load())
 	}
 }
+
+func TestResolverChangeSchedulesDaneRevalidation(t *testing.T) {
+	useTestPolicyCache(t)
+	now := time.Now()
+	oldScheduler := activePrefetchScheduler.Load()
+	scheduler := newPrefetchSchedulerAt(now, 3)
+	activePrefetchScheduler.Store(scheduler)
+	t.Cleanup(func() { activePrefetchScheduler.Store(oldScheduler) })
+
+	resolver := currentResolverIdentity()
+	if resolver == "" {
+		t.Skip("no resolver configured")
+	}
+	entry := func(resolver string) *CacheStruct {
+		expiresAt := now.Add(time.Hour)
+		return &CacheStruct{
+			Expirable: &cache.Expirable{ExpiresAt: expiresAt},
+			Policy:    "dane-only",
+			TTL:       3600,
+			Dane: withResolverProvenance(PolicyBranch{
+				Policy:    "dane-only",
+				TTL:       3600,
+				ExpiresAt: expiresAt,
+			}, resolver),
+		}
+	}
+	polCache.Set("current.example", entry(resolver))
+	polCache.Set("previous.example", entry("192.0.2.53:53"))
+	legacy := entry("")
+	legacy.Dane.Resolver, legacy.Dane.Validation = "", ""
+	polCache.Set("legacy.example", legacy)
+
+	if c, _ := polCache.Get("current.example"); c.Dane.Validation != DNS_VALIDATION_AD {
+		t.Fatalf("expected validation mode %q, got %q", DNS_VALIDATION_AD, c.Dane.Validation)
+	}
+	revalidateDaneBranches()
+
+	if _, _, ok := scheduler.status("current.example"); ok {
+		t.Fatal("expected branch from the current resolver not to be rescheduled")
+	}
+	if _, _, ok := scheduler.status("legacy.example"); ok {
+		t.Fatal("expected branch without provenance not to be rescheduled")
+	}
+	due, _, ok := scheduler.status("previous.example")
+	if !ok {
+		t.Fatal("expected branch from the previous resolver to be scheduled")
+	}
+	if due.Before(scheduler.batchAtOrAfter(now)) || due.After(scheduler.batchAtOrAfter(time.Now())) {
+		t.Fatalf("expected revalidation in the next batch, got %s", due)
+	}
+}
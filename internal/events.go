@@ -0,0 +1,399 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	EVENT_QUEUE_SIZE          = 1024
+	EVENT_WEBHOOK_RETRY_DELAY = time.Second // doubled after every failed attempt
+	EVENT_COMMAND_TIMEOUT     = 30 * time.Second
+	EVENT_RESPONSE_MAX_SIZE   = 64 << 10
+	EVENT_SHUTDOWN_TIMEOUT    = 5 * time.Second // for delivering pending events on shutdown
+)
+
+var activeEventDispatcher atomic.Pointer[eventDispatcher]
+
+// PolicyEvent is a policy change of a domain as delivered to the sinks.
+// Policies are named like in the logs: none, sts, dane and dane-only.
+type PolicyEvent struct {
+	Time           time.Time `json:"time"`
+	Version        string    `json:"version"`
+	Domain         string    `json:"domain"`
+	Event          string    `json:"event"`
+	PreviousPolicy string    `json:"previous-policy"`
+	CurrentPolicy  string    `json:"current-policy"`
+	Source         string    `json:"source"` // lookup or prefetch
+}
+
+// policyState is what events are derived from. A branch that was never
+// looked up is unknown and does not produce published or withdrawn events.
+type policyState struct {
+	policy      string
+	dane        string
+	mtaSts      string
+	daneKnown   bool
+	mtaStsKnown bool
+}
+
+func policyStateOf(c *CacheStruct, now time.Time) policyState {
+	return policyState{
+		policy:      firstWord(cachedPolicyForPrefetchTransition(c, now)),
+		dane:        firstWord(c.Dane.Policy),
+		mtaSts:      firstWord(c.MtaSts.Policy),
+		daneKnown:   c.Dane.HasData(),
+		mtaStsKnown: c.MtaSts.HasData(),
+	}
+}
+
+// policyEvents lists the events of the transition from before to after.
+func policyEvents(domain string, before policyState, after policyState, source string, now time.Time) []PolicyEvent {
+	var kinds []string
+	if before.daneKnown && after.daneKnown {
+		if before.dane == "" && after.dane != "" {
+			kinds = append(kinds, "dane-published")
+		} else if before.dane != "" && after.dane == "" {
+			kinds = append(kinds, "dane-withdrawn")
+		}
+	}
+	if before.mtaStsKnown && after.mtaStsKnown {
+		if before.mtaSts == "" && after.mtaSts != "" {
+			kinds = append(kinds, "mta-sts-published")
+		} else if before.mtaSts != "" && after.mtaSts == "" {
+			kinds = append(kinds, "mta-sts-withdrawn")
+		}
+	}
+	previousName, currentName, downgraded := isPrefetchedPolicyDowngrade(before.policy, after.policy)
+	if downgraded {
+		kinds = append(kinds, "downgrade")
+	}
+	events := make([]PolicyEvent, 0, len(kinds))
+	for _, kind := range kinds {
+		events = append(events, PolicyEvent{
+			Time:           now,
+			Version:        Version,
+			Domain:         domain,
+			Event:          kind,
+			PreviousPolicy: previousName,
+			CurrentPolicy:  currentName,
+			Source:         source,
+		})
+	}
+	return events
+}
+
+type eventSink interface {
+	name() string
+	deliver(ctx context.Context, event PolicyEvent, body []byte) error
+}
+
+type pendingPolicyChange struct {
+	timer  *time.Timer
+	source string
+	before policyState
+	after  policyState
+}
+
+// eventDispatcher debounces policy changes per domain and delivers their
+// events to the sinks from a single worker.
+type eventDispatcher struct {
+	queue    chan PolicyEvent
+	pending  map[string]*pendingPolicyChange
+	sinks    []eventSink
+	debounce time.Duration
+	mu       sync.Mutex
+}
+
+// newEventDispatcher returns nil if no sink is configured.
+func newEventDispatcher(cfg EventsConfig) *eventDispatcher {
+	var sinks []eventSink
+	if cfg.Webhook.URL != "" {
+		sinks = append(sinks, &webhookSink{
+			url:        cfg.Webhook.URL,
+			retries:    cfg.Webhook.Retries,
+			retryDelay: EVENT_WEBHOOK_RETRY_DELAY,
+			client:     &http.Client{Timeout: time.Duration(cfg.Webhook.Timeout) * time.Second},
+		})
+	}
+	if len(cfg.Command) != 0 {
+		sinks = append(sinks, &commandSink{argv: cfg.Command})
+	}
+	if cfg.Syslog {
+		sinks = append(sinks, &syslogSink{})
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	return &eventDispatcher{
+		queue:    make(chan PolicyEvent, EVENT_QUEUE_SIZE),
+		pending:  make(map[string]*pendingPolicyChange),
+		sinks:    sinks,
+		debounce: time.Duration(cfg.Debounce) * time.Second,
+	}
+}
+
+// notifyPolicyChange reports the change of a domain from the cached entry
+// previous to current, which was refreshed by source.
+func notifyPolicyChange(domain string, previous *CacheStruct, current *CacheStruct, source string, now time.Time) {
+	d := activeEventDispatcher.Load()
+	if d == nil || previous == nil || current == nil {
+		return
+	}
+	if _, _, _, ok := selectCachedPolicy(current, now); !ok {
+		return
+	}
+	d.change(domain, policyStateOf(previous, now), policyStateOf(current, now), source, now)
+}
+
+// notifyPolicyDiscard reports that the cached policy of a domain, previous,
+// was discarded and no policy is served until the domain is looked up again.
+func notifyPolicyDiscard(domain string, previous *CacheStruct, source string, now time.Time) {
+	d := activeEventDispatcher.Load()
+	if d == nil || previous == nil {
+		return
+	}
+	discarded := policyState{daneKnown: previous.Dane.HasData(), mtaStsKnown: previous.MtaSts.HasData()}
+	d.change(domain, policyStateOf(previous, now), discarded, source, now)
+}
+
+func (d *eventDispatcher) change(domain string, before policyState, after policyState, source string, now time.Time) {
+	d.mu.Lock()
+	p := d.pending[domain]
+	if p == nil {
+		if before == after {
+			d.mu.Unlock()
+			return
+		}
+		if d.debounce <= 0 {
+			d.mu.Unlock()
+			d.enqueue(policyEvents(domain, before, after, source, now))
+			return
+		}
+		p = &pendingPolicyChange{before: before}
+		p.timer = time.AfterFunc(d.debounce, func() { d.flush(domain) })
+		d.pending[domain] = p
+	}
+	p.after, p.source = after, source
+	d.mu.Unlock()
+}
+
+// flush delivers the net change of a domain once its debounce period ended.
+// A change that was reverted meanwhile produces no events.
+func (d *eventDispatcher) flush(domain string) {
+	d.mu.Lock()
+	p := d.pending[domain]
+	delete(d.pending, domain)
+	d.mu.Unlock()
+	if p != nil {
+		d.enqueue(policyEvents(domain, p.before, p.after, p.source, time.Now()))
+	}
+}
+
+func (d *eventDispatcher) enqueue(events []PolicyEvent) {
+	for _, event := range events {
+		observePolicyEvent(event.Event)
+		select {
+		case d.queue <- event:
+		default:
+			slog.Warn("Dropped policy event, delivery queue is full", "domain", event.Domain, "event", event.Event)
+			for _, sink := range d.sinks {
+				observeEventDeliveryFailure(sink.name())
+			}
+		}
+	}
+}
+
+func (d *eventDispatcher) run(ctx context.Context) {
+	defer func() {
+		for _, sink := range d.sinks {
+			if closer, ok := sink.(io.Closer); ok {
+				_ = closer.Close()
+			}
+		}
+	}()
+	for {
+		select {
+		case event := <-d.queue:
+			d.deliver(ctx, event)
+		case <-ctx.Done():
+			d.shutdown()
+			return
+		}
+	}
+}
+
+// shutdown flushes the changes still being debounced and delivers the queued
+// events within EVENT_SHUTDOWN_TIMEOUT. Events left after that are dropped.
+func (d *eventDispatcher) shutdown() {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = make(map[string]*pendingPolicyChange)
+	d.mu.Unlock()
+	now := time.Now()
+	for domain, p := range pending {
+		p.timer.Stop()
+		d.enqueue(policyEvents(domain, p.before, p.after, p.source, now))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), EVENT_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	dropped := 0
+	for {
+		select {
+		case event := <-d.queue:
+			if ctx.Err() == nil {
+				d.deliver(ctx, event)
+				continue
+			}
+			dropped++
+			for _, sink := range d.sinks {
+				observeEventDeliveryFailure(sink.name())
+			}
+		default:
+			if dropped != 0 {
+				slog.Warn("Dropped policy events on shutdown", "count", dropped)
+			}
+			return
+		}
+	}
+}
+
+func (d *eventDispatcher) deliver(ctx context.Context, event PolicyEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, sink := range d.sinks {
+		if err := sink.deliver(ctx, event, body); err != nil {
+			observeEventDeliveryFailure(sink.name())
+			slog.Warn("Could not deliver policy event", "sink", sink.name(), "domain", event.Domain, "event", event.Event, "error", err)
+		}
+	}
+}
+
+type webhookSink struct {
+	client     *http.Client
+	url        string
+	retryDelay time.Duration
+	retries    uint32
+}
+
+func (s *webhookSink) name() string {
+	return "webhook"
+}
+
+func (s *webhookSink) deliver(ctx context.Context, _ PolicyEvent, body []byte) error {
+	delay := s.retryDelay
+	for attempt := uint32(0); ; attempt++ {
+		err := s.post(ctx, body)
+		if err == nil || attempt >= s.retries {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
+
+func (s *webhookSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "postfix-tlspol/"+Version)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, EVENT_RESPONSE_MAX_SIZE))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// commandSink runs a command for every event, with the event as a line of
+// JSON on its standard input.
+type commandSink struct {
+	argv []string
+}
+
+func (s *commandSink) name() string {
+	return "command"
+}
+
+func (s *commandSink) deliver(ctx context.Context, _ PolicyEvent, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, EVENT_COMMAND_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.argv[0], s.argv[1:]...)
+	cmd.Stdin = bytes.NewReader(append(body, '\n'))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if output := strings.TrimSpace(string(output)); output != "" {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+// syslogSink logs events to the mail facility. It connects on the first
+// event and again after a failed write.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func (s *syslogSink) name() string {
+	return "syslog"
+}
+
+func (s *syslogSink) deliver(_ context.Context, event PolicyEvent, _ []byte) error {
+	if s.writer == nil {
+		writer, err := syslog.New(syslog.LOG_MAIL|syslog.LOG_INFO, "postfix-tlspol")
+		if err != nil {
+			return err
+		}
+		s.writer = writer
+	}
+	message := fmt.Sprintf("policy %s domain=%s previous=%s current=%s source=%s", event.Event, event.Domain, event.PreviousPolicy, event.CurrentPolicy, event.Source)
+	var err error
+	if event.Event == "downgrade" || strings.HasSuffix(event.Event, "-withdrawn") {
+		err = s.writer.Warning(message)
+	} else {
+		err = s.writer.Info(message)
+	}
+	if err != nil {
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+	return err
+}
+
+func (s *syslogSink) Close() error {
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Close()
+}
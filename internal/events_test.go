@@ -0,0 +1,234 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+)
+
+type recordingSink struct {
+	events []PolicyEvent
+	mu     sync.Mutex
+}
+
+func (s *recordingSink) name() string {
+	return "command"
+}
+
+func (s *recordingSink) deliver(_ context.Context, event PolicyEvent, _ []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *recordingSink) recorded() []PolicyEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PolicyEvent(nil), s.events...)
+}
+
+func startTestEventDispatcher(t *testing.T, debounce time.Duration, sink eventSink) *eventDispatcher {
+	t.Helper()
+	d := newEventDispatcher(EventsConfig{Command: []string{"true"}})
+	d.sinks = []eventSink{sink}
+	d.debounce = debounce
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.run(ctx)
+	}()
+	activeEventDispatcher.Store(d)
+	t.Cleanup(func() {
+		activeEventDispatcher.Store(nil)
+		cancel()
+		<-done
+	})
+	return d
+}
+
+func waitForEvents(t *testing.T, sink *recordingSink, count int) []PolicyEvent {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if events := sink.recorded(); len(events) >= count {
+			return events
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected %d events, got %+v", count, sink.recorded())
+	return nil
+}
+
+func TestPolicyEventsAreDebouncedPerDomain(t *testing.T) {
+	sink := &recordingSink{}
+	startTestEventDispatcher(t, 50*time.Millisecond, sink)
+	now := time.Now()
+
+	// A downgrade reverted within the debounce period is not reported.
+	flapping := pinTestEntry(now)
+	withdrawn := mergeCacheResult(flapping, testDomainResult("", "", ""), now)
+	notifyPolicyChange("flapping.example", flapping, withdrawn, "prefetch", now)
+	restored := mergeCacheResult(withdrawn, domainResult{Dane: branchFromResult("dane-only", "", 3600), DaneAttempted: true}, now)
+	notifyPolicyChange("flapping.example", withdrawn, restored, "prefetch", now)
+
+	previous := pinTestEntry(now)
+	notifyPolicyChange("downgraded.example", previous, mergeCacheResult(previous, testDomainResult("", "", ""), now), "lookup", now)
+
+	waitForEvents(t, sink, 2)
+	time.Sleep(100 * time.Millisecond)
+	events := sink.recorded()
+	if len(events) != 2 {
+		t.Fatalf("expected two events, got %+v", events)
+	}
+	for i, want := range []string{"dane-withdrawn", "downgrade"} {
+		event := events[i]
+		if event.Domain != "downgraded.example" || event.Event != want || event.Source != "lookup" {
+			t.Fatalf("event %d = %+v, want %s of downgraded.example", i, event, want)
+		}
+		if event.PreviousPolicy != "dane-only" || event.CurrentPolicy != "none" {
+			t.Fatalf("event %d policies = %s -> %s, want dane-only -> none", i, event.PreviousPolicy, event.CurrentPolicy)
+		}
+	}
+}
+
+func TestPolicyEventsReportFailedPrefetchDiscards(t *testing.T) {
+	useTestPolicyCache(t)
+	sink := &recordingSink{}
+	startTestEventDispatcher(t, 0, sink)
+	now := time.Now()
+	scheduler := newPrefetchScheduler()
+	failPrefetch := func(key string, c *CacheStruct, result domainResult) {
+		polCache.Set(key, c)
+		scheduler.failures[key] = prefetchFailure{firstFailed: now.Add(-PREFETCH_RETRY_MAX_AGE), attempts: 8}
+		scheduleFailedPolicyPrefetch(scheduler, key, c, result, now)
+	}
+
+	failPrefetch("discarded.example", pinTestEntry(now), domainResult{})
+	failPrefetch("sts-only.example", &CacheStruct{
+		Expirable: &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+		Dane:      PolicyBranch{Policy: "dane-only", TTL: 300, ExpiresAt: now.Add(-25 * time.Hour)},
+		MtaSts:    PolicyBranch{Policy: "secure match=mx.example", Report: "policy_type=sts", TTL: 86400, ExpiresAt: now.Add(time.Hour)},
+	}, domainResult{DaneAttempted: true})
+
+	events := waitForEvents(t, sink, 4)
+	for i, want := range []struct{ domain, event, current string }{
+		{"discarded.example", "dane-withdrawn", "none"},
+		{"discarded.example", "downgrade", "none"},
+		{"sts-only.example", "dane-withdrawn", "sts"},
+		{"sts-only.example", "downgrade", "sts"},
+	} {
+		event := events[i]
+		if event.Domain != want.domain || event.Event != want.event || event.Source != "prefetch" ||
+			event.PreviousPolicy != "dane-only" || event.CurrentPolicy != want.current {
+			t.Fatalf("event %d = %+v, want %s of %s", i, event, want.event, want.domain)
+		}
+	}
+}
+
+func TestPolicyEventsAreFlushedOnShutdown(t *testing.T) {
+	sink := &recordingSink{}
+	d := newEventDispatcher(EventsConfig{Command: []string{"true"}})
+	d.sinks = []eventSink{sink}
+	d.debounce = time.Hour
+	now := time.Now()
+	previous := pinTestEntry(now)
+	current := mergeCacheResult(previous, testDomainResult("", "", ""), now)
+	d.change("pending.example", policyStateOf(previous, now), policyStateOf(current, now), "prefetch", now)
+	d.enqueue([]PolicyEvent{{Domain: "queued.example", Event: "dane-published"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.run(ctx)
+	domains := map[string]bool{}
+	for _, event := range sink.recorded() {
+		domains[event.Domain] = true
+	}
+	if !domains["pending.example"] || !domains["queued.example"] {
+		t.Fatalf("events delivered on shutdown = %+v, want the queued and the debounced ones", sink.recorded())
+	}
+	if len(d.pending) != 0 {
+		t.Fatalf("pending changes left after shutdown: %d", len(d.pending))
+	}
+}
+
+func TestWebhookSinkRetriesFailedDeliveries(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []PolicyEvent
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		var event PolicyEvent
+		if err := json.Unmarshal(data, &event); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bodies = append(bodies, event)
+	}))
+	defer server.Close()
+
+	sink := &webhookSink{client: server.Client(), url: server.URL, retries: 2, retryDelay: time.Millisecond}
+	d := &eventDispatcher{sinks: []eventSink{sink}}
+	d.deliver(context.Background(), PolicyEvent{Domain: "example.com", Event: "mta-sts-withdrawn"})
+	mu.Lock()
+	if attempts != 2 || len(bodies) != 1 || bodies[0].Domain != "example.com" || bodies[0].Event != "mta-sts-withdrawn" {
+		t.Fatalf("attempts = %d, delivered = %+v", attempts, bodies)
+	}
+	mu.Unlock()
+
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	failures := metricEventFailWebhook.Load()
+	sink.url, sink.retries = failing.URL, 0
+	d.deliver(context.Background(), PolicyEvent{Domain: "example.com", Event: "downgrade"})
+	if got := metricEventFailWebhook.Load(); got != failures+1 {
+		t.Fatalf("webhook delivery failures = %d, want %d", got, failures+1)
+	}
+}
+
+func TestCommandSinkPipesEventToStdin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "event.json")
+	sink := &commandSink{argv: []string{"sh", "-c", `cat > "$0"`, path}}
+	failures := metricEventFailCommand.Load()
+	d := &eventDispatcher{sinks: []eventSink{sink}}
+	d.deliver(context.Background(), PolicyEvent{Domain: "example.com", Event: "dane-published", CurrentPolicy: "dane"})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event PolicyEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatalf("command received %q: %v", data, err)
+	}
+	if event.Domain != "example.com" || event.Event != "dane-published" || event.CurrentPolicy != "dane" {
+		t.Fatalf("command received %+v", event)
+	}
+
+	sink.argv = []string{"sh", "-c", "exit 3"}
+	d.deliver(context.Background(), PolicyEvent{Domain: "example.com", Event: "dane-published"})
+	if got := metricEventFailCommand.Load(); got != failures+1 {
+		t.Fatalf("command delivery failures = %d, want %d", got, failures+1)
+	}
+}
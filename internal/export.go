@@ -0,0 +1,462 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+)
+
+const (
+	CACHE_IMPORT_MAX_LINE    = 256 << 10
+	CACHE_IMPORT_MAX_ENTRIES = 2 * CACHE_MAX_ENTRIES
+	CACHE_IMPORT_MERGE       = "merge"
+	CACHE_IMPORT_REPLACE     = "replace"
+	CACHE_IMPORT_MAX_CLOCK   = 5 * time.Minute // tolerated clock skew between exporting and importing relay
+)
+
+var POLICY_HISTORY_REASONS = []string{"lookup", "prefetch", "prefetch-failure", "discard"}
+
+// cacheExportBranch and cacheExportEntry are the JSON lines representation of
+// a CacheStruct used by CACHEEXPORT and CACHEIMPORT.
+type cacheExportBranch struct {
+	ExpiresAt  time.Time `json:"expires,omitzero"`
+	Policy     string    `json:"policy"`
+	Report     string    `json:"report,omitempty"`
+	Resolver   string    `json:"resolver,omitempty"`
+	Validation string    `json:"validation,omitempty"`
+	TTL        uint32    `json:"ttl"`
+}
+
+type cacheExportPin struct {
+	Since   time.Time          `json:"since"`
+	Dane    *cacheExportBranch `json:"dane,omitempty"`
+	MtaSts  *cacheExportBranch `json:"mta-sts,omitempty"`
+	Policy  string             `json:"policy"`
+	Seen    string             `json:"seen"`
+	Lookups uint32             `json:"lookups"`
+}
+
+type cacheExportProbation struct {
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	Policy string    `json:"policy"`
+}
+
+type cacheExportEntry struct {
+	ExpiresAt         time.Time             `json:"expires,omitzero"`
+	DaneLastAttempt   time.Time             `json:"dane-last-attempt,omitzero"`
+	MtaStsLastAttempt time.Time             `json:"mta-sts-last-attempt,omitzero"`
+	LastQueried       time.Time             `json:"last-queried,omitzero"`
+	Dane              *cacheExportBranch    `json:"dane,omitempty"`
+	MtaSts            *cacheExportBranch    `json:"mta-sts,omitempty"`
+	Pin               *cacheExportPin       `json:"pin,omitempty"`
+	Probation         *cacheExportProbation `json:"probation,omitempty"`
+	Domain            string                `json:"domain"`
+	Policy            string                `json:"policy"`
+	Report            string                `json:"report,omitempty"`
+	History           []PolicyChange        `json:"history,omitempty"`
+	TTL               uint32                `json:"ttl"`
+	Counter           uint32                `json:"counter"`
+}
+
+func exportBranch(branch PolicyBranch) *cacheExportBranch {
+	if !branch.HasData() {
+		return nil
+	}
+	return &cacheExportBranch{
+		ExpiresAt:  branch.ExpiresAt.UTC(),
+		Policy:     branch.Policy,
+		Report:     branch.Report,
+		Resolver:   branch.Resolver,
+		Validation: branch.Validation,
+		TTL:        branch.TTL,
+	}
+}
+
+func newCacheExportEntry(domain string, c *CacheStruct) cacheExportEntry {
+	e := cacheExportEntry{
+		DaneLastAttempt:   c.DaneLastAttempt.UTC(),
+		MtaStsLastAttempt: c.MtaStsLastAttempt.UTC(),
+		LastQueried:       cacheEntryLastQueried(domain, c).UTC(),
+		Dane:              exportBranch(c.Dane),
+		MtaSts:            exportBranch(c.MtaSts),
+		Domain:            domain,
+		Policy:            c.Policy,
+		Report:            c.Report,
+		TTL:               c.TTL,
+		Counter:           cacheEntryCounter(domain, c),
+	}
+	if c.Expirable != nil {
+		e.ExpiresAt = c.Expirable.ExpiresAt.UTC()
+	}
+	if p := c.Pin; p != nil {
+		e.Pin = &cacheExportPin{
+			Since:   p.Since.UTC(),
+			Dane:    exportBranch(p.Dane),
+			MtaSts:  exportBranch(p.MtaSts),
+			Policy:  p.Policy,
+			Seen:    p.Seen,
+			Lookups: p.Lookups,
+		}
+	}
+	if p := c.Probation; p != nil {
+		e.Probation = &cacheExportProbation{Since: p.Since.UTC(), Until: p.Until.UTC(), Policy: p.Policy}
+	}
+	for _, change := range c.History {
+		change.Time = change.Time.UTC()
+		e.History = append(e.History, change)
+	}
+	return e
+}
+
+func printableASCII(s string) bool {
+	return !strings.ContainsFunc(s, func(r rune) bool { return r < ' ' || r > '~' })
+}
+
+func validCachedPolicy(policy string, allowed ...string) bool {
+	return printableASCII(policy) && slices.Contains(allowed, firstWord(policy))
+}
+
+func validExportTime(name string, t time.Time, latest time.Time) error {
+	if t.After(latest) {
+		return fmt.Errorf("%s %s is too far in the future", name, t.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (b *cacheExportBranch) policyBranch(name string, latest time.Time, allowed ...string) (PolicyBranch, error) {
+	if b == nil {
+		return PolicyBranch{}, nil
+	}
+	if !validCachedPolicy(b.Policy, allowed...) || !printableASCII(b.Report) {
+		return PolicyBranch{}, fmt.Errorf("invalid %s policy %q", name, b.Policy)
+	}
+	if !printableASCII(b.Resolver) || !printableASCII(b.Validation) {
+		return PolicyBranch{}, fmt.Errorf("invalid %s provenance %q", name, b.Resolver)
+	}
+	if b.TTL > CACHE_MAX_TTL {
+		return PolicyBranch{}, fmt.Errorf("%s ttl %d exceeds %d", name, b.TTL, CACHE_MAX_TTL)
+	}
+	if err := validExportTime(name+" expiry", b.ExpiresAt, latest); err != nil {
+		return PolicyBranch{}, err
+	}
+	branch := PolicyBranch{
+		ExpiresAt:  b.ExpiresAt,
+		Policy:     b.Policy,
+		Report:     b.Report,
+		Resolver:   b.Resolver,
+		Validation: b.Validation,
+		TTL:        b.TTL,
+	}
+	if !branch.HasData() {
+		return PolicyBranch{}, fmt.Errorf("%s branch has neither ttl nor expiry", name)
+	}
+	return branch, nil
+}
+
+func (p *cacheExportPin) policyPin(latest time.Time) (*PolicyPin, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if !validCachedPolicy(p.Policy, "dane", "dane-only", "secure") || !printableASCII(p.Seen) || strings.Contains(p.Seen, " ") {
+		return nil, fmt.Errorf("invalid pin policy %q", p.Policy)
+	}
+	if err := validExportTime("pin since", p.Since, latest); err != nil {
+		return nil, err
+	}
+	dane, err := p.Dane.policyBranch("pin dane", latest, "", "dane", "dane-only")
+	if err != nil {
+		return nil, err
+	}
+	mtaSts, err := p.MtaSts.policyBranch("pin mta-sts", latest, "", "secure")
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyPin{Since: p.Since, Dane: dane, MtaSts: mtaSts, Policy: p.Policy, Seen: p.Seen, Lookups: p.Lookups}, nil
+}
+
+func (p *cacheExportProbation) policyProbation(latest time.Time) (*PolicyProbation, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if probationForm(p.Policy) == "" {
+		return nil, fmt.Errorf("invalid probation policy %q", p.Policy)
+	}
+	if p.Until.Before(p.Since) {
+		return nil, errors.New("probation ends before it starts")
+	}
+	if err := validExportTime("probation until", p.Until, latest); err != nil {
+		return nil, err
+	}
+	return &PolicyProbation{Since: p.Since, Until: p.Until, Policy: p.Policy}, nil
+}
+
+func validPolicyHistory(history []PolicyChange, latest time.Time) error {
+	if len(history) > POLICY_HISTORY_MAX {
+		return fmt.Errorf("history exceeds %d changes", POLICY_HISTORY_MAX)
+	}
+	for i, change := range history {
+		if !validCachedPolicy(change.New, "none", "dane", "dane-only", "secure") ||
+			!validCachedPolicy(change.Old, "", "none", "dane", "dane-only", "secure") {
+			return fmt.Errorf("invalid history policy %q", change.New)
+		}
+		if !slices.Contains([]string{"", "dane", "mta-sts"}, change.Branch) || !slices.Contains(POLICY_HISTORY_REASONS, change.Reason) {
+			return fmt.Errorf("invalid history change %q from %q", change.Reason, change.Branch)
+		}
+		if change.TTL > CACHE_MAX_TTL {
+			return fmt.Errorf("history ttl %d exceeds %d", change.TTL, CACHE_MAX_TTL)
+		}
+		if err := validExportTime("history time", change.Time, latest); err != nil {
+			return err
+		}
+		if i != 0 && change.Time.Before(history[i-1].Time) {
+			return errors.New("history is not in order")
+		}
+	}
+	return nil
+}
+
+// cacheStruct validates an imported entry and converts it back into the form
+// stored in polCache.
+func (e cacheExportEntry) cacheStruct(now time.Time) (string, *CacheStruct, error) {
+	domain, ok := normalizePolicyKey(e.Domain)
+	if !ok || domain != e.Domain {
+		return "", nil, fmt.Errorf("invalid domain %q", e.Domain)
+	}
+	latest := now.Add(time.Duration(CACHE_MAX_TTL)*time.Second + CACHE_IMPORT_MAX_CLOCK)
+	dane, err := e.Dane.policyBranch("dane", latest, "", "dane", "dane-only")
+	if err != nil {
+		return "", nil, err
+	}
+	mtaSts, err := e.MtaSts.policyBranch("mta-sts", latest, "", "secure")
+	if err != nil {
+		return "", nil, err
+	}
+	if !validCachedPolicy(e.Policy, "", "dane", "dane-only", "secure") || !printableASCII(e.Report) {
+		return "", nil, fmt.Errorf("invalid policy %q", e.Policy)
+	}
+	if e.TTL > CACHE_MAX_TTL {
+		return "", nil, fmt.Errorf("ttl %d exceeds %d", e.TTL, CACHE_MAX_TTL)
+	}
+	for _, t := range []struct {
+		name string
+		time time.Time
+	}{
+		{"expiry", e.ExpiresAt},
+		{"dane-last-attempt", e.DaneLastAttempt},
+		{"mta-sts-last-attempt", e.MtaStsLastAttempt},
+		{"last-queried", e.LastQueried},
+	} {
+		if err := validExportTime(t.name, t.time, latest); err != nil {
+			return "", nil, err
+		}
+	}
+	pin, err := e.Pin.policyPin(latest)
+	if err != nil {
+		return "", nil, err
+	}
+	probation, err := e.Probation.policyProbation(latest)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := validPolicyHistory(e.History, latest); err != nil {
+		return "", nil, err
+	}
+	return domain, &CacheStruct{
+		DaneLastAttempt:   e.DaneLastAttempt,
+		MtaStsLastAttempt: e.MtaStsLastAttempt,
+		LastQueried:       e.LastQueried,
+		Expirable:         &cache.Expirable{ExpiresAt: e.ExpiresAt},
+		Policy:            e.Policy,
+		Report:            e.Report,
+		Dane:              dane,
+		MtaSts:            mtaSts,
+		TTL:               e.TTL,
+		Counter:           e.Counter,
+		Pin:               pin,
+		Probation:         probation,
+		History:           slices.Clip(e.History),
+	}, nil
+}
+
+func writeCacheExport(w io.Writer, entries []cache.Entry[*CacheStruct]) error {
+	slices.SortFunc(entries, func(a, b cache.Entry[*CacheStruct]) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		if entry.Value == nil {
+			continue
+		}
+		if err := enc.Encode(newCacheExportEntry(entry.Key, entry.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type cacheImportError struct {
+	err  error
+	line int
+}
+
+func (e *cacheImportError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+func (e *cacheImportError) Unwrap() error {
+	return e.err
+}
+
+// readCacheImport parses and validates all JSON lines before anything is
+// applied, so a bad file never leaves a half-imported cache. Entries that
+// have already expired are skipped.
+func readCacheImport(r io.Reader, now time.Time, beforeLine func() error) ([]cache.Entry[*CacheStruct], int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), CACHE_IMPORT_MAX_LINE)
+	var (
+		entries []cache.Entry[*CacheStruct]
+		skipped int
+		line    int
+	)
+	seen := make(map[string]struct{})
+	for {
+		if beforeLine != nil {
+			if err := beforeLine(); err != nil {
+				return nil, 0, err
+			}
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line++
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" {
+			continue
+		}
+		var e cacheExportEntry
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return nil, 0, &cacheImportError{line: line, err: err}
+		}
+		if dec.More() {
+			return nil, 0, &cacheImportError{line: line, err: errors.New("trailing data after entry")}
+		}
+		domain, c, err := e.cacheStruct(now)
+		if err != nil {
+			return nil, 0, &cacheImportError{line: line, err: err}
+		}
+		if _, dup := seen[domain]; dup {
+			return nil, 0, &cacheImportError{line: line, err: fmt.Errorf("duplicate domain %q", domain)}
+		}
+		if len(seen) >= CACHE_IMPORT_MAX_ENTRIES {
+			return nil, 0, &cacheImportError{line: line, err: fmt.Errorf("more than %d entries", CACHE_IMPORT_MAX_ENTRIES)}
+		}
+		seen[domain] = struct{}{}
+		if c.RemainingTTL(now) == 0 {
+			skipped++
+			continue
+		}
+		entries = append(entries, cache.Entry[*CacheStruct]{Key: domain, Value: c})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, &cacheImportError{line: line + 1, err: err}
+	}
+	return entries, skipped, nil
+}
+
+// applyCacheImport stores validated entries in polCache. In merge mode an
+// existing entry is only replaced by one that stays valid for longer, and the
+// higher of both counters, the later query time, both histories and the pin
+// and probation of the existing entry, unless imported, are kept.
+func applyCacheImport(entries []cache.Entry[*CacheStruct], mode string, now time.Time) (int, int, error) {
+	if mode == CACHE_IMPORT_REPLACE {
+		err := polCache.Purge()
+		flushCacheHitCounters(false)
+		clearPrefetchSchedule()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	imported, kept := 0, 0
+	for _, entry := range entries {
+		polCache.Update(false, entry.Key, func(current *CacheStruct, found bool) (*CacheStruct, bool) {
+			if found && current != nil {
+				if current.RemainingTTL(now) >= entry.Value.RemainingTTL(now) {
+					kept++
+					return nil, false
+				}
+				entry.Value.Counter = max(entry.Value.Counter, current.Counter)
+				if current.LastQueried.After(entry.Value.LastQueried) {
+					entry.Value.LastQueried = current.LastQueried
+				}
+				if entry.Value.Pin == nil {
+					entry.Value.Pin = current.Pin
+				}
+				if entry.Value.Probation == nil {
+					entry.Value.Probation = current.Probation
+				}
+				entry.Value.History = mergePolicyHistory(current.History, entry.Value.History)
+			}
+			imported++
+			return entry.Value, true
+		})
+	}
+	_ = tidyCache()
+	return imported, kept, nil
+}
+
+func exportCache(conn net.Conn) {
+	writer := bufio.NewWriterSize(conn, 64<<10)
+	if err := writeCacheExport(writer, tidyCache()); err != nil {
+		slog.Debug("Could not write cache export", "error", err)
+		return
+	}
+	if err := writer.Flush(); err != nil {
+		slog.Debug("Could not flush cache export", "error", err)
+	}
+}
+
+func importCache(conn net.Conn, reader *bufio.Reader, mode string) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == "" {
+		mode = CACHE_IMPORT_MERGE
+	}
+	if mode != CACHE_IMPORT_MERGE && mode != CACHE_IMPORT_REPLACE {
+		fmt.Fprintf(conn, "ERROR: invalid import mode %q\n", mode)
+		return
+	}
+	now := time.Now()
+	entries, skipped, err := readCacheImport(reader, now, func() error {
+		return conn.SetReadDeadline(time.Now().Add(SOCKETMAP_IO_TIMEOUT))
+	})
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		slog.Warn("Rejected cache import", "error", err)
+		fmt.Fprintf(conn, "ERROR: %v\n", err)
+		return
+	}
+	imported, kept, err := applyCacheImport(entries, mode, now)
+	if err != nil {
+		slog.Error("Could not import cache", "error", err)
+		fmt.Fprintf(conn, "ERROR: cache import failed: %v\n", err)
+		return
+	}
+	slog.Info("Imported cache entries", "mode", mode, "imported", imported, "kept", kept, "skipped", skipped)
+	fmt.Fprintf(conn, "OK imported=%d kept=%d skipped=%d\n", imported, kept, skipped)
+}
@@ -0,0 +1,235 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+)
+
+func useTestPolicyCache(t *testing.T) {
+	t.Helper()
+	oldPolCache := polCache
+	clearCacheHitCountersForTest()
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
+	t.Cleanup(func() {
+		polCache.Close()
+		polCache = oldPolCache
+		clearCacheHitCountersForTest()
+	})
+}
+
+func exportTestEntry(now time.Time, policy string, ttl uint32, counter uint32) *CacheStruct {
+	expiresAt := now.Add(time.Duration(ttl) * time.Second).Truncate(time.Second)
+	return &CacheStruct{
+		DaneLastAttempt:   now.Add(-time.Minute).Truncate(time.Second),
+		MtaStsLastAttempt: now.Add(-2 * time.Minute).Truncate(time.Second),
+		Expirable:         &cache.Expirable{ExpiresAt: expiresAt},
+		Policy:            policy,
+		Dane:              PolicyBranch{Policy: "", TTL: ttl, ExpiresAt: expiresAt},
+		MtaSts: PolicyBranch{
+			Policy:    policy,
+			Report:    "policy_type=sts policy_domain=example.org",
+			TTL:       ttl,
+			ExpiresAt: expiresAt,
+		},
+		TTL:     ttl,
+		Counter: counter,
+	}
+}
+
+func TestCacheExportRoundTripsAllFields(t *testing.T) {
+	useTestPolicyCache(t)
+	now := time.Now()
+	original := exportTestEntry(now, "secure match=mx.example.org servername=hostname", 3600, 7)
+	polCache.Set("example.org", original)
+
+	conn := newSecurityTestConn(nil, &net.UnixAddr{Name: "@", Net: "unix"})
+	handleSocketmapConnection(conn, bufio.NewReader(bytes.NewReader(netstring.Marshal("CACHEEXPORT"))))
+	exported := conn.output.String()
+	if strings.Count(exported, "\n") != 1 || !strings.Contains(exported, `"mta-sts":{`) {
+		t.Fatalf("unexpected export: %q", exported)
+	}
+
+	entries, skipped, err := readCacheImport(strings.NewReader(exported), now, nil)
+	if err != nil || skipped != 0 || len(entries) != 1 {
+		t.Fatalf("read export: entries=%d skipped=%d err=%v", len(entries), skipped, err)
+	}
+	got := entries[0].Value
+	if entries[0].Key != "example.org" || got.Policy != original.Policy || got.Counter != 7 ||
+		!got.Dane.ExpiresAt.Equal(original.Dane.ExpiresAt) || got.MtaSts != (PolicyBranch{
+		ExpiresAt: got.MtaSts.ExpiresAt, Policy: original.MtaSts.Policy, Report: original.MtaSts.Report, TTL: 3600,
+	}) || !got.MtaSts.ExpiresAt.Equal(original.MtaSts.ExpiresAt) ||
+		!got.DaneLastAttempt.Equal(original.DaneLastAttempt) || !got.MtaStsLastAttempt.Equal(original.MtaStsLastAttempt) {
+		t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", got, original)
+	}
+}
+
+func TestReadCacheImportRejectsInvalidEntries(t *testing.T) {
+	now := time.Now()
+	far := now.Add(365 * 24 * time.Hour).UTC().Format(time.RFC3339)
+	for name, line := range map[string]string{
+		"syntax":        `{"domain":`,
+		"unknown field": `{"domain":"example.org","policy":"","ttl":0,"counter":0,"extra":1}`,
+		"domain":        `{"domain":"Example.org","policy":"","ttl":0,"counter":0}`,
+		"bad domain":    `{"domain":"bad@domain","policy":"","ttl":0,"counter":0}`,
+		"dane policy":   `{"domain":"example.org","policy":"","ttl":0,"counter":0,"dane":{"policy":"secure","ttl":60}}`,
+		"control chars": `{"domain":"example.org","policy":"dane\nOK","ttl":0,"counter":0}`,
+		"future expiry": `{"domain":"example.org","policy":"dane","ttl":60,"counter":0,"expires":"` + far + `"}`,
+		"pin policy":    `{"domain":"example.org","policy":"","ttl":0,"counter":0,"pin":{"since":"2026-01-01T00:00:00Z","policy":"may","seen":"none","lookups":1}}`,
+		"probation":     `{"domain":"example.org","policy":"","ttl":0,"counter":0,"probation":{"since":"2026-01-02T00:00:00Z","until":"2026-01-01T00:00:00Z","policy":"secure"}}`,
+		"history":       `{"domain":"example.org","policy":"","ttl":0,"counter":0,"history":[{"time":"2026-01-01T00:00:00Z","new":"dane","reason":"forged"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			input := `{"domain":"valid.example","policy":"","ttl":0,"counter":0}` + "\n" + line + "\n"
+			var importErr *cacheImportError
+			if _, _, err := readCacheImport(strings.NewReader(input), now, nil); !errors.As(err, &importErr) || importErr.line != 2 {
+				t.Fatalf("expected error on line 2, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCacheImportMergeAndReplace(t *testing.T) {
+	useTestPolicyCache(t)
+	now := time.Now()
+	polCache.Set("longer.example", exportTestEntry(now, "secure match=mx.longer.example servername=hostname", 7200, 5))
+	polCache.Set("shorter.example", exportTestEntry(now, "secure match=mx.shorter.example servername=hostname", 60, 9))
+	polCache.Set("untouched.example", exportTestEntry(now, "secure match=mx.untouched.example servername=hostname", 600, 1))
+
+	var buf bytes.Buffer
+	if err := writeCacheExport(&buf, []cache.Entry[*CacheStruct]{
+		{Key: "longer.example", Value: exportTestEntry(now, "", 3600, 1)},
+		{Key: "shorter.example", Value: exportTestEntry(now, "", 3600, 2)},
+		{Key: "new.example", Value: exportTestEntry(now, "", 3600, 3)},
+		{Key: "expired.example", Value: exportTestEntry(now.Add(-2*time.Hour), "", 60, 3)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	export := buf.String()
+
+	input := append(netstring.Marshal("CACHEIMPORT merge"), export...)
+	conn := newSecurityTestConn(nil, &net.UnixAddr{Name: "@", Net: "unix"})
+	handleSocketmapConnection(conn, bufio.NewReader(bytes.NewReader(input)))
+	if got := conn.output.String(); got != "OK imported=2 kept=1 skipped=1\n" {
+		t.Fatalf("merge response = %q", got)
+	}
+	if c, _ := polCache.Get("longer.example"); c.TTL != 7200 {
+		t.Fatalf("merge replaced a longer-lived entry: %+v", c)
+	}
+	if c, _ := polCache.Get("shorter.example"); c.TTL != 3600 || c.Counter != 9 {
+		t.Fatalf("merge did not replace a shorter-lived entry and keep its counter: %+v", c)
+	}
+	if _, ok := polCache.Get("untouched.example"); !ok {
+		t.Fatal("merge removed an entry missing from the import")
+	}
+
+	input = append(netstring.Marshal("CACHEIMPORT replace"), export...)
+	conn = newSecurityTestConn(nil, &net.UnixAddr{Name: "@", Net: "unix"})
+	handleSocketmapConnection(conn, bufio.NewReader(bytes.NewReader(input)))
+	if got := conn.output.String(); got != "OK imported=3 kept=0 skipped=1\n" {
+		t.Fatalf("replace response = %q", got)
+	}
+	if _, ok := polCache.Get("untouched.example"); ok {
+		t.Fatal("replace kept an entry missing from the import")
+	}
+}
+
+func TestCacheImportRejectsInvalidFileWithoutChanges(t *testing.T) {
+	useTestPolicyCache(t)
+	now := time.Now()
+	polCache.Set("kept.example", exportTestEntry(now, "", 600, 1))
+
+	input := append(netstring.Marshal("CACHEIMPORT replace"), "{}\n"...)
+	conn := newSecurityTestConn(nil, &net.UnixAddr{Name: "@", Net: "unix"})
+	handleSocketmapConnection(conn, bufio.NewReader(bytes.NewReader(input)))
+	if got := conn.output.String(); !strings.HasPrefix(got, "ERROR: line 1:") {
+		t.Fatalf("response = %q, want line error", got)
+	}
+	if _, ok := polCache.Get("kept.example"); !ok {
+		t.Fatal("rejected import modified the cache")
+	}
+}
+
+func TestCacheExportKeepsPinProbationAndHistory(t *testing.T) {
+	useTestPolicyCache(t)
+	now := time.Now().Truncate(time.Second)
+	original := exportTestEntry(now, "secure match=mx.example.org servername=hostname", 3600, 7)
+	original.Pin = &PolicyPin{
+		Since:   now.Add(-time.Hour),
+		Dane:    PolicyBranch{Policy: "dane-only", TTL: 300, ExpiresAt: now.Add(5 * time.Minute)},
+		Policy:  "dane-only",
+		Seen:    "secure",
+		Lookups: 2,
+	}
+	original.Probation = &PolicyProbation{Since: now.Add(-time.Minute), Until: now.Add(time.Hour), Policy: "secure"}
+	original.History = []PolicyChange{
+		{Time: now.Add(-2 * time.Hour), New: "dane-only", Branch: "dane", Reason: "lookup", TTL: 3600},
+		{Time: now.Add(-time.Hour), Old: "dane-only", New: "secure match=mx.example.org servername=hostname", Branch: "mta-sts", Reason: "prefetch", TTL: 3600},
+	}
+
+	var buf bytes.Buffer
+	if err := writeCacheExport(&buf, []cache.Entry[*CacheStruct]{{Key: "example.org", Value: original}}); err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := readCacheImport(strings.NewReader(buf.String()), now, nil)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("read export: entries=%d err=%v", len(entries), err)
+	}
+	got := entries[0].Value
+	if got.Pin == nil || got.Pin.Policy != "dane-only" || got.Pin.Seen != "secure" || got.Pin.Lookups != 2 ||
+		!got.Pin.Since.Equal(original.Pin.Since) || got.Pin.Dane.Policy != "dane-only" || got.Pin.Dane.TTL != 300 {
+		t.Fatalf("pin not round-tripped: %+v", got.Pin)
+	}
+	if got.Probation == nil || got.Probation.Policy != "secure" || !got.Probation.Until.Equal(original.Probation.Until) {
+		t.Fatalf("probation not round-tripped: %+v", got.Probation)
+	}
+	if len(got.History) != 2 || !got.History[1].equal(original.History[1]) {
+		t.Fatalf("history not round-tripped: %+v", got.History)
+	}
+
+	// Merging a longer-lived entry without them keeps those of the cached entry.
+	polCache.Set("example.org", original)
+	buf.Reset()
+	newer := exportTestEntry(now, "secure match=mx.example.org servername=hostname", 7200, 1)
+	newer.History = []PolicyChange{original.History[1], {Time: now, Old: "secure match=mx.example.org servername=hostname", New: "none", Reason: "discard"}}
+	if err := writeCacheExport(&buf, []cache.Entry[*CacheStruct]{{Key: "example.org", Value: newer}}); err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err = readCacheImport(strings.NewReader(buf.String()), now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported, _, err := applyCacheImport(entries, CACHE_IMPORT_MERGE, now); err != nil || imported != 1 {
+		t.Fatalf("merge: imported=%d err=%v", imported, err)
+	}
+	c, _ := polCache.Get("example.org")
+	if c.TTL != 7200 || c.Pin == nil || c.Probation == nil || len(c.History) != 3 || c.History[2].Reason != "discard" {
+		t.Fatalf("merge dropped pin, probation or history: %+v", c)
+	}
+}
+
+func TestReadCacheImportLimitsEntries(t *testing.T) {
+	var b strings.Builder
+	for i := range CACHE_IMPORT_MAX_ENTRIES + 1 {
+		fmt.Fprintf(&b, `{"domain":"d%d.example","policy":"","ttl":0,"counter":0}`+"\n", i)
+	}
+	var importErr *cacheImportError
+	_, _, err := readCacheImport(strings.NewReader(b.String()), time.Now(), nil)
+	if !errors.As(err, &importErr) || importErr.line != CACHE_IMPORT_MAX_ENTRIES+1 {
+		t.Fatalf("expected error on line %d, got %v", CACHE_IMPORT_MAX_ENTRIES+1, err)
+	}
+}
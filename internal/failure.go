@@ -0,0 +1,153 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// lookupFailureStreaks counts the consecutive temporary lookup failures of
+// each domain, see FailurePolicyConfig. Any other reply resets the streak.
+var lookupFailureStreaks = failureStreaks{streaks: map[string]failureStreak{}}
+
+type failureStreak struct {
+	failures uint32
+	updated  uint64 // sequence number of the last failure
+}
+
+// failureStreaks holds the streaks of up to CACHE_MAX_ENTRIES domains. Beyond
+// that, the streaks that failed longest ago are dropped down to
+// CACHE_PRUNE_TARGET, so the domains of an ongoing outage keep theirs.
+type failureStreaks struct {
+	streaks map[string]failureStreak
+	seq     uint64
+	mu      sync.Mutex
+}
+
+func (s *failureStreaks) add(domain string) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	streak, found := s.streaks[domain]
+	if !found && len(s.streaks) >= CACHE_MAX_ENTRIES {
+		s.pruneLocked(CACHE_PRUNE_TARGET - 1)
+	}
+	s.seq++
+	streak.failures++
+	streak.updated = s.seq
+	s.streaks[domain] = streak
+	return streak.failures
+}
+
+// pruneLocked keeps the keep streaks that failed last.
+func (s *failureStreaks) pruneLocked(keep int) {
+	if len(s.streaks) <= keep {
+		return
+	}
+	updated := make([]uint64, 0, len(s.streaks))
+	for _, streak := range s.streaks {
+		updated = append(updated, streak.updated)
+	}
+	slices.Sort(updated)
+	cutoff := updated[len(updated)-keep]
+	for domain, streak := range s.streaks {
+		if streak.updated < cutoff {
+			delete(s.streaks, domain)
+		}
+	}
+}
+
+func (s *failureStreaks) reset(domain string) {
+	s.mu.Lock()
+	delete(s.streaks, domain)
+	s.mu.Unlock()
+}
+
+// resetBelow resets the streaks of the subdomains of suffix.
+func (s *failureStreaks) resetBelow(suffix string) {
+	s.mu.Lock()
+	for domain := range s.streaks {
+		if strings.HasSuffix(domain, "."+suffix) {
+			delete(s.streaks, domain)
+		}
+	}
+	s.mu.Unlock()
+}
+
+func (s *failureStreaks) clear() {
+	s.mu.Lock()
+	clear(s.streaks)
+	s.mu.Unlock()
+}
+
+// longestDomainSuffix returns the value of the longest suffix of domain,
+// including domain itself, in m. Next-hop keys match by their host.
+func longestDomainSuffix[V any](m map[string]V, domain string) (V, bool) {
+	for suffix := policyKeyHost(domain); suffix != ""; {
+		if v, ok := m[suffix]; ok {
+			return v, true
+		}
+		_, suffix, _ = strings.Cut(suffix, ".")
+	}
+	var zero V
+	return zero, false
+}
+
+// failurePolicyFor returns the failure policy of the longest suffix of domain
+// configured in cfg, or its default.
+func failurePolicyFor(cfg *FailurePolicyConfig, domain string) string {
+	if policy, ok := longestDomainSuffix(cfg.Domains, domain); ok {
+		return policy
+	}
+	if cfg.Default == "" {
+		return "temp"
+	}
+	return cfg.Default
+}
+
+func addLookupFailure(domain string) uint32 {
+	return lookupFailureStreaks.add(domain)
+}
+
+func resetLookupFailures(domain string) {
+	lookupFailureStreaks.reset(domain)
+}
+
+// failureFallback returns the reply replacing TEMP for domain, or "temp"
+// while its failure streak is within cfg.MaxFailures or the domain had a
+// strict policy.
+func failureFallback(cfg *FailurePolicyConfig, domain string) (string, uint32) {
+	failures := addLookupFailure(domain)
+	if failures <= cfg.MaxFailures || hadStrictPolicy(domain) {
+		return "temp", failures
+	}
+	return failurePolicyFor(cfg, domain), failures
+}
+
+// hadStrictPolicy reports whether dane-only or secure is or was served for
+// domain, even if that policy expired, is held back by a pin or is only left
+// in the history of the domain. Mail to it keeps being deferred rather than
+// sent with a weaker policy while lookups fail.
+func hadStrictPolicy(domain string) bool {
+	if polCache == nil {
+		return false
+	}
+	c, found := polCache.Get(domain)
+	if !found || c == nil {
+		return false
+	}
+	policies := []string{c.Policy, c.Dane.Policy, c.MtaSts.Policy}
+	if c.Pin != nil {
+		policies = append(policies, c.Pin.Policy)
+	}
+	for _, change := range c.History {
+		policies = append(policies, change.New)
+	}
+	return slices.ContainsFunc(policies, func(policy string) bool {
+		return probationForm(firstWord(policy)) != ""
+	})
+}
@@ -0,0 +1,143 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+)
+
+func replyForTest(domain string, policy string) []byte {
+	conn := newSecurityTestConn(nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25})
+	replySocketmap(conn, "network", domain, policy, "", 0, defaultQueryProfile(false))
+	return conn.output.Bytes()
+}
+
+func TestFailurePolicyAppliesAfterMaxFailures(t *testing.T) {
+	patchConfigForTest(t, func(c *Config) {
+		c.FailurePolicy = FailurePolicyConfig{Default: "notfound", MaxFailures: 2}
+	})
+	t.Cleanup(lookupFailureStreaks.clear)
+	fallbacks := metricFallbackNotFound.Load()
+	for i, want := range [][]byte{NS_TEMP, NS_TEMP, NS_NOTFOUND, NS_NOTFOUND} {
+		if got := replyForTest("failing.example", "TEMP"); !bytes.Equal(got, want) {
+			t.Fatalf("failure %d: reply = %q, want %q", i+1, got, want)
+		}
+	}
+	if got := metricFallbackNotFound.Load(); got != fallbacks+2 {
+		t.Fatalf("notfound fallbacks = %d, want %d", got, fallbacks+2)
+	}
+
+	// A successful lookup starts a new streak.
+	replyForTest("failing.example", "dane")
+	if got := replyForTest("failing.example", "TEMP"); !bytes.Equal(got, NS_TEMP) {
+		t.Fatalf("reply after success = %q, want TEMP", got)
+	}
+}
+
+func TestFailurePolicyUsesLongestDomainSuffix(t *testing.T) {
+	patchConfigForTest(t, func(c *Config) {
+		c.FailurePolicy = FailurePolicyConfig{
+			Default: "temp",
+			Domains: map[string]string{
+				"Example.COM.":      "may",
+				".mail.example.com": "Encrypt",
+				"unrelated.example": "notfound",
+			},
+		}
+		if err := c.FailurePolicy.validate("failure-policy"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Cleanup(lookupFailureStreaks.clear)
+	for domain, want := range map[string][]byte{
+		"example.com":         netstring.Marshal("OK may"),
+		"mx.example.com":      netstring.Marshal("OK may"),
+		"mail.example.com":    netstring.Marshal("OK encrypt"),
+		"eu.mail.example.com": netstring.Marshal("OK encrypt"),
+		"notexample.com":      NS_TEMP,
+		"example.org":         NS_TEMP,
+	} {
+		if got := replyForTest(domain, "TEMP"); !bytes.Equal(got, want) {
+			t.Fatalf("%s: reply = %q, want %q", domain, got, want)
+		}
+	}
+}
+
+func TestFailurePolicyRejectsUnknownPolicies(t *testing.T) {
+	for _, cfg := range []FailurePolicyConfig{
+		{Default: "defer"},
+		{Domains: map[string]string{"example.com": "dane"}},
+		{Domains: map[string]string{"bad_domain..": "may"}},
+	} {
+		if err := cfg.validate("failure-policy"); err == nil {
+			t.Fatalf("expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestFailurePolicyKeepsTempForStrictPolicies(t *testing.T) {
+	useTestPolicyCache(t)
+	patchConfigForTest(t, func(c *Config) {
+		c.FailurePolicy = FailurePolicyConfig{Default: "may"}
+	})
+	t.Cleanup(lookupFailureStreaks.clear)
+	now := time.Now()
+	expired := pinTestEntry(now.Add(-time.Hour))
+	held := exportTestEntry(now, "", 3600, 1)
+	held.Pin = &PolicyPin{Since: now, Policy: "secure match=mx.held.example", Lookups: 1}
+	history := statsOnlyCacheEntry(3)
+	history.History = []PolicyChange{{Time: now, New: "dane-only", Reason: "lookup"}, {Time: now, Old: "dane-only", New: "none", Reason: "discard"}}
+	polCache.Set("expired.example", expired)
+	polCache.Set("held.example", held)
+	polCache.Set("history.example", history)
+	polCache.Set("plain.example", exportTestEntry(now, "", 3600, 1))
+
+	for domain, want := range map[string][]byte{
+		"expired.example":  NS_TEMP,
+		"held.example":     NS_TEMP,
+		"history.example":  NS_TEMP,
+		"plain.example":    netstring.Marshal("OK may"),
+		"uncached.example": netstring.Marshal("OK may"),
+	} {
+		if got := replyForTest(domain, "TEMP"); !bytes.Equal(got, want) {
+			t.Fatalf("%s: reply = %q, want %q", domain, got, want)
+		}
+	}
+}
+
+func TestFailureStreaksDropTheOldestBeyondTheBound(t *testing.T) {
+	t.Cleanup(lookupFailureStreaks.clear)
+	addLookupFailure("outage.example")
+	addLookupFailure("outage.example")
+	for i := range CACHE_MAX_ENTRIES - 1 {
+		addLookupFailure(fmt.Sprintf("d%d.example", i))
+	}
+	if got := addLookupFailure("outage.example"); got != 3 {
+		t.Fatalf("streak before the bound = %d, want 3", got)
+	}
+	for i := range 100 {
+		addLookupFailure(fmt.Sprintf("more%d.example", i))
+	}
+
+	lookupFailureStreaks.mu.Lock()
+	count := len(lookupFailureStreaks.streaks)
+	lookupFailureStreaks.mu.Unlock()
+	if count > CACHE_MAX_ENTRIES {
+		t.Fatalf("%d streaks kept, want at most %d", count, CACHE_MAX_ENTRIES)
+	}
+	if got := addLookupFailure("outage.example"); got != 4 {
+		t.Fatalf("streak of a domain still failing = %d, want 4", got)
+	}
+	if got := addLookupFailure("d0.example"); got != 1 {
+		t.Fatalf("oldest streak = %d, want it dropped", got)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+)
+
+const POLICY_HISTORY_MAX = 32
+
+// PolicyChange is a change of the policy served for a domain. Policies are
+// recorded in full, "none" when no policy was served. The first change of a
+// domain has no old policy.
+type PolicyChange struct {
+	Time   time.Time `json:"time"`
+	Old    string    `json:"old,omitempty"`
+	New    string    `json:"new"`
+	Branch string    `json:"branch,omitempty"` // branch the new policy was taken from, or probation or rule
+	Reason string    `json:"reason"`           // lookup, prefetch, prefetch-failure or discard
+	TTL    uint32    `json:"ttl"`
+}
+
+// PolicyHistory is the reply to HISTORY, oldest change first.
+type PolicyHistory struct {
+	Version string         `json:"version"`
+	Domain  string         `json:"domain"`
+	Changes []PolicyChange `json:"changes"`
+	Cached  bool           `json:"cached"`
+}
+
+func historyPolicyName(policy string) string {
+	if policy == "" {
+		return "none"
+	}
+	return policy
+}
+
+// lastServedPolicy is the policy served for c, taken from its history or,
+// for entries cached before histories were kept, from its branches.
+func lastServedPolicy(c *CacheStruct, now time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	if n := len(c.History); n != 0 {
+		return c.History[n-1].New, true
+	}
+	if !c.hasBranches() {
+		return "", false
+	}
+	return historyPolicyName(cachedPolicyForPrefetchTransition(c, now)), true
+}
+
+// appendPolicyChange replaces the history of cs, which may be shared with the
+// entry it was cloned from, by one ending with change.
+func appendPolicyChange(cs *CacheStruct, change PolicyChange) {
+	start := max(len(cs.History)+1-POLICY_HISTORY_MAX, 0)
+	cs.History = append(slices.Clip(cs.History[start:]), change)
+}
+
+// mergePolicyHistory merges the histories of two entries of a domain by time,
+// without duplicating changes recorded in both, and keeps the last
+// POLICY_HISTORY_MAX changes.
+func mergePolicyHistory(a []PolicyChange, b []PolicyChange) []PolicyChange {
+	merged := slices.Clone(a)
+	for _, change := range b {
+		if !slices.ContainsFunc(a, change.equal) {
+			merged = append(merged, change)
+		}
+	}
+	slices.SortStableFunc(merged, func(x, y PolicyChange) int {
+		return x.Time.Compare(y.Time)
+	})
+	return slices.Clip(merged[max(len(merged)-POLICY_HISTORY_MAX, 0):])
+}
+
+func (c PolicyChange) equal(other PolicyChange) bool {
+	return c.Time.Equal(other.Time) && c.Old == other.Old && c.New == other.New &&
+		c.Branch == other.Branch && c.Reason == other.Reason && c.TTL == other.TTL
+}
+
+// recordPolicyHistory records the policy cs serves, after probation and
+// rules, if it differs from the one last served for the previous entry c.
+func recordPolicyHistory(domain string, c *CacheStruct, cs *CacheStruct, reason string, now time.Time) {
+	policy, _, ttl, branch, ok := selectServedPolicySource(domain, cs, now)
+	if !ok {
+		return
+	}
+	policy = historyPolicyName(policy)
+	previous, known := lastServedPolicy(c, now)
+	if known && previous == policy {
+		return
+	}
+	appendPolicyChange(cs, PolicyChange{Time: now, Old: previous, New: policy, Branch: branch, Reason: reason, TTL: ttl})
+}
+
+// recordPolicyDiscard records that the cached policy of c was dropped and
+// nothing is served for it until the domain is looked up again.
+func recordPolicyDiscard(c *CacheStruct, cs *CacheStruct, now time.Time) {
+	cs.History = c.History
+	if previous, known := lastServedPolicy(c, now); known && previous != "none" {
+		appendPolicyChange(cs, PolicyChange{Time: now, Old: previous, New: "none", Reason: "discard"})
+	}
+}
+
+func reportPolicyHistory(conn net.Conn, argument string) {
+	domain, ok := normalizePolicyKey(argument)
+	if !ok {
+		writeConnectionResponse(conn, NS_NOTFOUND)
+		return
+	}
+	c, found := polCache.Get(domain)
+	r := PolicyHistory{
+		Version: Version,
+		Domain:  domain,
+		Changes: []PolicyChange{},
+		Cached:  found && c != nil,
+	}
+	if r.Cached && len(c.History) != 0 {
+		r.Changes = c.History
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		slog.Error("Could not marshal JSON", "error", err)
+		return
+	}
+	writeConnectionResponse(conn, append(b, '\n'))
+}
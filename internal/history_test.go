@@ -0,0 +1,109 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func decodePolicyHistory(t *testing.T, raw string) PolicyHistory {
+	t.Helper()
+	var r PolicyHistory
+	if err := json.Unmarshal([]byte(raw), &r); err != nil {
+		t.Fatalf("decode history %q: %v", raw, err)
+	}
+	return r
+}
+
+func TestHistoryRecordsServedPolicyChanges(t *testing.T) {
+	useTestPolicyCache(t)
+	c, _ := storeDomainResult("history.example", nil, testDomainResult("dane-only", "", ""), 1)
+	c, _ = storeDomainResult("history.example", c, testDomainResult("dane-only", "", ""), 1)
+	c, _ = storeDomainResult("history.example", c, testDomainResult("", "", ""), 1)
+
+	r := decodePolicyHistory(t, runControlCommand(t, "HISTORY History.Example."))
+	if !r.Cached || r.Domain != "history.example" || len(r.Changes) != 2 {
+		t.Fatalf("history = %+v, want two changes of history.example", r)
+	}
+	first, second := r.Changes[0], r.Changes[1]
+	if first.Old != "" || first.New != "dane-only" || first.Branch != "dane" || first.Reason != "lookup" || first.TTL == 0 {
+		t.Fatalf("first change = %+v, want new dane-only from dane", first)
+	}
+	if second.Old != "dane-only" || second.New != "none" || second.Branch != "mta-sts" || second.Time.Before(first.Time) {
+		t.Fatalf("second change = %+v, want dane-only -> none from mta-sts", second)
+	}
+
+	discardCachedPolicyState(false, "history.example", c)
+	r = decodePolicyHistory(t, runControlCommand(t, "HISTORY history.example"))
+	if len(r.Changes) != 2 {
+		t.Fatalf("discarding an entry without policy recorded %+v", r.Changes)
+	}
+
+	if r := decodePolicyHistory(t, runControlCommand(t, "HISTORY unknown.example")); r.Cached || r.Changes == nil || len(r.Changes) != 0 {
+		t.Fatalf("history of an unknown domain = %+v", r)
+	}
+	if got := runControlCommand(t, "HISTORY"); got != string(NS_NOTFOUND) {
+		t.Fatalf("HISTORY without domain = %q", got)
+	}
+}
+
+func TestHistoryRecordsPolicyServedOnProbation(t *testing.T) {
+	useTestPolicyCache(t)
+	patchConfigForTest(t, func(c *Config) {
+		c.Probation = ProbationConfig{Enabled: true, Period: 1800}
+	})
+	c, _ := storeDomainResult("probation-history.example", nil, testDomainResult("", "", ""), 1)
+	c, _ = storeDomainResult("probation-history.example", c, testDomainResult("dane-only", "", ""), 1)
+	if c.Probation == nil {
+		t.Fatal("expected the upgrade to dane-only to start a probation")
+	}
+	if len(c.History) != 2 {
+		t.Fatalf("history = %+v, want two changes", c.History)
+	}
+	if last := c.History[1]; last.Old != "none" || last.New != "dane" || last.Branch != "probation" {
+		t.Fatalf("last change = %+v, want none -> dane on probation", last)
+	}
+}
+
+func TestHistoryIsBoundedAndRecordsDiscards(t *testing.T) {
+	useTestPolicyCache(t)
+	var c *CacheStruct
+	for i := range POLICY_HISTORY_MAX + 5 {
+		policy := "dane-only"
+		if i%2 == 1 {
+			policy = ""
+		}
+		c, _ = storeDomainResult("bounded.example", c, testDomainResult(policy, "", ""), 1)
+	}
+	if len(c.History) != POLICY_HISTORY_MAX {
+		t.Fatalf("history length = %d, want %d", len(c.History), POLICY_HISTORY_MAX)
+	}
+	if last := c.History[POLICY_HISTORY_MAX-1]; last.New != "dane-only" || last.Old != "none" {
+		t.Fatalf("last change = %+v, want none -> dane-only", last)
+	}
+
+	discardCachedPolicyState(false, "bounded.example", c)
+	stored, found := polCache.Get("bounded.example")
+	if !found || len(stored.History) != POLICY_HISTORY_MAX {
+		t.Fatalf("stats-only entry lost its history: %+v", stored)
+	}
+	if last := stored.History[POLICY_HISTORY_MAX-1]; last.Reason != "discard" || last.Old != "dane-only" || last.New != "none" {
+		t.Fatalf("discard change = %+v", last)
+	}
+
+	path := filepath.Join(t.TempDir(), "cache.db")
+	saved := newTestPolicyCache(t, path)
+	saved.Set("bounded.example", stored)
+	saved.Close()
+	reopened := newTestPolicyCache(t, path)
+	defer reopened.Close()
+	got, found := reopened.Get("bounded.example")
+	if !found || len(got.History) != POLICY_HISTORY_MAX || !got.History[0].Time.Equal(stored.History[0].Time) || got.History[POLICY_HISTORY_MAX-1] != (PolicyChange{Time: got.History[POLICY_HISTORY_MAX-1].Time, Old: "dane-only", New: "none", Reason: "discard"}) {
+		t.Fatalf("history after reload = %+v", got)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// domainToASCII converts the U-labels of an internationalized domain to
+// A-labels (IDNA 2008 with UTS 46 mapping), as used in DNS. ASCII names and
+// names that cannot be converted are returned as is, for validation to reject.
+func domainToASCII(domain string) string {
+	if isASCII(domain) {
+		return domain
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return domain
+	}
+	return ascii
+}
+
+// domainToUnicode returns the U-label form of a domain or next-hop key with
+// A-labels, or "" if it has none.
+func domainToUnicode(key string) string {
+	if !strings.Contains(key, "xn--") {
+		return ""
+	}
+	if h, ok := parseNextHop(key); ok {
+		if h.host = domainToUnicode(h.host); h.host == "" {
+			return ""
+		}
+		return h.key()
+	}
+	display, err := idna.Display.ToUnicode(key)
+	if err != nil || display == key {
+		return ""
+	}
+	return display
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+)
+
+func TestNormalizePolicyKeyConvertsULabels(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"Bücher.DE", "xn--bcher-kva.de", true},
+		{"bücher.de.", "xn--bcher-kva.de", true},
+		{"xn--bcher-kva.de", "xn--bcher-kva.de", true},
+		{"ＢÜＣＨＥＲ。de", "xn--bcher-kva.de", true},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah", true},
+		{"[smtp.bücher.de]:587", "[smtp.xn--bcher-kva.de]:587", true},
+		{"bücher.de:25", "xn--bcher-kva.de", true},
+		{"bü cher.de", "", false},
+		{"-bücher.de", "", false},
+	} {
+		got, ok := normalizePolicyKey(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizePolicyKey(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDomainToUnicode(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"xn--bcher-kva.de", "bücher.de"},
+		{"[smtp.xn--bcher-kva.de]:587", "[smtp.bücher.de]:587"},
+		{"example.com", ""},
+		{"xn--zz.example", ""},
+	} {
+		if got := domainToUnicode(tt.in); got != tt.want {
+			t.Errorf("domainToUnicode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestInternationalizedDomainsUseALabelCacheKey(t *testing.T) {
+	useTestPolicyCache(t)
+	storeDomainResult("xn--bcher-kva.de", nil, domainResult{
+		Dane:            branchFromResult("dane-only", "", 3600),
+		DaneAttempted:   true,
+		MtaStsAttempted: true,
+	}, 1)
+	want := string(netstring.Marshal("OK dane-only"))
+	for _, query := range []string{"QUERY bücher.de", "QUERY BÜCHER.de.", "QUERY xn--bcher-kva.de"} {
+		if got := runControlCommand(t, query); got != want {
+			t.Fatalf("%s = %q, want %q", query, got, want)
+		}
+	}
+	if got := runControlCommand(t, "PURGE *.bücher.de"); got != "OK removed=0\n" {
+		t.Fatalf("PURGE *.bücher.de = %q, want no subdomain removed", got)
+	}
+	if got := runControlCommand(t, "PURGE bücher.de"); got != "OK removed=1\n" {
+		t.Fatalf("PURGE bücher.de = %q, want the A-label entry removed", got)
+	}
+	if _, found := polCache.Get("xn--bcher-kva.de"); found {
+		t.Fatal("PURGE bücher.de kept the A-label entry")
+	}
+}
+
+func TestParseMtaStsPolicyWithInternationalizedMxPatterns(t *testing.T) {
+	policy, report, _ := parseMtaStsPolicy("xn--bcher-kva.de", strings.NewReader("version: STSv1\nmode: enforce\nmx: mx.Bücher.de\nmx: *.backup.bücher.de\nmax_age: 86400\n"))
+	if policy != "secure match=mx.xn--bcher-kva.de:.backup.xn--bcher-kva.de servername=hostname" {
+		t.Fatalf("unexpected policy: %q", policy)
+	}
+	for _, expected := range []string{
+		"policy_domain=xn--bcher-kva.de",
+		"mx_host_pattern=mx.xn--bcher-kva.de",
+		"mx_host_pattern=*.backup.xn--bcher-kva.de",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Fatalf("expected report to contain %q; report=%q", expected, report)
+		}
+	}
+}
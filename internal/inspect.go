@@ -0,0 +1,372 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/valid"
+)
+
+const (
+	DUMP_FORMAT_TEXT = "text"
+	DUMP_FORMAT_JSON = "json"
+	DUMP_FORMAT_CSV  = "csv"
+
+	PREFETCH_STATUS_DEFAULT_LIMIT = 50
+	PREFETCH_STATUS_MAX_LIMIT     = 10000
+)
+
+type InspectBranch struct {
+	ExpiresAt    time.Time `json:"expires,omitzero"`
+	Policy       string    `json:"policy"`
+	Report       string    `json:"report,omitempty"`
+	TTL          uint32    `json:"ttl"`
+	RemainingTTL uint32    `json:"remaining-ttl"`
+	Resolver     string    `json:"resolver,omitempty"`
+	Validation   string    `json:"validation,omitempty"`
+}
+
+type InspectServed struct {
+	Policy string `json:"policy"`
+	Report string `json:"report,omitempty"`
+	TTL    uint32 `json:"ttl"`
+}
+
+// InspectPin is a downgrade held back by pinning.
+type InspectPin struct {
+	Since   time.Time `json:"since"`
+	Policy  string    `json:"policy"`
+	Seen    string    `json:"seen"`
+	Lookups uint32    `json:"lookups"`
+}
+
+// InspectProbation is a policy on probation, served as its opportunistic
+// form until Until.
+type InspectProbation struct {
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Policy  string    `json:"policy"`
+	Serving string    `json:"serving"`
+}
+
+func inspectProbation(c *CacheStruct, now time.Time) *InspectProbation {
+	if c == nil || c.Probation == nil || !now.Before(c.Probation.Until) {
+		return nil
+	}
+	return &InspectProbation{
+		Since:   c.Probation.Since,
+		Until:   c.Probation.Until,
+		Policy:  c.Probation.Policy,
+		Serving: probationForm(c.Probation.Policy),
+	}
+}
+
+type InspectResult struct {
+	DaneLastAttempt   time.Time         `json:"dane-last-attempt,omitzero"`
+	MtaStsLastAttempt time.Time         `json:"mta-sts-last-attempt,omitzero"`
+	NextPrefetch      time.Time         `json:"next-prefetch,omitzero"`
+	LastQueried       time.Time         `json:"last-queried,omitzero"`
+	Served            *InspectServed    `json:"served,omitempty"`
+	Pin               *InspectPin       `json:"pin,omitempty"`
+	Probation         *InspectProbation `json:"probation,omitempty"`
+	Dane              *InspectBranch    `json:"dane,omitempty"`
+	MtaSts            *InspectBranch    `json:"mta-sts,omitempty"`
+	Version           string            `json:"version"`
+	Domain            string            `json:"domain"`
+	Error             string            `json:"error,omitempty"`
+	Counter           uint32            `json:"counter"`
+	PrefetchRetries   uint32            `json:"prefetch-retries,omitempty"`
+	Cached            bool              `json:"cached"`
+}
+
+// PrefetchStatusEntry is a scheduled prefetch. Retries counts the failed
+// attempts since the last success; GraceDeadline is when retrying stops.
+type PrefetchStatusEntry struct {
+	Due           time.Time `json:"due"`
+	GraceDeadline time.Time `json:"grace-deadline,omitzero"`
+	Domain        string    `json:"domain"`
+	Retries       uint32    `json:"retries"`
+	Overdue       bool      `json:"overdue,omitempty"`
+}
+
+type PrefetchStatus struct {
+	LastBatch         time.Time             `json:"last-batch,omitzero"`
+	Version           string                `json:"version"`
+	Entries           []PrefetchStatusEntry `json:"entries"`
+	LastBatchDuration float64               `json:"last-batch-duration,omitempty"` // seconds
+	LastBatchSize     int                   `json:"last-batch-size,omitempty"`
+	Queued            int                   `json:"queued"`
+	Overdue           int                   `json:"overdue"`
+	Enabled           bool                  `json:"enabled"`
+}
+
+func parsePrefetchStatusLimit(argument string) (int, error) {
+	argument = strings.TrimSpace(argument)
+	if argument == "" {
+		return PREFETCH_STATUS_DEFAULT_LIMIT, nil
+	}
+	limit, err := strconv.Atoi(argument)
+	if err != nil || limit < 1 || limit > PREFETCH_STATUS_MAX_LIMIT {
+		return 0, fmt.Errorf("invalid prefetch status limit %q, must be between 1 and %d", argument, PREFETCH_STATUS_MAX_LIMIT)
+	}
+	return limit, nil
+}
+
+func prefetchStatus(now time.Time, limit int) PrefetchStatus {
+	r := PrefetchStatus{Version: Version, Entries: []PrefetchStatusEntry{}}
+	scheduler := activePrefetchScheduler.Load()
+	if scheduler == nil {
+		return r
+	}
+	r.Enabled = true
+	r.Entries, r.Queued, r.Overdue = scheduler.snapshot(now, limit)
+	var elapsed time.Duration
+	r.LastBatch, elapsed, r.LastBatchSize = scheduler.lastBatchStats()
+	r.LastBatchDuration = elapsed.Seconds()
+	return r
+}
+
+// reportPrefetchStatus lists the earliest scheduled prefetches, at most the
+// number given as argument.
+func reportPrefetchStatus(conn net.Conn, argument string) {
+	limit, err := parsePrefetchStatusLimit(argument)
+	if err != nil {
+		fmt.Fprintf(conn, "ERROR: %v\n", err)
+		return
+	}
+	b, err := json.Marshal(prefetchStatus(time.Now(), limit))
+	if err != nil {
+		slog.Error("Could not marshal JSON", "error", err)
+		return
+	}
+	writeConnectionResponse(conn, append(b, '\n'))
+}
+
+func inspectBranch(branch PolicyBranch, now time.Time) *InspectBranch {
+	if !branch.HasData() {
+		return nil
+	}
+	return &InspectBranch{
+		ExpiresAt:    branch.ExpiresAt,
+		Policy:       branch.Policy,
+		Report:       branch.Report,
+		TTL:          branch.TTL,
+		RemainingTTL: branch.RemainingTTL(now),
+		Resolver:     branch.Resolver,
+		Validation:   branch.Validation,
+	}
+}
+
+// inspectCacheEntry describes the cached state of domain, including the
+// policy tryCachedPolicy would serve right now.
+func inspectCacheEntry(domain string, c *CacheStruct, found bool, now time.Time) InspectResult {
+	r := InspectResult{
+		Version: Version,
+		Domain:  domain,
+		Cached:  found && c != nil,
+	}
+	if !r.Cached {
+		return r
+	}
+	if policy, report, ttl, ok := selectServedPolicy(domain, c, now); ok {
+		policy, report = mapPolicy(&config.PolicyMapping, domain, policy, report)
+		r.Served = &InspectServed{Policy: policy, Report: report, TTL: ttl}
+	}
+	r.Probation = inspectProbation(c, now)
+	if c.Pin != nil {
+		r.Pin = &InspectPin{Since: c.Pin.Since, Policy: firstWord(c.Pin.Policy), Seen: c.Pin.Seen, Lookups: c.Pin.Lookups}
+	}
+	r.Dane = inspectBranch(c.Dane, now)
+	r.MtaSts = inspectBranch(c.MtaSts, now)
+	r.DaneLastAttempt = c.DaneLastAttempt
+	r.MtaStsLastAttempt = c.MtaStsLastAttempt
+	r.Counter = cacheEntryCounter(domain, c)
+	r.LastQueried = cacheEntryLastQueried(domain, c)
+	r.NextPrefetch, r.PrefetchRetries, _ = cachedPolicyPrefetchStatus(domain)
+	return r
+}
+
+func inspectCachedDomain(conn net.Conn, argument string, refresh bool) {
+	domain, ok := normalizePolicyKey(argument)
+	if !ok {
+		writeConnectionResponse(conn, NS_NOTFOUND)
+		return
+	}
+	c, found := polCache.Get(domain)
+	var lookupErr string
+	if refresh {
+		result := queryDomain(domain)
+		if result.Policy == "TEMP" {
+			lookupErr = "policy lookup failed temporarily"
+		}
+		if stored, ok := storeDomainResult(domain, c, result, 0); ok {
+			c, found = stored, true
+			slog.Info("Refreshed cached policy", "domain", domain, "policy", firstWord(result.Policy))
+		}
+	}
+	r := inspectCacheEntry(domain, c, found, time.Now())
+	r.Error = lookupErr
+	b, err := json.Marshal(r)
+	if err != nil {
+		slog.Error("Could not marshal JSON", "error", err)
+		return
+	}
+	writeConnectionResponse(conn, append(b, '\n'))
+}
+
+// purgeCacheDomains removes a single domain, or with a "*." prefix every
+// subdomain of the given suffix, from the cache.
+func purgeCacheDomains(conn net.Conn, argument string) {
+	suffix, wildcard := strings.CutPrefix(strings.TrimSpace(argument), "*.")
+	suffix = normalizeDomain(suffix)
+	ok := valid.IsDNSName(suffix) && !strings.HasPrefix(suffix, ".")
+	if !wildcard {
+		// A single entry may also be a next-hop destination
+		suffix, ok = normalizePolicyKey(suffix)
+	}
+	if !ok {
+		fmt.Fprintf(conn, "ERROR: invalid domain pattern %q\n", argument)
+		return
+	}
+	var keys []string
+	if wildcard {
+		for _, entry := range polCache.Items(false) {
+			if strings.HasSuffix(entry.Key, "."+suffix) {
+				keys = append(keys, entry.Key)
+			}
+		}
+	} else if _, found := polCache.Get(suffix); found {
+		keys = append(keys, suffix)
+	}
+	for _, key := range keys {
+		polCache.Remove(false, key)
+		cacheHitCounters.Delete(key)
+		cacheLastQueried.Delete(key)
+		unscheduleCachedPolicyPrefetch(key)
+	}
+	// Failed lookups are not cached, so their streaks are reset by pattern
+	if wildcard {
+		lookupFailureStreaks.resetBelow(suffix)
+	} else {
+		resetLookupFailures(suffix)
+	}
+	slog.Info("Purged cached policies", "pattern", argument, "removed", len(keys))
+	if len(keys) != 0 {
+		if err := polCache.Save(false); err != nil {
+			slog.Error("Could not persist purged cache entries", "error", err)
+			fmt.Fprintf(conn, "ERROR: cache purge is not durable: %v\n", err)
+			return
+		}
+	}
+	fmt.Fprintf(conn, "OK removed=%d\n", len(keys))
+}
+
+// DumpEntry is one line of DUMP JSON and DUMP CSV. Unlike the text dump it
+// includes entries without a usable policy, which have an empty source. See
+// selectServedPolicySource for the other sources.
+type DumpEntry struct {
+	DaneLastAttempt   time.Time `json:"dane-last-attempt,omitzero"`
+	MtaStsLastAttempt time.Time `json:"mta-sts-last-attempt,omitzero"`
+	Domain            string    `json:"domain"`
+	Policy            string    `json:"policy"`
+	Source            string    `json:"source"`
+	Report            string    `json:"report,omitempty"`
+	RemainingTTL      uint32    `json:"remaining-ttl"`
+	Counter           uint32    `json:"counter"`
+}
+
+var dumpCSVHeader = []string{"domain", "policy", "source", "remaining_ttl", "counter", "dane_last_attempt", "mta_sts_last_attempt", "report"}
+
+func (e DumpEntry) csvRecord() []string {
+	return []string{
+		e.Domain,
+		e.Policy,
+		e.Source,
+		strconv.FormatUint(uint64(e.RemainingTTL), 10),
+		strconv.FormatUint(uint64(e.Counter), 10),
+		formatDumpTime(e.DaneLastAttempt),
+		formatDumpTime(e.MtaStsLastAttempt),
+		e.Report,
+	}
+}
+
+func formatDumpTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func dumpCachedPoliciesAs(conn net.Conn, format string) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format != DUMP_FORMAT_JSON && format != DUMP_FORMAT_CSV {
+		fmt.Fprintf(conn, "ERROR: unknown dump format %q\n", format)
+		return
+	}
+	items := tidyCache()
+	counters := sortCacheEntriesByCounter(items)
+	writer := bufio.NewWriterSize(conn, 64<<10)
+	defer func() {
+		if err := writer.Flush(); err != nil {
+			slog.Debug("Could not flush cached policy dump", "error", err)
+		}
+	}()
+	var (
+		enc  *json.Encoder
+		rows *csv.Writer
+	)
+	if format == DUMP_FORMAT_JSON {
+		enc = json.NewEncoder(writer)
+	} else {
+		rows = csv.NewWriter(writer)
+		if err := rows.Write(dumpCSVHeader); err != nil {
+			slog.Debug("Could not write cached policy dump", "error", err)
+			return
+		}
+	}
+	now := time.Now()
+	for i, entry := range items {
+		policy, report, remainingTTL, source, ok := selectServedPolicySource(entry.Key, entry.Value, now)
+		if ok {
+			policy, report = mapPolicy(&config.PolicyMapping, entry.Key, policy, report)
+		}
+		e := DumpEntry{
+			DaneLastAttempt:   entry.Value.DaneLastAttempt,
+			MtaStsLastAttempt: entry.Value.MtaStsLastAttempt,
+			Domain:            entry.Key,
+			Policy:            policy,
+			Source:            source,
+			Report:            report,
+			RemainingTTL:      remainingTTL,
+			Counter:           counters[i],
+		}
+		var err error
+		if enc != nil {
+			err = enc.Encode(e)
+		} else {
+			err = rows.Write(e.csvRecord())
+		}
+		if err != nil {
+			slog.Debug("Could not write cached policy dump", "error", err)
+			return
+		}
+	}
+	if rows != nil {
+		rows.Flush()
+		if err := rows.Error(); err != nil {
+			slog.Debug("Could not write cached policy dump", "error", err)
+		}
+	}
+}
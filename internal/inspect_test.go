@@ -0,0 +1,285 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+)
+
+func runControlCommand(t *testing.T, query string) string {
+	t.Helper()
+	conn := newSecurityTestConn(nil, &net.UnixAddr{Name: "@", Net: "unix"})
+	handleSocketmapConnection(conn, bufio.NewReader(bytes.NewReader(netstring.Marshal(query))))
+	return conn.output.String()
+}
+
+func decodeInspectResult(t *testing.T, raw string) InspectResult {
+	t.Helper()
+	var r InspectResult
+	if err := json.Unmarshal([]byte(raw), &r); err != nil {
+		t.Fatalf("decode inspect result %q: %v", raw, err)
+	}
+	return r
+}
+
+func TestInspectReportsCachedBranches(t *testing.T) {
+	useTestPolicyCache(t)
+	now := time.Now()
+	polCache.Set("example.org", &CacheStruct{
+		DaneLastAttempt: now.Add(-time.Minute),
+		Expirable:       &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+		Policy:          "dane-only",
+		Dane:            PolicyBranch{Policy: "dane-only", TTL: 3600, ExpiresAt: now.Add(time.Hour)},
+		MtaSts:          PolicyBranch{TTL: 600, ExpiresAt: now.Add(10 * time.Minute)},
+		TTL:             3600,
+		Counter:         4,
+	})
+	addCacheHitCounter("example.org")
+
+	r := decodeInspectResult(t, runControlCommand(t, "INSPECT Example.org."))
+	if !r.Cached || r.Domain != "example.org" || r.Counter != 5 {
+		t.Fatalf("unexpected inspect result: %+v", r)
+	}
+	if r.Served == nil || r.Served.Policy != "dane-only" || r.Served.TTL == 0 || r.Served.TTL > 3600 {
+		t.Fatalf("unexpected served policy: %+v", r.Served)
+	}
+	if r.Dane == nil || r.Dane.RemainingTTL == 0 || r.MtaSts == nil || r.MtaSts.Policy != "" || r.DaneLastAttempt.IsZero() {
+		t.Fatalf("unexpected branches: dane=%+v mta-sts=%+v", r.Dane, r.MtaSts)
+	}
+
+	if r := decodeInspectResult(t, runControlCommand(t, "INSPECT missing.example")); r.Cached || r.Served != nil {
+		t.Fatalf("unexpected result for missing domain: %+v", r)
+	}
+	if got := runControlCommand(t, "INSPECT bad@domain"); got != string(NS_NOTFOUND) {
+		t.Fatalf("invalid domain response = %q", got)
+	}
+}
+
+func TestRefreshStoresFreshLookup(t *testing.T) {
+	useTestPolicyCache(t)
+	originalDane, originalMtaSts := checkDanePolicy, checkMtaStsPolicy
+	t.Cleanup(func() {
+		checkDanePolicy, checkMtaStsPolicy = originalDane, originalMtaSts
+	})
+	checkDanePolicy = func(context.Context, string, bool) (string, uint32) {
+		return "dane-only", 600
+	}
+	checkMtaStsPolicy = func(context.Context, string, bool) (string, string, uint32) {
+		return "", "", 0
+	}
+	now := time.Now()
+	polCache.Set("example.org", &CacheStruct{
+		Expirable: &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+		Policy:    "dane",
+		Dane:      PolicyBranch{Policy: "dane", TTL: 3600, ExpiresAt: now.Add(time.Hour)},
+		TTL:       3600,
+		Counter:   2,
+	})
+
+	r := decodeInspectResult(t, runControlCommand(t, "REFRESH example.org"))
+	if r.Error != "" || r.Served == nil || r.Served.Policy != "dane-only" || r.Counter != 2 {
+		t.Fatalf("unexpected refresh result: %+v", r)
+	}
+	if c, _ := polCache.Get("example.org"); c.Dane.Policy != "dane-only" {
+		t.Fatalf("refresh did not store the new policy: %+v", c)
+	}
+
+	checkDanePolicy = func(context.Context, string, bool) (string, uint32) {
+		return "TEMP", 0
+	}
+	if r := decodeInspectResult(t, runControlCommand(t, "REFRESH example.org")); r.Error == "" || r.Served == nil || r.Served.Policy != "dane-only" {
+		t.Fatalf("failed refresh should report the error and keep the cached policy: %+v", r)
+	}
+}
+
+func TestPurgeDomainAndSuffix(t *testing.T) {
+	useTestPolicyCache(t)
+	now := time.Now()
+	for _, domain := range []string{"example.org", "a.example.org", "b.a.example.org", "notexample.org", "other.net"} {
+		polCache.Set(domain, &CacheStruct{
+			Expirable: &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+			Dane:      PolicyBranch{Policy: "dane", TTL: 3600, ExpiresAt: now.Add(time.Hour)},
+		})
+	}
+
+	t.Cleanup(lookupFailureStreaks.clear)
+	addLookupFailure("a.example.org")
+	addLookupFailure("failing.example.org")
+	addLookupFailure("other.net")
+	cacheLastQueried.Store("a.example.org", now.UnixNano())
+	cacheLastQueried.Store("other.net", now.UnixNano())
+	t.Cleanup(func() { cacheLastQueried.Clear() })
+
+	if got := runControlCommand(t, "PURGE *.example.org"); got != "OK removed=2\n" {
+		t.Fatalf("suffix purge response = %q", got)
+	}
+	for domain, want := range map[string]bool{"example.org": true, "a.example.org": false, "b.a.example.org": false, "notexample.org": true} {
+		if _, ok := polCache.Get(domain); ok != want {
+			t.Fatalf("%s cached = %v after suffix purge, want %v", domain, ok, want)
+		}
+	}
+	if got := runControlCommand(t, "PURGE other.net"); got != "OK removed=1\n" {
+		t.Fatalf("domain purge response = %q", got)
+	}
+	if got := runControlCommand(t, "PURGE other.net"); got != "OK removed=0\n" {
+		t.Fatalf("repeated purge response = %q", got)
+	}
+	for _, domain := range []string{"a.example.org", "other.net"} {
+		if _, ok := cacheLastQueried.Load(domain); ok {
+			t.Fatalf("%s kept its last query time after purge", domain)
+		}
+	}
+	for _, domain := range []string{"a.example.org", "failing.example.org", "other.net"} {
+		if got := addLookupFailure(domain); got != 1 {
+			t.Fatalf("%s kept a failure streak of %d after purge", domain, got-1)
+		}
+	}
+	if got := runControlCommand(t, "PURGE *.bad@domain"); got[:6] != "ERROR:" {
+		t.Fatalf("invalid pattern response = %q", got)
+	}
+	if polCache.Len() != 2 {
+		t.Fatalf("unexpected remaining entries: %d", polCache.Len())
+	}
+}
+
+func TestDumpJSONAndCSVIncludeEveryEntry(t *testing.T) {
+	useTestPolicyCache(t)
+	now := time.Now()
+	polCache.Set("dane.example", &CacheStruct{
+		DaneLastAttempt: now.Add(-time.Minute),
+		Expirable:       &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+		Dane:            PolicyBranch{Policy: "dane-only", TTL: 3600, ExpiresAt: now.Add(time.Hour)},
+		Counter:         7,
+	})
+	// Expires before the next prefetch interval, so the text dump hides it.
+	polCache.Set("sts.example", &CacheStruct{
+		Expirable: &cache.Expirable{ExpiresAt: now.Add(time.Minute)},
+		Dane:      PolicyBranch{TTL: 60, ExpiresAt: now.Add(time.Minute)},
+		MtaSts:    PolicyBranch{Policy: "secure match=mx.example", Report: "policy_type=sts", TTL: 60, ExpiresAt: now.Add(time.Minute)},
+		Counter:   1,
+	})
+
+	var entries []DumpEntry
+	dec := json.NewDecoder(bytes.NewReader([]byte(runControlCommand(t, "DUMP JSON"))))
+	for dec.More() {
+		var e DumpEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("decode dump entry: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d dump entries, want 2: %+v", len(entries), entries)
+	}
+	if e := entries[0]; e.Domain != "dane.example" || e.Policy != "dane-only" || e.Source != "dane" || e.Counter != 7 || e.RemainingTTL == 0 || e.DaneLastAttempt.IsZero() {
+		t.Fatalf("unexpected first entry: %+v", e)
+	}
+	if e := entries[1]; e.Domain != "sts.example" || e.Source != "mta-sts" || e.Report != "policy_type=sts" || e.RemainingTTL == 0 {
+		t.Fatalf("unexpected second entry: %+v", e)
+	}
+
+	rows, err := csv.NewReader(bytes.NewReader([]byte(runControlCommand(t, "DUMP csv")))).ReadAll()
+	if err != nil {
+		t.Fatalf("parse csv dump: %v", err)
+	}
+	if len(rows) != 3 || !slices.Equal(rows[0], dumpCSVHeader) || rows[1][0] != "dane.example" || rows[2][1] != "secure match=mx.example" {
+		t.Fatalf("unexpected csv dump: %q", rows)
+	}
+
+	if got := runControlCommand(t, "DUMP XML"); !strings.HasPrefix(got, "ERROR:") {
+		t.Fatalf("unknown format response = %q", got)
+	}
+}
+
+func TestDumpSourceNamesProbationAndRules(t *testing.T) {
+	useTestPolicyCache(t)
+	rules := mustParsePolicyRules(t, testPolicyRules)
+	patchConfigForTest(t, func(c *Config) { c.rules = rules })
+	patchConfigForTest(t, func(c *Config) {
+		c.Probation = ProbationConfig{Enabled: true, Period: 3600}
+	})
+	now := time.Now()
+	polCache.Set("probation.example", &CacheStruct{
+		Expirable: &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+		Dane:      PolicyBranch{Policy: "dane-only", TTL: 3600, ExpiresAt: now.Add(time.Hour)},
+		Probation: &PolicyProbation{Since: now, Until: now.Add(time.Hour), Policy: "dane-only"},
+		Counter:   2,
+	})
+	storeDomainResult("shop.subsidiary.example", nil, testDomainResult("", "", "policy_type=sts"), 1)
+
+	sources := make(map[string]DumpEntry)
+	dec := json.NewDecoder(bytes.NewReader([]byte(runControlCommand(t, "DUMP JSON"))))
+	for dec.More() {
+		var e DumpEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("decode dump entry: %v", err)
+		}
+		sources[e.Domain] = e
+	}
+	if e := sources["probation.example"]; e.Policy != "dane" || e.Source != "probation" {
+		t.Fatalf("probation entry = %+v, want dane from probation", e)
+	}
+	if e := sources["shop.subsidiary.example"]; e.Policy != "encrypt" || e.Source != "rule" {
+		t.Fatalf("rule entry = %+v, want encrypt from rule", e)
+	}
+}
+
+func TestPrefetchStatusListsScheduledPrefetches(t *testing.T) {
+	now := time.Now()
+	oldScheduler := activePrefetchScheduler.Load()
+	scheduler := newPrefetchSchedulerAt(now.Add(-time.Hour), 5)
+	activePrefetchScheduler.Store(scheduler)
+	t.Cleanup(func() { activePrefetchScheduler.Store(oldScheduler) })
+
+	scheduler.schedule("late.example", now.Add(-time.Minute))
+	scheduler.schedule("soon.example", now.Add(time.Minute))
+	scheduler.schedule("later.example", now.Add(time.Hour))
+	due, attempts, _, ok := scheduler.scheduleRetryUntil("soon.example", now, now.Add(2*time.Hour))
+	if !ok || attempts != 1 {
+		t.Fatalf("scheduleRetryUntil = %s, %d, %v", due, attempts, ok)
+	}
+	scheduler.recordBatch(now.Add(-2*time.Second), 3)
+
+	var status PrefetchStatus
+	raw := runControlCommand(t, "PREFETCH 2")
+	if err := json.Unmarshal([]byte(raw), &status); err != nil {
+		t.Fatalf("decode prefetch status %q: %v", raw, err)
+	}
+	if !status.Enabled || status.Queued != 3 || status.Overdue != 1 || status.LastBatchSize != 3 || status.LastBatchDuration < 2 {
+		t.Fatalf("unexpected prefetch status: %+v", status)
+	}
+	if len(status.Entries) != 2 {
+		t.Fatalf("expected the limit to apply, got %+v", status.Entries)
+	}
+	late, soon := status.Entries[0], status.Entries[1]
+	if late.Domain != "late.example" || !late.Overdue || late.Retries != 0 || !late.GraceDeadline.IsZero() {
+		t.Fatalf("unexpected overdue entry: %+v", late)
+	}
+	if soon.Domain != "soon.example" || soon.Overdue || soon.Retries != 1 || !soon.Due.Equal(due) ||
+		!soon.GraceDeadline.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("unexpected retry entry: %+v", soon)
+	}
+
+	if got := runControlCommand(t, "PREFETCH 0"); !strings.HasPrefix(got, "ERROR: ") {
+		t.Fatalf("expected invalid limit to be rejected, got %q", got)
+	}
+	activePrefetchScheduler.Store(nil)
+	if err := json.Unmarshal([]byte(runControlCommand(t, "PREFETCH")), &status); err != nil || status.Enabled || len(status.Entries) != 0 {
+		t.Fatalf("expected disabled prefetching to report no entries, got %+v (%v)", status, err)
+	}
+}
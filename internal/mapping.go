@@ -0,0 +1,57 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+// policyMappingFor returns the global policy mapping of cfg with the fields
+// set for the longest suffix of domain taking precedence.
+func policyMappingFor(cfg *PolicyMappingConfig, domain string) PolicyMapping {
+	m := cfg.PolicyMapping
+	override, ok := longestDomainSuffix(cfg.Domains, domain)
+	if !ok {
+		return m
+	}
+	for _, field := range []struct{ dst, src *string }{
+		{&m.DaneOnly, &override.DaneOnly},
+		{&m.Dane, &override.Dane},
+		{&m.Secure, &override.Secure},
+		{&m.MtaStsTesting, &override.MtaStsTesting},
+		{&m.Attributes, &override.Attributes},
+	} {
+		if *field.src != "" {
+			*field.dst = *field.src
+		}
+	}
+	return m
+}
+
+// mapPolicy returns the reply for policy, as looked up or served for domain,
+// according to cfg. Policies replaced by encrypt or may lose the TLSRPT
+// attributes of the policy they replace.
+func mapPolicy(cfg *PolicyMappingConfig, domain string, policy string, report string) (string, string) {
+	if policy == "" || policy == "TEMP" {
+		return policy, report
+	}
+	m := policyMappingFor(cfg, domain)
+	var target string
+	switch firstWord(policy) {
+	case "dane-only":
+		target = m.DaneOnly
+	case "dane":
+		target = m.Dane
+	case "secure":
+		target = m.Secure
+	}
+	if target != "" && target != firstWord(policy) {
+		if target == "encrypt" || target == "may" {
+			report = ""
+		}
+		policy = target
+	}
+	if m.Attributes != "" {
+		policy += " " + m.Attributes
+	}
+	return policy, report
+}
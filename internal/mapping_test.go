@@ -0,0 +1,87 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMapPolicyAppliesDomainOverrides(t *testing.T) {
+	patchConfigForTest(t, func(c *Config) {
+		c.PolicyMapping = PolicyMappingConfig{
+			PolicyMapping: PolicyMapping{Dane: "encrypt", Attributes: "protocols=>=TLSv1.2"},
+			Domains: map[string]PolicyMapping{
+				".Partner.Example": {Secure: "encrypt", Attributes: "ciphers=high"},
+			},
+		}
+		if err := c.PolicyMapping.validate("policy-mapping"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	for _, tt := range []struct {
+		domain, policy, report string
+		wantPolicy, wantReport string
+	}{
+		{"other.example", "dane", "", "encrypt protocols=>=TLSv1.2", ""},
+		{"other.example", "dane-only", "", "dane-only protocols=>=TLSv1.2", ""},
+		{"other.example", "secure match=mx.other.example", "policy_type=sts", "secure match=mx.other.example protocols=>=TLSv1.2", "policy_type=sts"},
+		{"mx.partner.example", "secure match=mx.partner.example", "policy_type=sts", "encrypt ciphers=high", ""},
+		{"partner.example", "dane", "", "encrypt ciphers=high", ""},
+		{"other.example", "", "", "", ""},
+		{"other.example", "TEMP", "", "TEMP", ""},
+	} {
+		policy, report := mapPolicy(&config.PolicyMapping, tt.domain, tt.policy, tt.report)
+		if policy != tt.wantPolicy || report != tt.wantReport {
+			t.Fatalf("mapPolicy(%s, %q) = %q, %q, want %q, %q", tt.domain, tt.policy, policy, report, tt.wantPolicy, tt.wantReport)
+		}
+	}
+}
+
+func TestPolicyMappingAppliesToReplies(t *testing.T) {
+	patchConfigForTest(t, func(c *Config) {
+		c.PolicyMapping = PolicyMappingConfig{PolicyMapping: PolicyMapping{Dane: "encrypt"}}
+	})
+	if got := string(replyForTest("example.com", "dane")); got != "10:OK encrypt," {
+		t.Fatalf("reply = %q, want OK encrypt", got)
+	}
+}
+
+func TestPolicyMappingEnforcesMtaStsTesting(t *testing.T) {
+	body := "version: STSv1\nmode: testing\nmx: mail.example.com\nmax_age: 86400\n"
+	if policy, _, _ := parseMtaStsPolicy("example.com", strings.NewReader(body)); policy != "" {
+		t.Fatalf("policy in testing mode = %q, want none", policy)
+	}
+	patchConfigForTest(t, func(c *Config) {
+		c.PolicyMapping = PolicyMappingConfig{Domains: map[string]PolicyMapping{"example.com": {MtaStsTesting: "secure"}}}
+	})
+	policy, _, ttl := parseMtaStsPolicy("example.com", strings.NewReader(body))
+	if policy != "secure match=mail.example.com servername=hostname" || ttl != 86400 {
+		t.Fatalf("mapped policy = %q (ttl %d), want secure", policy, ttl)
+	}
+	if policy, _, _ := parseMtaStsPolicy("example.net", strings.NewReader(body)); policy != "" {
+		t.Fatalf("policy of unmapped domain = %q, want none", policy)
+	}
+}
+
+func TestLoadConfigPolicyMapping(t *testing.T) {
+	initializeTestDefaultConfig(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	body := "server:\n  address: 127.0.0.1:8642\npolicy-mapping:\n  dane: Encrypt\n  attributes: '  protocols=>=TLSv1.2   ciphers=high '\n  domains:\n    bank.example:\n      mta-sts-testing: secure\n"
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := cfg.PolicyMapping
+	if m.Dane != "encrypt" || m.Attributes != "protocols=>=TLSv1.2 ciphers=high" || m.Domains["bank.example"].MtaStsTesting != "secure" {
+		t.Fatalf("policy mapping = %+v", m)
+	}
+}
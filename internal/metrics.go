@@ -10,8 +10,13 @@ import (
 	"runtime"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
+// prefetchBatchBuckets are the upper bounds in seconds of the prefetch batch
+// duration histogram.
+var prefetchBatchBuckets = [...]float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60}
+
 var (
 	metricQueriesTotal  atomic.Uint64
 	metricDaneTotal     atomic.Uint64
@@ -23,6 +28,38 @@ var (
 	metricPrefetchOK    atomic.Uint64
 	metricPrefetchFail  atomic.Uint64
 	metricPrefetchDrop  atomic.Uint64
+	metricPrefetchIdle  atomic.Uint64
+	metricPrefetchDefer atomic.Uint64
+
+	metricShadowDane     atomic.Uint64
+	metricShadowDaneOnly atomic.Uint64
+	metricShadowSecure   atomic.Uint64
+	metricShadowNoPolicy atomic.Uint64
+	metricShadowTemp     atomic.Uint64
+
+	metricFallbackNotFound atomic.Uint64
+	metricFallbackEncrypt  atomic.Uint64
+	metricFallbackMay      atomic.Uint64
+
+	metricEvictCapacity  atomic.Uint64
+	metricEvictAdmission atomic.Uint64
+
+	metricPinHeld      atomic.Uint64
+	metricPinConfirmed atomic.Uint64
+	metricPinReleased  atomic.Uint64
+
+	metricEventDanePublished   atomic.Uint64
+	metricEventDaneWithdrawn   atomic.Uint64
+	metricEventMtaStsPublished atomic.Uint64
+	metricEventMtaStsWithdrawn atomic.Uint64
+	metricEventDowngrade       atomic.Uint64
+	metricEventFailWebhook     atomic.Uint64
+	metricEventFailCommand     atomic.Uint64
+	metricEventFailSyslog      atomic.Uint64
+
+	metricPrefetchBatchBuckets [len(prefetchBatchBuckets)]atomic.Uint64
+	metricPrefetchBatchCount   atomic.Uint64
+	metricPrefetchBatchMicros  atomic.Uint64
 )
 
 func addMetricQuery() {
@@ -43,6 +80,36 @@ func observePolicy(policy string) {
 	}
 }
 
+// observeShadowPolicy counts a policy evaluated in shadow mode, which
+// Postfix did not get.
+func observeShadowPolicy(policy string) {
+	switch firstWord(policy) {
+	case "dane-only":
+		metricShadowDaneOnly.Add(1)
+	case "dane":
+		metricShadowDane.Add(1)
+	case "secure":
+		metricShadowSecure.Add(1)
+	case "TEMP":
+		metricShadowTemp.Add(1)
+	case "":
+		metricShadowNoPolicy.Add(1)
+	}
+}
+
+// observeFailureFallback counts a temporary lookup failure answered by the
+// failure policy instead of TEMP.
+func observeFailureFallback(policy string) {
+	switch policy {
+	case "notfound":
+		metricFallbackNotFound.Add(1)
+	case "encrypt":
+		metricFallbackEncrypt.Add(1)
+	case "may":
+		metricFallbackMay.Add(1)
+	}
+}
+
 func observeCacheRequest(hit bool) {
 	if hit {
 		metricCacheHits.Add(1)
@@ -59,6 +126,69 @@ func observePrefetch(result string) {
 		metricPrefetchFail.Add(1)
 	case "discard":
 		metricPrefetchDrop.Add(1)
+	case "idle":
+		metricPrefetchIdle.Add(1)
+	case "deferred":
+		metricPrefetchDefer.Add(1)
+	}
+}
+
+func observePrefetchBatch(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	for i, le := range prefetchBatchBuckets {
+		if seconds <= le {
+			metricPrefetchBatchBuckets[i].Add(1)
+		}
+	}
+	metricPrefetchBatchCount.Add(1)
+	metricPrefetchBatchMicros.Add(uint64(elapsed.Microseconds()))
+}
+
+func observeDowngradePin(result string) {
+	switch result {
+	case "held":
+		metricPinHeld.Add(1)
+	case "confirmed":
+		metricPinConfirmed.Add(1)
+	case "released":
+		metricPinReleased.Add(1)
+	}
+}
+
+func observePolicyEvent(event string) {
+	switch event {
+	case "dane-published":
+		metricEventDanePublished.Add(1)
+	case "dane-withdrawn":
+		metricEventDaneWithdrawn.Add(1)
+	case "mta-sts-published":
+		metricEventMtaStsPublished.Add(1)
+	case "mta-sts-withdrawn":
+		metricEventMtaStsWithdrawn.Add(1)
+	case "downgrade":
+		metricEventDowngrade.Add(1)
+	}
+}
+
+func observeEventDeliveryFailure(sink string) {
+	switch sink {
+	case "webhook":
+		metricEventFailWebhook.Add(1)
+	case "command":
+		metricEventFailCommand.Add(1)
+	case "syslog":
+		metricEventFailSyslog.Add(1)
+	}
+}
+
+// observeCacheEviction counts a domain dropped for its low popularity, either
+// evicted from a full cache or refused admission to it.
+func observeCacheEviction(reason string) {
+	switch reason {
+	case "capacity":
+		metricEvictCapacity.Add(1)
+	case "admission":
+		metricEvictAdmission.Add(1)
 	}
 }
 
@@ -83,6 +213,18 @@ func buildMetricsText() string {
 	fmt.Fprintf(&b, "postfix_tlspol_policy_total{policy=\"dane-only\"} %d\n", daneOnly)
 	fmt.Fprintf(&b, "postfix_tlspol_policy_total{policy=\"secure\"} %d\n", metricSecureTotal.Load())
 	fmt.Fprintf(&b, "postfix_tlspol_policy_total{policy=\"no-policy\"} %d\n", metricNoPolicyTotal.Load())
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_shadow_policy_total Total policies evaluated in shadow mode by policy type, not returned to Postfix.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_shadow_policy_total counter\n")
+	fmt.Fprintf(&b, "postfix_tlspol_shadow_policy_total{policy=\"dane\"} %d\n", metricShadowDane.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_shadow_policy_total{policy=\"dane-only\"} %d\n", metricShadowDaneOnly.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_shadow_policy_total{policy=\"secure\"} %d\n", metricShadowSecure.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_shadow_policy_total{policy=\"no-policy\"} %d\n", metricShadowNoPolicy.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_shadow_policy_total{policy=\"temp\"} %d\n", metricShadowTemp.Load())
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_failure_fallbacks_total Total temporary lookup failures answered by the failure policy instead of TEMP.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_failure_fallbacks_total counter\n")
+	fmt.Fprintf(&b, "postfix_tlspol_failure_fallbacks_total{policy=\"notfound\"} %d\n", metricFallbackNotFound.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_failure_fallbacks_total{policy=\"encrypt\"} %d\n", metricFallbackEncrypt.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_failure_fallbacks_total{policy=\"may\"} %d\n", metricFallbackMay.Load())
 	fmt.Fprintf(&b, "# HELP postfix_tlspol_cache_requests_total Total policy cache lookups by result.\n")
 	fmt.Fprintf(&b, "# TYPE postfix_tlspol_cache_requests_total counter\n")
 	fmt.Fprintf(&b, "postfix_tlspol_cache_requests_total{result=\"hit\"} %d\n", metricCacheHits.Load())
@@ -94,11 +236,61 @@ func buildMetricsText() string {
 	fmt.Fprintf(&b, "# HELP postfix_tlspol_cache_entries Current number of in-memory policy cache entries.\n")
 	fmt.Fprintf(&b, "# TYPE postfix_tlspol_cache_entries gauge\n")
 	fmt.Fprintf(&b, "postfix_tlspol_cache_entries %d\n", cacheEntries)
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_cache_evictions_total Total domains dropped from the policy cache for low popularity by reason.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_cache_evictions_total counter\n")
+	fmt.Fprintf(&b, "postfix_tlspol_cache_evictions_total{reason=\"capacity\"} %d\n", metricEvictCapacity.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_cache_evictions_total{reason=\"admission\"} %d\n", metricEvictAdmission.Load())
 	fmt.Fprintf(&b, "# HELP postfix_tlspol_prefetch_total Total policy prefetch outcomes by result.\n")
 	fmt.Fprintf(&b, "# TYPE postfix_tlspol_prefetch_total counter\n")
 	fmt.Fprintf(&b, "postfix_tlspol_prefetch_total{result=\"success\"} %d\n", metricPrefetchOK.Load())
 	fmt.Fprintf(&b, "postfix_tlspol_prefetch_total{result=\"failure\"} %d\n", metricPrefetchFail.Load())
 	fmt.Fprintf(&b, "postfix_tlspol_prefetch_total{result=\"discard\"} %d\n", metricPrefetchDrop.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_prefetch_total{result=\"idle\"} %d\n", metricPrefetchIdle.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_prefetch_total{result=\"deferred\"} %d\n", metricPrefetchDefer.Load())
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_downgrade_pins_total Total policy downgrades seen during refresh by pinning outcome.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_downgrade_pins_total counter\n")
+	fmt.Fprintf(&b, "postfix_tlspol_downgrade_pins_total{result=\"held\"} %d\n", metricPinHeld.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_downgrade_pins_total{result=\"confirmed\"} %d\n", metricPinConfirmed.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_downgrade_pins_total{result=\"released\"} %d\n", metricPinReleased.Load())
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_policy_events_total Total policy change events by event type.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_policy_events_total counter\n")
+	fmt.Fprintf(&b, "postfix_tlspol_policy_events_total{event=\"dane-published\"} %d\n", metricEventDanePublished.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_policy_events_total{event=\"dane-withdrawn\"} %d\n", metricEventDaneWithdrawn.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_policy_events_total{event=\"mta-sts-published\"} %d\n", metricEventMtaStsPublished.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_policy_events_total{event=\"mta-sts-withdrawn\"} %d\n", metricEventMtaStsWithdrawn.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_policy_events_total{event=\"downgrade\"} %d\n", metricEventDowngrade.Load())
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_event_delivery_failures_total Total policy events that could not be delivered by sink.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_event_delivery_failures_total counter\n")
+	fmt.Fprintf(&b, "postfix_tlspol_event_delivery_failures_total{sink=\"webhook\"} %d\n", metricEventFailWebhook.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_event_delivery_failures_total{sink=\"command\"} %d\n", metricEventFailCommand.Load())
+	fmt.Fprintf(&b, "postfix_tlspol_event_delivery_failures_total{sink=\"syslog\"} %d\n", metricEventFailSyslog.Load())
+	queued, overdue := 0, 0
+	if scheduler := activePrefetchScheduler.Load(); scheduler != nil {
+		queued, overdue = scheduler.queueStats(time.Now())
+	}
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_prefetch_queue_length Current number of domains scheduled for prefetching.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_prefetch_queue_length gauge\n")
+	fmt.Fprintf(&b, "postfix_tlspol_prefetch_queue_length %d\n", queued)
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_prefetch_overdue Current number of scheduled prefetches that are overdue.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_prefetch_overdue gauge\n")
+	fmt.Fprintf(&b, "postfix_tlspol_prefetch_overdue %d\n", overdue)
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_prefetch_batch_duration_seconds Time taken by prefetch batches.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_prefetch_batch_duration_seconds histogram\n")
+	for i, le := range prefetchBatchBuckets {
+		fmt.Fprintf(&b, "postfix_tlspol_prefetch_batch_duration_seconds_bucket{le=\"%g\"} %d\n", le, metricPrefetchBatchBuckets[i].Load())
+	}
+	batches := metricPrefetchBatchCount.Load()
+	fmt.Fprintf(&b, "postfix_tlspol_prefetch_batch_duration_seconds_bucket{le=\"+Inf\"} %d\n", batches)
+	fmt.Fprintf(&b, "postfix_tlspol_prefetch_batch_duration_seconds_sum %.6f\n", float64(metricPrefetchBatchMicros.Load())/1e6)
+	fmt.Fprintf(&b, "postfix_tlspol_prefetch_batch_duration_seconds_count %d\n", batches)
+	var dnsWait, httpsWait float64
+	if budget := prefetchBudget.Load(); budget != nil {
+		dnsWait, httpsWait = budget.dns.waitedSeconds(), budget.https.waitedSeconds()
+	}
+	fmt.Fprintf(&b, "# HELP postfix_tlspol_prefetch_budget_wait_seconds_total Time prefetch lookups waited for the query budget.\n")
+	fmt.Fprintf(&b, "# TYPE postfix_tlspol_prefetch_budget_wait_seconds_total counter\n")
+	fmt.Fprintf(&b, "postfix_tlspol_prefetch_budget_wait_seconds_total{kind=\"dns\"} %.6f\n", dnsWait)
+	fmt.Fprintf(&b, "postfix_tlspol_prefetch_budget_wait_seconds_total{kind=\"https\"} %.6f\n", httpsWait)
 	fmt.Fprintf(&b, "# HELP postfix_tlspol_go_goroutines Number of goroutines that currently exist.\n")
 	fmt.Fprintf(&b, "# TYPE postfix_tlspol_go_goroutines gauge\n")
 	fmt.Fprintf(&b, "postfix_tlspol_go_goroutines %d\n", runtime.NumGoroutine())
@@ -272,17 +272,19 @@ func (p *mtaStsPolicyParser) parseLine(line string) bool {
 		p.hasVersion = true
 		p.writeReportField(key, reportVal)
 	case "mx":
-		if strings.HasPrefix(val, "*.") {
-			if !valid.IsDNSName(val[2:]) {
-				return false
-			}
-		} else if !valid.IsDNSName(val) {
+		// Patterns may use U-labels, MX hosts are matched by their A-labels
+		host, wildcard := strings.CutPrefix(val, "*.")
+		host = domainToASCII(strings.ToLower(host))
+		if !valid.IsDNSName(host) {
 			return false
 		}
-		val = strings.ToLower(val)
+		val = host
+		if wildcard {
+			val = "*." + host
+		}
 		p.mxHosts.WriteString(" mx_host_pattern=")
 		p.mxHosts.WriteString(val)
-		if strings.HasPrefix(val, "*.") {
+		if wildcard {
 			val = val[1:]
 		}
 		p.mxServers = append(p.mxServers, val)
@@ -345,7 +347,9 @@ func parseMtaStsPolicy(domain string, r io.Reader) (string, string, uint32) {
 	}
 	report := parser.reportFor(domain)
 
-	if parser.mode == "enforce" && len(parser.mxServers) != 0 {
+	// A policy in testing mode may be mapped to secure, see PolicyMapping
+	enforce := parser.mode == "enforce" || (parser.mode == "testing" && policyMappingFor(&config.PolicyMapping, domain).MtaStsTesting == "secure")
+	if enforce && len(parser.mxServers) != 0 {
 		res := "secure match=" + strings.Join(parser.mxServers, ":") + " servername=hostname"
 		return res, report, parser.maxAge
 	}
@@ -362,6 +366,10 @@ func isValidMtaStsPolicyMediaType(contentType string) bool {
 }
 
 func checkMtaSts(ctx context.Context, domain string, mayRetry bool) (string, string, uint32) {
+	if _, ok := parseNextHop(domain); ok {
+		// MTA-STS applies to MX delivery to a recipient domain on port 25
+		return "", "", 0
+	}
 	resolverAddress, err := config.Dns.GetResolverAddress()
 	if err != nil {
 		logPolicyLookupFailure(ctx, "DNS resolver configuration error during MTA-STS lookup", "domain", domain, "error", err)
@@ -405,6 +413,9 @@ func checkMtaStsOnce(ctx context.Context, domain string, resolverAddress string)
 		return "", "", 0, err
 	}
 	req.Header.Set("User-Agent", "postfix-tlspol/"+Version)
+	if err := spendHTTPSBudget(ctx); err != nil {
+		return "", "", 0, err
+	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", "", 0, err
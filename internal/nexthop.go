@@ -0,0 +1,104 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/valid"
+)
+
+const SMTP_PORT = 25
+
+// nextHop is a Postfix next-hop destination other than a plain domain: a
+// host in brackets, for which Postfix does not look up MX records, as used
+// by relayhost and transport(5), and/or a port other than 25.
+type nextHop struct {
+	host      string
+	port      uint16
+	bracketed bool
+}
+
+// key is the cache key of h. Port 25 is left out, so [mx.example.com]:25
+// and [mx.example.com] share an entry.
+func (h nextHop) key() string {
+	key := h.host
+	if h.bracketed {
+		key = "[" + key + "]"
+	}
+	if h.port != SMTP_PORT {
+		key += ":" + strconv.Itoa(int(h.port))
+	}
+	return key
+}
+
+// parseNextHop parses a normalized key such as [mx.example.com],
+// [mx.example.com]:587 or example.com:587. It fails for plain domains and
+// for IP literals, which have no DNS name to look up policies for.
+func parseNextHop(key string) (nextHop, bool) {
+	h := nextHop{host: key, port: SMTP_PORT}
+	if rest, ok := strings.CutPrefix(key, "["); ok {
+		host, port, ok := strings.Cut(rest, "]")
+		if !ok {
+			return nextHop{}, false
+		}
+		h.host, h.bracketed = host, true
+		if port != "" {
+			port, ok = strings.CutPrefix(port, ":")
+			if !ok || !parseNextHopPort(port, &h) {
+				return nextHop{}, false
+			}
+		}
+	} else if host, port, ok := strings.Cut(key, ":"); ok {
+		h.host = host
+		if !parseNextHopPort(port, &h) {
+			return nextHop{}, false
+		}
+	} else {
+		return nextHop{}, false
+	}
+	h.host = domainToASCII(strings.TrimSuffix(h.host, "."))
+	if _, err := netip.ParseAddr(strings.TrimPrefix(h.host, "ipv6:")); err == nil {
+		return nextHop{}, false
+	}
+	if !valid.IsDNSName(h.host) || strings.HasPrefix(h.host, ".") {
+		return nextHop{}, false
+	}
+	return h, true
+}
+
+func parseNextHopPort(s string, h *nextHop) bool {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return false
+	}
+	h.port = uint16(port)
+	return true
+}
+
+// normalizePolicyKey returns the cache key of a domain or next-hop
+// destination queried by Postfix, and whether policies can be looked up for it.
+func normalizePolicyKey(s string) (string, bool) {
+	key := normalizeDomain(s)
+	if h, ok := parseNextHop(key); ok {
+		return h.key(), true
+	}
+	if !valid.IsDNSName(key) || strings.HasPrefix(key, ".") {
+		return "", false
+	}
+	return key, true
+}
+
+// policyKeyHost is the domain or host name of a cache key, for matching it
+// against configured domain suffixes.
+func policyKeyHost(key string) string {
+	if h, ok := parseNextHop(key); ok {
+		return h.host
+	}
+	return key
+}
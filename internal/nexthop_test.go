@@ -0,0 +1,77 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"testing"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+)
+
+func TestNormalizePolicyKey(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"Example.COM.", "example.com", true},
+		{"example.com:25", "example.com", true},
+		{"example.com:2525", "example.com:2525", true},
+		{"[Smtp.Partner.NET.]:587", "[smtp.partner.net]:587", true},
+		{"[mx.example.com]:25", "[mx.example.com]", true},
+		{"[mx.example.com]", "[mx.example.com]", true},
+		{"[192.0.2.1]", "", false},
+		{"[192.0.2.1]:587", "", false},
+		{"[ipv6:2001:db8::1]", "", false},
+		{"[mx.example.com]:0", "", false},
+		{"[mx.example.com]:65536", "", false},
+		{"[mx.example.com]587", "", false},
+		{"[mx.example.com", "", false},
+		{"mx.example.com:smtp", "", false},
+		{"[.example.com]", "", false},
+		{"[]", "", false},
+	} {
+		got, ok := normalizePolicyKey(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizePolicyKey(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNextHopKeysAreCachedSeparately(t *testing.T) {
+	useTestPolicyCache(t)
+	storeDomainResult("partner.example", nil, domainResult{
+		Dane:            branchFromResult("", "", 3600),
+		MtaSts:          branchFromResult("secure match=mx.partner.example", "policy_type=sts", 86400),
+		DaneAttempted:   true,
+		MtaStsAttempted: true,
+	}, 1)
+	storeDomainResult("[smtp.partner.example]:587", nil, domainResult{
+		Dane:            branchFromResult("dane-only", "", 3600),
+		DaneAttempted:   true,
+		MtaStsAttempted: true,
+	}, 1)
+
+	for _, tt := range []struct{ query, want string }{
+		{"QUERY partner.example", string(netstring.Marshal("OK secure match=mx.partner.example"))},
+		{"QUERY partner.example:25", string(netstring.Marshal("OK secure match=mx.partner.example"))},
+		{"QUERY [SMTP.partner.example.]:587", string(netstring.Marshal("OK dane-only"))},
+		{"QUERY [192.0.2.1]:587", string(NS_NOTFOUND)},
+	} {
+		if got := runControlCommand(t, tt.query); got != tt.want {
+			t.Fatalf("%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestNextHopKeysMatchDomainSuffixes(t *testing.T) {
+	m := map[string]string{"partner.example": "encrypt"}
+	if v, ok := longestDomainSuffix(m, "[smtp.partner.example]:587"); !ok || v != "encrypt" {
+		t.Fatalf("longestDomainSuffix = %q, %v, want encrypt", v, ok)
+	}
+	if _, ok := longestDomainSuffix(m, "[smtp.other.example]"); ok {
+		t.Fatal("unrelated next-hop matched partner.example")
+	}
+}
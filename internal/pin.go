@@ -0,0 +1,127 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"log/slog"
+	"time"
+)
+
+const PIN_MIN_HOLD_TTL uint32 = 60
+
+// PolicyPin is a downgrade held back by pinning. The branches of the stricter
+// policy keep being served while lookups keep returning the weaker Seen
+// policy, until the downgrade is confirmed.
+type PolicyPin struct {
+	Since   time.Time // first lookup that returned the weaker policy
+	Dane    PolicyBranch
+	MtaSts  PolicyBranch
+	Policy  string // pinned policy
+	Seen    string // weaker policy returned by the lookups
+	Lookups uint32
+}
+
+// pinHoldTTL spreads the confirming lookups over the confirmation period.
+func pinHoldTTL() uint32 {
+	return max(config.Pinning.ConfirmPeriod/max(config.Pinning.ConfirmLookups, 1), PIN_MIN_HOLD_TTL)
+}
+
+func pinnedBranch(branch PolicyBranch, now time.Time) PolicyBranch {
+	if branch.Policy == "" {
+		return PolicyBranch{}
+	}
+	branch.TTL = pinHoldTTL()
+	return expireBranch(branch, now)
+}
+
+// holdPolicyDowngrade compares the refreshed entry merged with the previous
+// entry c. With pinning enabled a downgrade is held back: merged keeps the
+// stricter branches, with a short TTL so that the next lookup comes soon,
+// until the weaker policy has been seen often and long enough.
+func holdPolicyDowngrade(domain string, c *CacheStruct, merged *CacheStruct, now time.Time) *CacheStruct {
+	if !config.Pinning.Enabled {
+		merged.Pin = nil
+		return merged
+	}
+	seen, _, _, ok := selectCachedPolicy(merged, now)
+	if !ok {
+		return merged
+	}
+	pin := merged.Pin
+	pinned := cachedPolicyForPrefetchTransition(c, now)
+	if pin != nil {
+		pinned = pin.Policy
+	}
+	pinnedName, seenName, downgraded := isPrefetchedPolicyDowngrade(pinned, seen)
+	if !downgraded {
+		if pin != nil {
+			observeDowngradePin("released")
+			slog.Info("Released policy pin, downgrade was not confirmed", "domain", domain, "pinned_policy", pinnedName, "current_policy", seenName, "lookups", pin.Lookups)
+		}
+		merged.Pin = nil
+		return merged
+	}
+	if pin == nil || pin.Seen != firstWord(seen) {
+		pin = &PolicyPin{Since: now, Policy: pinned}
+		if c != nil {
+			pin.Dane, pin.MtaSts = c.Dane, c.MtaSts
+		}
+	} else {
+		pin = &PolicyPin{Since: pin.Since, Dane: pin.Dane, MtaSts: pin.MtaSts, Policy: pin.Policy, Lookups: pin.Lookups}
+	}
+	pin.Seen = firstWord(seen)
+	pin.Lookups++
+	confirmAfter := pin.Since.Add(time.Duration(config.Pinning.ConfirmPeriod) * time.Second)
+	if pin.Lookups >= config.Pinning.ConfirmLookups && !now.Before(confirmAfter) {
+		observeDowngradePin("confirmed")
+		slog.Warn("Confirmed policy downgrade", "domain", domain, "previous_policy", pinnedName, "current_policy", seenName, "lookups", pin.Lookups, "since", pin.Since)
+		merged.Pin = nil
+		return merged
+	}
+
+	held, ok := heldPolicyEntry(merged, pin, now)
+	if !ok {
+		// The pinned branches cannot be served, e.g. a legacy entry.
+		merged.Pin = nil
+		return merged
+	}
+	observeDowngradePin("held")
+	slog.Warn("Held back policy downgrade", "domain", domain, "pinned_policy", pinnedName, "current_policy", seenName, "lookups", pin.Lookups, "confirm_lookups", config.Pinning.ConfirmLookups, "confirm_after", confirmAfter)
+	return held
+}
+
+// heldPolicyEntry serves the branches of pin instead of those of c, with the
+// short hold TTL.
+func heldPolicyEntry(c *CacheStruct, pin *PolicyPin, now time.Time) (*CacheStruct, bool) {
+	held := cloneCacheStruct(c)
+	if branch := pinnedBranch(pin.Dane, now); branch.HasData() {
+		held.Dane = branch
+	}
+	if branch := pinnedBranch(pin.MtaSts, now); branch.HasData() {
+		held.MtaSts = branch
+		if !held.Dane.HasData() || held.Dane.RemainingTTL(now) == 0 {
+			held.Dane = expireBranch(PolicyBranch{TTL: pinHoldTTL()}, now)
+		}
+	}
+	policy, report, ttl, ok := selectCachedPolicy(held, now)
+	if _, _, stillDowngraded := isPrefetchedPolicyDowngrade(pin.Policy, policy); !ok || stillDowngraded {
+		return nil, false
+	}
+	held.Policy, held.Report, held.TTL = policy, report, ttl
+	held.Expirable.ExpiresAt = now.Add(time.Duration(ttl) * time.Second)
+	held.Pin = pin
+	return held, true
+}
+
+// holdPinnedPolicy keeps serving the pinned policy of c when its lookups keep
+// failing, instead of discarding it. A failed lookup did not return the
+// weaker policy, so it does not count towards confirming the downgrade.
+func holdPinnedPolicy(c *CacheStruct, now time.Time) (*CacheStruct, bool) {
+	if !config.Pinning.Enabled || c == nil || c.Pin == nil {
+		return nil, false
+	}
+	return heldPolicyEntry(c, c.Pin, now)
+}
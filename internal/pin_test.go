@@ -0,0 +1,164 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+)
+
+func pinTestEntry(now time.Time) *CacheStruct {
+	return &CacheStruct{
+		Expirable: &cache.Expirable{ExpiresAt: now.Add(20 * time.Second)},
+		Policy:    "dane-only",
+		TTL:       3600,
+		Dane:      PolicyBranch{Policy: "dane-only", TTL: 3600, ExpiresAt: now.Add(20 * time.Second)},
+		MtaSts:    PolicyBranch{TTL: 86400, ExpiresAt: now.Add(24 * time.Hour)},
+	}
+}
+
+func TestPinningHoldsDowngradeUntilConfirmed(t *testing.T) {
+	patchConfigForTest(t, func(c *Config) {
+		c.Pinning = PinningConfig{Enabled: true, ConfirmLookups: 3, ConfirmPeriod: 3600}
+	})
+	held := metricPinHeld.Load()
+	confirmed := metricPinConfirmed.Load()
+	now := time.Now()
+	c := pinTestEntry(now)
+
+	for i, at := range []time.Time{now, now.Add(20 * time.Minute), now.Add(40 * time.Minute)} {
+		c = holdPolicyDowngrade("pinned.example", c, mergeCacheResult(c, testDomainResult("", "", ""), at), at)
+		policy, _, ttl, ok := selectCachedPolicy(c, at)
+		if !ok || policy != "dane-only" {
+			t.Fatalf("lookup %d: served %q (%v), want pinned dane-only", i+1, policy, ok)
+		}
+		if ttl > 1200+20 {
+			t.Fatalf("lookup %d: pinned policy ttl %d exceeds the hold interval", i+1, ttl)
+		}
+		if c.Pin == nil || c.Pin.Lookups != uint32(i+1) || c.Pin.Seen != "" || !c.Pin.Since.Equal(now) {
+			t.Fatalf("lookup %d: unexpected pin %+v", i+1, c.Pin)
+		}
+	}
+	if got := metricPinHeld.Load() - held; got != 3 {
+		t.Fatalf("held downgrades = %d, want 3", got)
+	}
+
+	at := now.Add(time.Hour)
+	c = holdPolicyDowngrade("pinned.example", c, mergeCacheResult(c, testDomainResult("", "", ""), at), at)
+	if policy, _, _, ok := selectCachedPolicy(c, at); !ok || policy != "" || c.Pin != nil {
+		t.Fatalf("expected confirmed downgrade to be served, got %q (%v), pin %+v", policy, ok, c.Pin)
+	}
+	if metricPinConfirmed.Load()-confirmed != 1 {
+		t.Fatal("expected the confirmed downgrade to be counted")
+	}
+}
+
+func TestPinningReleasesPinWhenPolicyRecovers(t *testing.T) {
+	patchConfigForTest(t, func(c *Config) {
+		c.Pinning = PinningConfig{Enabled: true, ConfirmLookups: 2, ConfirmPeriod: 600}
+	})
+	released := metricPinReleased.Load()
+	now := time.Now()
+	c := holdPolicyDowngrade("flaky.example", pinTestEntry(now), mergeCacheResult(pinTestEntry(now), testDomainResult("", "", ""), now), now)
+	if c.Pin == nil {
+		t.Fatal("expected downgrade to be pinned")
+	}
+	recovered := domainResult{Dane: branchFromResult("dane-only", "", 3600), DaneAttempted: true}
+	c = holdPolicyDowngrade("flaky.example", c, mergeCacheResult(c, recovered, now.Add(time.Minute)), now.Add(time.Minute))
+	if c.Pin != nil || metricPinReleased.Load()-released != 1 {
+		t.Fatalf("expected pin to be released, got %+v", c.Pin)
+	}
+
+	config.Pinning.Enabled = false
+	c = holdPolicyDowngrade("flaky.example", c, mergeCacheResult(c, testDomainResult("", "", ""), now), now)
+	if policy, _, _, _ := selectCachedPolicy(c, now); policy != "" || c.Pin != nil {
+		t.Fatalf("expected downgrade without pinning, got %q", policy)
+	}
+}
+
+func TestPinnedPolicyIsServedToPostfix(t *testing.T) {
+	useTestPolicyCache(t)
+	patchConfigForTest(t, func(c *Config) {
+		c.Pinning = PinningConfig{Enabled: true, ConfirmLookups: 3, ConfirmPeriod: 3600}
+	})
+	oldCheckDane, oldCheckMtaSts := checkDanePolicy, checkMtaStsPolicy
+	t.Cleanup(func() { checkDanePolicy, checkMtaStsPolicy = oldCheckDane, oldCheckMtaSts })
+	checkDanePolicy = func(context.Context, string, bool) (string, uint32) { return "", 3600 }
+	checkMtaStsPolicy = func(context.Context, string, bool) (string, string, uint32) { return "", "", 3600 }
+
+	now := time.Now()
+	c := pinTestEntry(now)
+	c.Dane.ExpiresAt = now.Add(-time.Second)
+	c.Expirable.ExpiresAt = now.Add(-time.Second)
+	polCache.Set("pinned.example", c)
+
+	if got := runControlCommand(t, "QUERY pinned.example"); got != string(netstring.Marshal("OK dane-only")) {
+		t.Fatalf("reply = %q, want the pinned policy", got)
+	}
+}
+
+func TestPinnedPolicyIsKeptWhenPrefetchKeepsFailing(t *testing.T) {
+	useTestPolicyCache(t)
+	patchConfigForTest(t, func(c *Config) {
+		c.Pinning = PinningConfig{Enabled: true, ConfirmLookups: 3, ConfirmPeriod: 3600}
+	})
+	now := time.Now()
+	key := "pinned.example"
+	c := holdPolicyDowngrade(key, pinTestEntry(now), mergeCacheResult(pinTestEntry(now), testDomainResult("", "", ""), now), now)
+	if c.Pin == nil {
+		t.Fatal("expected downgrade to be pinned")
+	}
+	polCache.Set(key, c)
+
+	scheduler := newPrefetchScheduler()
+	for i := range 3 {
+		at := now.Add(time.Duration(i) * time.Hour)
+		scheduler.failures[key] = prefetchFailure{firstFailed: at.Add(-PREFETCH_RETRY_MAX_AGE), attempts: 8}
+		cached, _ := polCache.Get(key)
+		scheduleFailedPolicyPrefetch(scheduler, key, cached, domainResult{}, at)
+
+		stored, found := polCache.Get(key)
+		if !found || stored.Pin == nil || stored.Pin.Lookups != 1 {
+			t.Fatalf("failure %d: expected pinned entry to be kept unconfirmed, got %+v", i+1, stored)
+		}
+		if policy, _, _, ok := selectCachedPolicy(stored, at); !ok || policy != "dane-only" {
+			t.Fatalf("failure %d: served %q (%v), want pinned dane-only", i+1, policy, ok)
+		}
+		if _, ok := scheduler.nextDue(); !ok {
+			t.Fatalf("failure %d: expected pinned entry to be prefetched again", i+1)
+		}
+	}
+}
+
+func TestPinnedPolicyIsHeldWhenFailedBranchIsDiscarded(t *testing.T) {
+	useTestPolicyCache(t)
+	patchConfigForTest(t, func(c *Config) {
+		c.Pinning = PinningConfig{Enabled: true, ConfirmLookups: 3, ConfirmPeriod: 3600}
+	})
+	now := time.Now()
+	key := "pinned-sts.example"
+	dane := PolicyBranch{Policy: "dane-only", TTL: 300, ExpiresAt: now.Add(-25 * time.Hour)}
+	polCache.Set(key, &CacheStruct{
+		Expirable: &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+		Dane:      dane,
+		MtaSts:    PolicyBranch{Policy: "secure match=mx.example", Report: "policy_type=sts", TTL: 86400, ExpiresAt: now.Add(time.Hour)},
+		Pin:       &PolicyPin{Since: now, Dane: dane, Policy: "dane-only", Seen: "secure", Lookups: 1},
+	})
+
+	scheduler := newPrefetchScheduler()
+	scheduler.failures[key] = prefetchFailure{firstFailed: now.Add(-PREFETCH_RETRY_MAX_AGE), attempts: 8}
+	cached, _ := polCache.Get(key)
+	scheduleFailedPolicyPrefetch(scheduler, key, cached, domainResult{DaneAttempted: true}, now)
+
+	stored, _ := polCache.Get(key)
+	if policy, _, _, ok := selectCachedPolicy(stored, now); !ok || policy != "dane-only" || stored.Pin == nil {
+		t.Fatalf("served %q (%v) with pin %+v, want the pinned dane-only", policy, ok, stored.Pin)
+	}
+}
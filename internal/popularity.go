@@ -0,0 +1,194 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"cmp"
+	"hash/maphash"
+	"math/bits"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+)
+
+const (
+	POPULARITY_SKETCH_DEPTH     = 4
+	POPULARITY_MAX_COUNT        = 15 // 4-bit counters as in TinyLFU
+	POPULARITY_SAMPLE_FACTOR    = 10 // halve all counters after this many additions per cache slot
+	POPULARITY_ADMISSION_SAMPLE = 8  // cached entries compared with a new domain in a full cache
+	popularityBuckets           = 2 * (POPULARITY_MAX_COUNT + 1)
+)
+
+// popularitySketch is a count-min sketch of recent domain popularity. All
+// counters are halved once the number of additions reaches sampleSize, so
+// popularity decays and last year's traffic no longer outranks today's.
+type popularitySketch struct {
+	mu         sync.Mutex
+	seed       maphash.Seed
+	rows       [POPULARITY_SKETCH_DEPTH][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+var cachePopularity = newPopularitySketch(CACHE_MAX_ENTRIES)
+
+func newPopularitySketch(capacity int) *popularitySketch {
+	width := 1 << bits.Len(uint(max(capacity, 16)-1))
+	s := &popularitySketch{
+		seed:       maphash.MakeSeed(),
+		mask:       uint64(width - 1),
+		sampleSize: capacity * POPULARITY_SAMPLE_FACTOR,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *popularitySketch) indexes(key string) [POPULARITY_SKETCH_DEPTH]uint64 {
+	h := maphash.String(s.seed, key)
+	step := h>>32 | h<<32 | 1
+	var idx [POPULARITY_SKETCH_DEPTH]uint64
+	for i := range idx {
+		idx[i] = (h + uint64(i)*step) & s.mask
+	}
+	return idx
+}
+
+// add counts n accesses of key using conservative update, which only raises
+// the smallest counters and keeps hash collisions from inflating estimates.
+func (s *popularitySketch) add(key string, n uint32) {
+	if n == 0 {
+		return
+	}
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := uint8(POPULARITY_MAX_COUNT)
+	for i, j := range idx {
+		current = min(current, s.rows[i][j])
+	}
+	target := uint8(min(uint32(current)+n, POPULARITY_MAX_COUNT))
+	for i, j := range idx {
+		if s.rows[i][j] < target {
+			s.rows[i][j] = target
+		}
+	}
+	s.additions += int(n)
+	if s.additions >= s.sampleSize {
+		s.age()
+	}
+}
+
+func (s *popularitySketch) age() {
+	for _, row := range s.rows {
+		for j := range row {
+			row[j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+func (s *popularitySketch) estimate(key string) uint8 {
+	idx := s.indexes(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	estimate := uint8(POPULARITY_MAX_COUNT)
+	for i, j := range idx {
+		estimate = min(estimate, s.rows[i][j])
+	}
+	return estimate
+}
+
+// seedCachePopularity gives entries loaded from disk a starting popularity
+// that grows logarithmically with their lifetime counter and decays like any
+// other access.
+func seedCachePopularity(entries []cache.Entry[*CacheStruct]) {
+	for _, entry := range entries {
+		cachePopularity.add(entry.Key, uint32(bits.Len32(cacheEntryCounter(entry.Key, entry.Value))))
+	}
+}
+
+// cacheEntryPopularity ranks an entry for eviction: entries without a policy
+// rank below all entries with one, then by their estimated popularity.
+func cacheEntryPopularity(key string, c *CacheStruct) uint8 {
+	b := cachePopularity.estimate(key)
+	if cacheStructHasPolicy(c) {
+		b += POPULARITY_MAX_COUNT + 1
+	}
+	return b
+}
+
+// admitCacheEntry reports whether a domain that is not cached yet may be added
+// to the cache. Once the cache is full, the domain must rank above the least
+// popular of a few sampled entries, the victim it would displace, as in
+// TinyLFU. A domain queried once does not push out one that is queried
+// regularly; it is admitted once it was queried often enough.
+func admitCacheEntry(domain string, cs *CacheStruct) bool {
+	if polCache.Len() < CACHE_MAX_ENTRIES {
+		return true
+	}
+	sample := polCache.Sample(POPULARITY_ADMISSION_SAMPLE)
+	if len(sample) == 0 {
+		return true
+	}
+	victim := uint8(popularityBuckets)
+	for _, entry := range sample {
+		victim = min(victim, cacheEntryPopularity(entry.Key, entry.Value))
+	}
+	return cacheEntryPopularity(domain, cs) > victim
+}
+
+// partitionCacheEntriesForLimit selects the entries to evict when there are
+// more than maxEntries, keeping targetEntries. Entries without a policy go
+// first, then the least popular ones; only the entries sharing the boundary
+// popularity are sorted, by remaining TTL.
+func partitionCacheEntriesForLimit(entries []cache.Entry[*CacheStruct], now time.Time, maxEntries int, targetEntries int) ([]cache.Entry[*CacheStruct], []cache.Entry[*CacheStruct]) {
+	if len(entries) <= maxEntries {
+		return entries, nil
+	}
+	buckets := make([]uint8, len(entries))
+	var counts [popularityBuckets]int
+	for i, entry := range entries {
+		buckets[i] = cacheEntryPopularity(entry.Key, entry.Value)
+		counts[buckets[i]]++
+	}
+	evictCount := len(entries) - targetEntries
+	boundary, below := 0, 0
+	for ; boundary < popularityBuckets; boundary++ {
+		if below+counts[boundary] >= evictCount {
+			break
+		}
+		below += counts[boundary]
+	}
+	kept := make([]cache.Entry[*CacheStruct], 0, targetEntries)
+	evicted := make([]cache.Entry[*CacheStruct], 0, evictCount)
+	var tied []cache.Entry[*CacheStruct]
+	for i, entry := range entries {
+		switch b := int(buckets[i]); {
+		case b < boundary:
+			evicted = append(evicted, entry)
+		case b == boundary:
+			tied = append(tied, entry)
+		default:
+			kept = append(kept, entry)
+		}
+	}
+	slices.SortFunc(tied, func(a, b cache.Entry[*CacheStruct]) int {
+		if c := cmp.Compare(a.Value.RemainingTTL(now), b.Value.RemainingTTL(now)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+	need := evictCount - below
+	evicted = append(evicted, tied[:need]...)
+	kept = append(kept, tied[need:]...)
+	return kept, evicted
+}
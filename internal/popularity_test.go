@@ -0,0 +1,105 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+)
+
+func TestPopularitySketchCountsAndDecays(t *testing.T) {
+	s := newPopularitySketch(64)
+	s.add("busy.example", 10)
+	s.add("quiet.example", 1)
+	if got := s.estimate("busy.example"); got != 10 {
+		t.Fatalf("busy estimate = %d, want 10", got)
+	}
+	if got := s.estimate("unseen.example"); got != 0 {
+		t.Fatalf("unseen estimate = %d, want 0", got)
+	}
+	s.add("busy.example", 100)
+	if got := s.estimate("busy.example"); got != POPULARITY_MAX_COUNT {
+		t.Fatalf("saturated estimate = %d, want %d", got, POPULARITY_MAX_COUNT)
+	}
+
+	// Enough traffic to other domains halves the old counters.
+	for i := 0; s.estimate("busy.example") == POPULARITY_MAX_COUNT; i++ {
+		if i > s.sampleSize {
+			t.Fatal("sketch never aged")
+		}
+		s.add("other-"+strconv.Itoa(i)+".example", 1)
+	}
+	if got := s.estimate("busy.example"); got != POPULARITY_MAX_COUNT/2 {
+		t.Fatalf("aged estimate = %d, want %d", got, POPULARITY_MAX_COUNT/2)
+	}
+}
+
+func TestPartitionCacheEntriesPrefersRecentPopularity(t *testing.T) {
+	clearCacheHitCountersForTest()
+	t.Cleanup(clearCacheHitCountersForTest)
+	now := time.Now()
+	entry := func(key string, counter uint32, ttl time.Duration) cache.Entry[*CacheStruct] {
+		return cache.Entry[*CacheStruct]{
+			Key: key,
+			Value: &CacheStruct{
+				Expirable: &cache.Expirable{ExpiresAt: now.Add(ttl)},
+				Policy:    "dane",
+				Counter:   counter,
+			},
+		}
+	}
+	entries := []cache.Entry[*CacheStruct]{
+		entry("busy-last-year.example", 100000, time.Hour),
+		entry("busy-today.example", 3, time.Minute),
+		entry("short-ttl.example", 0, time.Minute),
+		entry("long-ttl.example", 0, 2*time.Hour),
+	}
+	for range 5 {
+		cachePopularity.add("busy-today.example", 1)
+	}
+	cachePopularity.add("short-ttl.example", 1)
+	cachePopularity.add("long-ttl.example", 1)
+
+	kept, evicted := partitionCacheEntriesForLimit(entries, now, 3, 2)
+	if len(kept) != 2 || len(evicted) != 2 {
+		t.Fatalf("unexpected partition sizes: kept=%d evicted=%d", len(kept), len(evicted))
+	}
+	if evicted[0].Key != "busy-last-year.example" || evicted[1].Key != "short-ttl.example" {
+		t.Fatalf("unexpected evictions: %s, %s", evicted[0].Key, evicted[1].Key)
+	}
+}
+
+func TestAdmitCacheEntryRequiresMorePopularDomain(t *testing.T) {
+	useTestPolicyCache(t)
+	// A wider sketch keeps hash collisions from inflating the estimates
+	cachePopularity = newPopularitySketch(16 * CACHE_MAX_ENTRIES)
+	now := time.Now()
+	for i := range CACHE_MAX_ENTRIES {
+		key := "cached-" + strconv.Itoa(i) + ".example"
+		polCache.Set(key, exportTestEntry(now, "dane", 3600, 0))
+		cachePopularity.add(key, 2)
+	}
+	metricEvictAdmission.Store(0)
+	result := testDomainResult("dane-only", "", "policy_type=sts")
+
+	for range 2 {
+		if _, stored := storeDomainResult("new.example", nil, result, 1); stored {
+			t.Fatal("domain less popular than the cached entries was admitted")
+		}
+	}
+	if _, ok := polCache.Get("new.example"); ok || metricEvictAdmission.Load() != 2 {
+		t.Fatalf("expected two refused admissions, cached=%v refused=%d", ok, metricEvictAdmission.Load())
+	}
+	if _, stored := storeDomainResult("new.example", nil, result, 1); !stored {
+		t.Fatal("domain queried more often than the cached entries was not admitted")
+	}
+	if _, stored := storeDomainResult("warmed.example", nil, result, 0); !stored {
+		t.Fatal("lookup without a query was refused admission")
+	}
+}
@@ -6,11 +6,14 @@
 package tlspol
 
 import (
+	"cmp"
 	"container/heap"
 	"context"
 	"log/slog"
 	"math/rand/v2"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,6 +27,8 @@ const (
 	PREFETCH_RETRY_MAX_INTERVAL        = 5 * time.Minute
 	PREFETCH_SLOT_INTERVAL             = 10 * time.Second
 	PREFETCH_BATCH_JITTER_MAX          = 250 * time.Millisecond
+	PREFETCH_OVERDUE_AFTER             = PREFETCH_SLOT_INTERVAL // due items older than this count as overdue
+	PREFETCH_QUERIES_PER_DOMAIN        = 4                      // rough DNS queries of one refresh, to size batches to the budget
 )
 
 var semaphore chan struct{}
@@ -91,13 +96,15 @@ func logPrefetchedPolicyDowngrade(domain string, previous *CacheStruct, current
 }
 
 type prefetchItem struct {
-	due   time.Time
-	key   string
-	index int
+	due      time.Time
+	key      string
+	index    int
+	priority uint8 // popularity when scheduled, orders items due at the same batch
 }
 
 type prefetchFailure struct {
 	firstFailed time.Time
+	deadline    time.Time // retries stop and the branch is discarded after this
 	attempts    uint32
 }
 
@@ -108,7 +115,10 @@ func (q prefetchQueue) Len() int {
 }
 
 func (q prefetchQueue) Less(i int, j int) bool {
-	return q[i].due.Before(q[j].due)
+	if c := q[i].due.Compare(q[j].due); c != 0 {
+		return c < 0
+	}
+	return q[i].priority > q[j].priority
 }
 
 func (q prefetchQueue) Swap(i int, j int) {
@@ -134,13 +144,17 @@ func (q *prefetchQueue) Pop() any {
 }
 
 type prefetchScheduler struct {
-	batchOrigin time.Time
-	items       map[string]*prefetchItem
-	failures    map[string]prefetchFailure
-	wake        chan struct{}
-	queue       prefetchQueue
-	jitterSeed  uint64
-	mu          sync.Mutex
+	startedAt     time.Time
+	batchOrigin   time.Time
+	lastBatch     time.Time
+	items         map[string]*prefetchItem
+	failures      map[string]prefetchFailure
+	wake          chan struct{}
+	queue         prefetchQueue
+	jitterSeed    uint64
+	lastBatchTime time.Duration
+	lastBatchSize int
+	mu            sync.Mutex
 }
 
 func newPrefetchScheduler() *prefetchScheduler {
@@ -149,6 +163,7 @@ func newPrefetchScheduler() *prefetchScheduler {
 
 func newPrefetchSchedulerAt(startedAt time.Time, jitterSeed uint64) *prefetchScheduler {
 	s := &prefetchScheduler{
+		startedAt:   startedAt,
 		batchOrigin: startedAt.Add(PREFETCH_SLOT_INTERVAL),
 		items:       make(map[string]*prefetchItem),
 		failures:    make(map[string]prefetchFailure),
@@ -214,11 +229,13 @@ func (s *prefetchScheduler) schedule(key string, due time.Time) {
 }
 
 func (s *prefetchScheduler) scheduleLocked(key string, due time.Time) {
+	priority := cachePopularity.estimate(key)
 	if item, ok := s.items[key]; ok {
 		item.due = due
+		item.priority = priority
 		heap.Fix(&s.queue, item.index)
 	} else {
-		item = &prefetchItem{key: key, due: due}
+		item = &prefetchItem{key: key, due: due, priority: priority}
 		s.items[key] = item
 		heap.Push(&s.queue, item)
 	}
@@ -276,6 +293,7 @@ func (s *prefetchScheduler) scheduleRetryUntil(key string, now time.Time, graceD
 	}
 
 	failure.attempts++
+	failure.deadline = retryDeadline
 	delay := prefetchRetryDelay(failure.attempts)
 	if due := now.Add(delay); due.After(retryDeadline) {
 		delay = retryDeadline.Sub(now)
@@ -301,6 +319,79 @@ func prefetchRetryDelay(attempts uint32) time.Duration {
 	return delay
 }
 
+// status reports when key is due for prefetching and how many retries have
+// failed since the last successful prefetch.
+func (s *prefetchScheduler) status(key string) (time.Time, uint32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts := s.failures[key].attempts
+	item, ok := s.items[key]
+	if !ok {
+		return time.Time{}, attempts, false
+	}
+	return item.due, attempts, true
+}
+
+// snapshot returns the limit earliest scheduled prefetches, the queue length
+// and the number of overdue items.
+func (s *prefetchScheduler) snapshot(now time.Time, limit int) ([]PrefetchStatusEntry, int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := slices.Clone(s.queue)
+	overdue := s.countDueBeforeLocked(0, now.Add(-PREFETCH_OVERDUE_AFTER))
+	slices.SortFunc(items, func(a, b *prefetchItem) int {
+		if c := a.due.Compare(b.due); c != 0 {
+			return c
+		}
+		return strings.Compare(a.key, b.key)
+	})
+	entries := make([]PrefetchStatusEntry, 0, min(limit, len(items)))
+	for _, item := range items[:min(limit, len(items))] {
+		failure := s.failures[item.key]
+		entries = append(entries, PrefetchStatusEntry{
+			Due:           item.due,
+			GraceDeadline: failure.deadline,
+			Domain:        item.key,
+			Retries:       failure.attempts,
+			Overdue:       item.due.Before(now.Add(-PREFETCH_OVERDUE_AFTER)),
+		})
+	}
+	return entries, len(s.queue), overdue
+}
+
+// countDueBeforeLocked counts the items of the heap below index i that are
+// due before t. Children are never due earlier than their parent, so only
+// overdue subtrees are visited.
+func (s *prefetchScheduler) countDueBeforeLocked(i int, t time.Time) int {
+	if i >= len(s.queue) || !s.queue[i].due.Before(t) {
+		return 0
+	}
+	return 1 + s.countDueBeforeLocked(2*i+1, t) + s.countDueBeforeLocked(2*i+2, t)
+}
+
+// queueStats returns the queue length and the number of overdue items.
+func (s *prefetchScheduler) queueStats(now time.Time) (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue), s.countDueBeforeLocked(0, now.Add(-PREFETCH_OVERDUE_AFTER))
+}
+
+func (s *prefetchScheduler) recordBatch(started time.Time, size int) {
+	elapsed := time.Since(started)
+	s.mu.Lock()
+	s.lastBatch = started
+	s.lastBatchTime = elapsed
+	s.lastBatchSize = size
+	s.mu.Unlock()
+	observePrefetchBatch(elapsed)
+}
+
+func (s *prefetchScheduler) lastBatchStats() (time.Time, time.Duration, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastBatch, s.lastBatchTime, s.lastBatchSize
+}
+
 func (s *prefetchScheduler) nextDue() (time.Time, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -322,6 +413,29 @@ func (s *prefetchScheduler) popDue(now time.Time) []string {
 	return keys
 }
 
+// deferExcess keeps the capacity most popular of keys for this batch and
+// moves the rest to the next one. A capacity of 0 keeps all keys.
+func (s *prefetchScheduler) deferExcess(keys []string, capacity int, now time.Time) []string {
+	if capacity == 0 || len(keys) <= capacity {
+		return keys
+	}
+	popularity := make(map[string]uint8, len(keys))
+	for _, key := range keys {
+		popularity[key] = cachePopularity.estimate(key)
+	}
+	slices.SortStableFunc(keys, func(a, b string) int {
+		return cmp.Compare(popularity[b], popularity[a])
+	})
+	next := s.batchAtOrAfter(now.Add(PREFETCH_SLOT_INTERVAL))
+	s.mu.Lock()
+	for _, key := range keys[capacity:] {
+		s.scheduleLocked(key, next)
+		observePrefetch("deferred")
+	}
+	s.mu.Unlock()
+	return keys[:capacity]
+}
+
 func (s *prefetchScheduler) notify() {
 	select {
 	case s.wake <- struct{}{}:
@@ -375,11 +489,48 @@ func startPrefetching(ctx context.Context) {
 	}
 }
 
+// idle reports whether domain was not queried within prefetch.idle-window.
+// Entries cached before queries were tracked count from startup.
+func (s *prefetchScheduler) idle(domain string, c *CacheStruct, now time.Time) bool {
+	window := config.Prefetch.IdleWindow
+	if window == 0 || c == nil {
+		return false
+	}
+	last := cacheEntryLastQueried(domain, c)
+	if last.IsZero() {
+		last = s.startedAt
+	}
+	return now.Sub(last) > time.Duration(window)*time.Second
+}
+
+func prefetchIdle(domain string, c *CacheStruct, now time.Time) bool {
+	scheduler := activePrefetchScheduler.Load()
+	return scheduler != nil && scheduler.idle(domain, c, now)
+}
+
+// prefetchBatchCapacity is how many domains the DNS budget allows per slot,
+// or 0 without a budget.
+func prefetchBatchCapacity() int {
+	budget := prefetchBudget.Load()
+	if budget == nil || budget.dns == nil {
+		return 0
+	}
+	return max(1, int(budget.dns.rate*PREFETCH_SLOT_INTERVAL.Seconds())/PREFETCH_QUERIES_PER_DOMAIN)
+}
+
 func scheduleCachedPolicyPrefetch(key string, c *CacheStruct, now time.Time) {
 	scheduler := activePrefetchScheduler.Load()
 	if scheduler == nil {
 		return
 	}
+	if scheduler.idle(key, c, now) {
+		scheduler.remove(key)
+		return
+	}
+	if c != nil && daneNeedsRevalidation(c.Dane, currentResolverIdentity()) && c.Age(now) < CACHE_MAX_AGE {
+		scheduler.schedule(key, scheduler.batchAtOrAfter(now))
+		return
+	}
 	due, ok := scheduler.nextPrefetchTime(c, now)
 	if !ok {
 		if shouldRetryCachedPolicyPrefetch(c, now) {
@@ -406,6 +557,14 @@ func clearPrefetchSchedule() {
 	}
 }
 
+func cachedPolicyPrefetchStatus(key string) (time.Time, uint32, bool) {
+	scheduler := activePrefetchScheduler.Load()
+	if scheduler == nil {
+		return time.Time{}, 0, false
+	}
+	return scheduler.status(key)
+}
+
 func resetCachedPolicyPrefetchFailures(key string) {
 	scheduler := activePrefetchScheduler.Load()
 	if scheduler != nil {
@@ -504,7 +663,10 @@ func scheduleFailedPolicyPrefetch(scheduler *prefetchScheduler, key string, c *C
 	}
 	if updated, ok := cacheAfterFailedBranchDiscard(c, result, now); ok {
 		observePrefetch("discard")
+		updated = holdPolicyDowngrade(key, c, updated, now)
 		logPrefetchedPolicyDowngrade(key, c, updated, now)
+		recordPolicyHistory(key, c, updated, "prefetch-failure", now)
+		notifyPolicyChange(key, c, updated, "prefetch", now)
 		polCache.Set(key, updated)
 		if due, ok := scheduler.nextPrefetchTime(updated, now); ok {
 			scheduler.schedule(key, due)
@@ -515,7 +677,19 @@ func scheduleFailedPolicyPrefetch(scheduler *prefetchScheduler, key string, c *C
 		slog.Debug("Cleared failed cached policy branch after repeated prefetch failures", "domain", key, "retry_window", PREFETCH_RETRY_MAX_AGE)
 		return
 	}
+	if held, ok := holdPinnedPolicy(c, now); ok {
+		polCache.Set(key, held)
+		if due, ok := scheduler.nextPrefetchTime(held, now); ok {
+			scheduler.schedule(key, due)
+		}
+		if err := polCache.Save(false); err != nil {
+			slog.Error("Could not save cache after failed prefetch of pinned policy", "domain", key, "error", err)
+		}
+		slog.Warn("Kept pinned policy after repeated prefetch failures", "domain", key, "pinned_policy", firstWord(held.Pin.Policy), "since", held.Pin.Since)
+		return
+	}
 	logPrefetchedPolicyDowngrade(key, c, nil, now)
+	notifyPolicyDiscard(key, c, "prefetch", now)
 	discardCachedPolicyState(false, key, c)
 	observePrefetch("discard")
 	if err := polCache.Save(false); err != nil {
@@ -567,6 +741,21 @@ func cacheAfterFailedBranchDiscard(c *CacheStruct, result domainResult, now time
 	return cs, true
 }
 
+func waitUntil(ctx context.Context, t time.Time) bool {
+	delay := time.Until(t)
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func prefetchDuePolicies(scheduler *prefetchScheduler) {
 	prefetchDuePoliciesContext(bgCtx, scheduler)
 }
@@ -575,9 +764,14 @@ func prefetchDuePoliciesContext(ctx context.Context, scheduler *prefetchSchedule
 	var wg sync.WaitGroup
 	var counter atomic.Uint32
 	now := time.Now()
-	keys := scheduler.popDue(now)
+	keys := scheduler.deferExcess(scheduler.popDue(now), prefetchBatchCapacity(), now)
 	itemsCount := len(keys)
-	for _, key := range keys {
+	if itemsCount != 0 {
+		defer scheduler.recordBatch(now, len(keys))
+	}
+	// Start the batch's lookups evenly over the slot instead of all at once
+	spacing := PREFETCH_SLOT_INTERVAL / time.Duration(max(itemsCount, 1))
+	for i, key := range keys {
 		if ctx.Err() != nil {
 			wg.Wait()
 			return
@@ -586,12 +780,20 @@ func prefetchDuePoliciesContext(ctx context.Context, scheduler *prefetchSchedule
 		if !found {
 			continue
 		}
+		if scheduler.idle(key, value, now) {
+			itemsCount--
+			observePrefetch("idle")
+			scheduler.resetFailures(key)
+			slog.Debug("Stopped prefetching idle domain", "domain", key, "last_queried", cacheEntryLastQueried(key, value))
+			continue
+		}
 		entry := cache.Entry[*CacheStruct]{Key: key, Value: value}
 		policy, _, remainingTTL, usable := selectCachedPolicy(entry.Value, now)
 		if !usable {
 			if !shouldRetryCachedPolicyPrefetch(entry.Value, now) {
 				itemsCount--
 				logPrefetchedPolicyDowngrade(entry.Key, entry.Value, nil, now)
+				notifyPolicyDiscard(entry.Key, entry.Value, "prefetch", now)
 				discardCachedPolicyState(false, entry.Key, entry.Value)
 				unscheduleCachedPolicyPrefetch(entry.Key)
 				continue
@@ -599,6 +801,7 @@ func prefetchDuePoliciesContext(ctx context.Context, scheduler *prefetchSchedule
 		} else if policy == "" {
 			itemsCount--
 			if remainingTTL == 0 {
+				notifyPolicyDiscard(entry.Key, entry.Value, "prefetch", now)
 				discardCachedPolicyState(false, entry.Key, entry.Value)
 				unscheduleCachedPolicyPrefetch(entry.Key)
 			} else {
@@ -609,14 +812,19 @@ func prefetchDuePoliciesContext(ctx context.Context, scheduler *prefetchSchedule
 		if entry.Value.Age(now) >= CACHE_MAX_AGE {
 			itemsCount--
 			logPrefetchedPolicyDowngrade(entry.Key, entry.Value, nil, now)
+			notifyPolicyDiscard(entry.Key, entry.Value, "prefetch", now)
 			discardCachedPolicyState(false, entry.Key, entry.Value)
 			unscheduleCachedPolicyPrefetch(entry.Key)
 			continue
 		}
-		if remainingTTL > PREFETCH_INTERVAL {
+		if remainingTTL > PREFETCH_INTERVAL && !daneNeedsRevalidation(entry.Value.Dane, currentResolverIdentity()) {
 			scheduleCachedPolicyPrefetch(entry.Key, entry.Value, now)
 			continue
 		}
+		if !waitUntil(ctx, now.Add(time.Duration(i)*spacing)) {
+			wg.Wait()
+			return
+		}
 		sem := semaphore
 		select {
 		case sem <- struct{}{}:
@@ -630,17 +838,31 @@ func prefetchDuePoliciesContext(ctx context.Context, scheduler *prefetchSchedule
 				<-sem
 				wg.Done()
 			}()
+			// Wait for the budget before the lookup deadline starts
+			allowance, err := reservePrefetchBudget(ctx)
+			if err != nil {
+				return
+			}
 			// Refresh the cached policy
-			refreshed := prefetchDomain(c.Key, c.Value)
+			refreshed := prefetchDomain(c.Key, c.Value, allowance)
 			refreshedAt := time.Now()
+			if allowance.deferred.Load() {
+				// Out of budget is no failure: keep the policy and retry next batch
+				scheduler.schedule(c.Key, scheduler.batchAtOrAfter(refreshedAt.Add(PREFETCH_SLOT_INTERVAL)))
+				observePrefetch("deferred")
+				return
+			}
 			hasRefreshedData := refreshed.Dane.HasData() || refreshed.MtaSts.HasData()
 			hasFailedAttempt := (refreshed.DaneAttempted && !refreshed.Dane.HasData()) ||
 				(refreshed.MtaStsAttempted && !refreshed.MtaSts.HasData())
 			if hasRefreshedData || refreshed.DaneAttempted || refreshed.MtaStsAttempted {
-				merged := mergeCacheResult(c.Value, refreshed, refreshedAt)
+				merged := holdPolicyDowngrade(c.Key, c.Value, mergeCacheResult(c.Value, refreshed, refreshedAt), refreshedAt)
+				updatePolicyProbation(c.Key, c.Value, merged, refreshedAt)
+				recordPolicyHistory(c.Key, c.Value, merged, "prefetch", refreshedAt)
 				_, _, _, selected := selectCachedPolicy(merged, refreshedAt)
 				if selected {
 					logPrefetchedPolicyDowngrade(c.Key, c.Value, merged, refreshedAt)
+					notifyPolicyChange(c.Key, c.Value, merged, "prefetch", refreshedAt)
 				}
 				polCache.Set(c.Key, merged)
 				if selected {
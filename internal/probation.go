@@ -0,0 +1,83 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"log/slog"
+	"time"
+)
+
+// PolicyProbation is a stricter policy a domain newly moved to. Its
+// opportunistic form is served until Until, then it is promoted.
+type PolicyProbation struct {
+	Since  time.Time
+	Until  time.Time
+	Policy string // dane-only or secure
+}
+
+// probationForm is the policy served for a policy on probation.
+func probationForm(policy string) string {
+	switch policy {
+	case "dane-only":
+		return "dane"
+	case "secure":
+		return "encrypt"
+	}
+	return ""
+}
+
+// updatePolicyProbation starts, keeps or ends the probation of cs, the entry
+// merged from c. Probation starts only when the previous policy was not
+// stricter than the opportunistic form served meanwhile.
+func updatePolicyProbation(domain string, c *CacheStruct, cs *CacheStruct, now time.Time) {
+	if !config.Probation.Enabled {
+		cs.Probation = nil
+		return
+	}
+	policy, _, _, ok := selectCachedPolicy(cs, now)
+	if !ok {
+		return
+	}
+	policy = firstWord(policy)
+	if p := cs.Probation; p != nil {
+		if p.Policy == policy && now.Before(p.Until) {
+			return
+		}
+		if p.Policy == policy {
+			slog.Info("Promoted policy after probation", "domain", domain, "policy", policy, "since", p.Since)
+		}
+		cs.Probation = nil
+		return
+	}
+	form := probationForm(policy)
+	if form == "" || c == nil || !c.hasBranches() {
+		return
+	}
+	previousName, previousLevel, recognized := classifyPrefetchedPolicy(cachedPolicyForPrefetchTransition(c, now))
+	_, level, _ := classifyPrefetchedPolicy(policy)
+	_, formLevel, _ := classifyPrefetchedPolicy(form)
+	if !recognized || previousLevel >= level || previousLevel > formLevel {
+		return
+	}
+	until := now.Add(time.Duration(config.Probation.Period) * time.Second)
+	cs.Probation = &PolicyProbation{Since: now, Until: until, Policy: policy}
+	slog.Info("Started policy probation", "domain", domain, "policy", policy, "previous_policy", previousName, "serving", form, "until", until)
+}
+
+// applyPolicyProbation replaces policy, selected for c, by its opportunistic
+// form while it is on probation, with a TTL ending with the probation.
+func applyPolicyProbation(c *CacheStruct, policy string, report string, ttl uint32, now time.Time) (string, string, uint32) {
+	if c.Probation == nil || firstWord(policy) != c.Probation.Policy || !now.Before(c.Probation.Until) {
+		return policy, report, ttl
+	}
+	form := probationForm(c.Probation.Policy)
+	if form == "encrypt" {
+		// The TLSRPT attributes describe the MTA-STS policy
+		report = ""
+	}
+	remaining := uint32(c.Probation.Until.Sub(now)/time.Second) + 1
+	return form, report, min(ttl, remaining)
+}
@@ -0,0 +1,66 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbationServesDaneUntilDaneOnlyIsPromoted(t *testing.T) {
+	useTestPolicyCache(t)
+	patchConfigForTest(t, func(c *Config) {
+		c.Probation = ProbationConfig{Enabled: true, Period: 1800}
+	})
+	c, _ := storeDomainResult("probation.example", nil, testDomainResult("dane", "", ""), 1)
+	if c.Probation != nil {
+		t.Fatal("a domain looked up the first time must not be on probation")
+	}
+	c, _ = storeDomainResult("probation.example", c, testDomainResult("dane-only", "", ""), 1)
+	if c.Probation == nil || c.Probation.Policy != "dane-only" {
+		t.Fatalf("expected dane-only on probation, got %+v", c.Probation)
+	}
+
+	now := time.Now()
+	policy, _, ttl, ok := selectServedPolicy("probation.example", c, now)
+	if !ok || policy != "dane" || ttl > 1801 {
+		t.Fatalf("served %q (ttl %d), want dane during probation", policy, ttl)
+	}
+	r := decodeInspectResult(t, runControlCommand(t, "INSPECT probation.example"))
+	if r.Probation == nil || r.Probation.Policy != "dane-only" || r.Probation.Serving != "dane" || r.Served == nil || r.Served.Policy != "dane" {
+		t.Fatalf("inspect = %+v, want dane-only on probation served as dane", r)
+	}
+
+	later := c.Probation.Until.Add(time.Second)
+	if policy, _, _, _ := selectServedPolicy("probation.example", c, later); policy != "dane-only" {
+		t.Fatalf("served %q after probation, want dane-only", policy)
+	}
+	promoted := mergeCacheResult(c, testDomainResult("dane-only", "", ""), later)
+	updatePolicyProbation("probation.example", c, promoted, later)
+	if promoted.Probation != nil {
+		t.Fatalf("probation kept after promotion: %+v", promoted.Probation)
+	}
+}
+
+func TestProbationServesEncryptForNewMtaStsPolicy(t *testing.T) {
+	useTestPolicyCache(t)
+	patchConfigForTest(t, func(c *Config) {
+		c.Probation = ProbationConfig{Enabled: true, Period: 3600}
+	})
+	c, _ := storeDomainResult("sts.example", nil, testDomainResult("", "", ""), 1)
+	c, _ = storeDomainResult("sts.example", c, testDomainResult("", "secure match=mx.sts.example", "policy_type=sts"), 1)
+	policy, report, _, ok := selectServedPolicy("sts.example", c, time.Now())
+	if !ok || policy != "encrypt" || report != "" {
+		t.Fatalf("served %q %q, want encrypt without TLSRPT attributes", policy, report)
+	}
+
+	// Disabling probation enforces the policy on the next lookup.
+	config.Probation.Enabled = false
+	c, _ = storeDomainResult("sts.example", c, testDomainResult("", "secure match=mx.sts.example", "policy_type=sts"), 1)
+	if policy, _, _, _ := selectServedPolicy("sts.example", c, time.Now()); c.Probation != nil || policy != "secure match=mx.sts.example" {
+		t.Fatalf("served %q with probation disabled, probation %+v", policy, c.Probation)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// queryProfile is how a socketmap query is answered: with the server
+// settings for QUERY and QUERYwithTLSRPT, or with a profile named by the map.
+type queryProfile struct {
+	failurePolicy  *FailurePolicyConfig // nil for the global one
+	policyMapping  *PolicyMappingConfig // nil for the global one
+	name           string
+	mode           string
+	shadowBaseline string
+	branches       string
+	tlsRpt         bool
+}
+
+// defaultQueryProfile answers queries with the server settings.
+func defaultQueryProfile(tlsRpt bool) *queryProfile {
+	return &queryProfile{
+		mode:           config.Server.Mode,
+		shadowBaseline: config.Server.ShadowBaseline,
+		branches:       PROFILE_BRANCHES_BOTH,
+		tlsRpt:         tlsRpt,
+	}
+}
+
+// buildQueryProfiles validates the profiles of cfg, whose server settings
+// must be validated already.
+func buildQueryProfiles(cfg *Config) (map[string]*queryProfile, error) {
+	if len(cfg.Profiles) == 0 {
+		return nil, nil
+	}
+	profiles := make(map[string]*queryProfile, len(cfg.Profiles))
+	for name, pc := range cfg.Profiles {
+		key := strings.ToUpper(strings.TrimSpace(name))
+		prefix := "profiles." + name
+		if key == "" || strings.ContainsAny(key, " \t\r\n:,") {
+			return nil, fmt.Errorf("invalid profile name %q", name)
+		}
+		if key == "QUERY" || key == "QUERYWITHTLSRPT" || isControlCommand(key) {
+			return nil, fmt.Errorf("profile name %q is a socketmap command", name)
+		}
+		if _, ok := profiles[key]; ok {
+			return nil, fmt.Errorf("duplicate profile %q", key)
+		}
+		p := &queryProfile{
+			name:           key,
+			mode:           strings.ToLower(strings.TrimSpace(pc.Mode)),
+			shadowBaseline: strings.TrimSpace(pc.ShadowBaseline),
+			branches:       strings.ToLower(strings.TrimSpace(pc.Branches)),
+			tlsRpt:         cfg.Server.TlsRpt,
+		}
+		if pc.TlsRpt != nil {
+			p.tlsRpt = *pc.TlsRpt
+		}
+		if p.mode == "" {
+			p.mode = cfg.Server.Mode
+		}
+		if p.mode != SERVER_MODE_ENFORCE && p.mode != SERVER_MODE_SHADOW {
+			return nil, fmt.Errorf("invalid %s.mode %q", prefix, p.mode)
+		}
+		if p.shadowBaseline == "" {
+			p.shadowBaseline = cfg.Server.ShadowBaseline
+		} else if !validCachedPolicy(p.shadowBaseline, SHADOW_BASELINE_LEVELS...) {
+			return nil, fmt.Errorf("invalid %s.shadow-baseline %q", prefix, p.shadowBaseline)
+		}
+		switch p.branches {
+		case "":
+			p.branches = PROFILE_BRANCHES_BOTH
+		case PROFILE_BRANCHES_BOTH, PROFILE_BRANCHES_DANE, PROFILE_BRANCHES_MTASTS:
+		default:
+			return nil, fmt.Errorf("invalid %s.branches %q", prefix, p.branches)
+		}
+		if pc.FailurePolicy != nil {
+			if err := pc.FailurePolicy.validate(prefix + ".failure-policy"); err != nil {
+				return nil, err
+			}
+			p.failurePolicy = pc.FailurePolicy
+		}
+		if pc.PolicyMapping != nil {
+			if err := pc.PolicyMapping.validate(prefix + ".policy-mapping"); err != nil {
+				return nil, err
+			}
+			p.policyMapping = pc.PolicyMapping
+		}
+		profiles[key] = p
+	}
+	return profiles, nil
+}
+
+func (p *queryProfile) failurePolicyConfig() *FailurePolicyConfig {
+	if p.failurePolicy != nil {
+		return p.failurePolicy
+	}
+	return &config.FailurePolicy
+}
+
+func (p *queryProfile) policyMappingConfig() *PolicyMappingConfig {
+	if p.policyMapping != nil {
+		return p.policyMapping
+	}
+	return &config.PolicyMapping
+}
+
+// selectPolicy is selectServedPolicy for profiles serving both branches.
+// Otherwise the policy of the DANE or MTA-STS branch is served, held back
+// by a pin, on probation and decided by rules like any served policy. Rules
+// can only select the branch of the profile.
+func (p *queryProfile) selectPolicy(domain string, c *CacheStruct, now time.Time) (string, string, uint32, bool) {
+	if p.branches == PROFILE_BRANCHES_BOTH {
+		return selectServedPolicy(domain, c, now)
+	}
+	if c == nil {
+		return "", "", 0, false
+	}
+	restricted := cloneCacheStruct(c)
+	branch := &restricted.Dane
+	if p.branches == PROFILE_BRANCHES_MTASTS {
+		restricted.Dane = PolicyBranch{}
+		branch = &restricted.MtaSts
+	} else {
+		restricted.MtaSts = PolicyBranch{}
+	}
+	if config.Pinning.Enabled && c.Pin != nil {
+		pinned := pinnedBranch(c.Pin.Dane, now)
+		if p.branches == PROFILE_BRANCHES_MTASTS {
+			pinned = pinnedBranch(c.Pin.MtaSts, now)
+		}
+		if _, _, downgraded := isPrefetchedPolicyDowngrade(pinned.Policy, branch.Policy); pinned.HasData() && downgraded {
+			*branch = pinned
+		}
+	}
+	ttl := branch.RemainingTTL(now)
+	if ttl == 0 {
+		return "", "", 0, false
+	}
+	policy, report, ttl := applyPolicyProbation(c, branch.Policy, branch.Report, ttl, now)
+	policy, report, ttl, _ = applyPolicyRulesTo(domain, c, restricted, policy, report, ttl, p.branches, now)
+	return policy, report, ttl, true
+}
@@ -0,0 +1,153 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+)
+
+const testProfilesConfig = `server:
+  address: 127.0.0.1:8642
+profiles:
+  strict:
+    tlsrpt: true
+    failure-policy:
+      default: encrypt
+      max-failures: 0
+  DANEONLY:
+    branches: dane
+  STSONLY:
+    branches: mta-sts
+  SHADOW:
+    mode: shadow
+    shadow-baseline: may
+`
+
+func loadProfilesForTest(t *testing.T, body string) Config {
+	t.Helper()
+	initializeTestDefaultConfig(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := config
+	t.Cleanup(func() {
+		config = original
+		lookupFailureStreaks.clear()
+	})
+	return cfg
+}
+
+func TestProfilesSelectBranchesPerMap(t *testing.T) {
+	useTestPolicyCache(t)
+	config = loadProfilesForTest(t, testProfilesConfig)
+	storeDomainResult("sts.example", nil, domainResult{
+		Dane:            branchFromResult("", "", 3600),
+		MtaSts:          branchFromResult("secure match=mx.sts.example", "policy_type=sts", 86400),
+		DaneAttempted:   true,
+		MtaStsAttempted: true,
+	}, 1)
+
+	for _, tt := range []struct{ query, want string }{
+		{"QUERY sts.example", string(netstring.Marshal("OK secure match=mx.sts.example"))},
+		{"STSONLY sts.example", string(netstring.Marshal("OK secure match=mx.sts.example"))},
+		{"DANEONLY sts.example", string(NS_NOTFOUND)},
+		{"strict sts.example", string(netstring.Marshal("OK secure match=mx.sts.example policy_type=sts"))},
+		{"SHADOW sts.example", string(netstring.Marshal("OK may"))},
+		{"UNKNOWN sts.example", string(NS_PERM)},
+	} {
+		if got := runControlCommand(t, tt.query); got != tt.want {
+			t.Fatalf("%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestBranchProfilesServePinsProbationAndRules(t *testing.T) {
+	useTestPolicyCache(t)
+	config = loadProfilesForTest(t, testProfilesConfig)
+	patchConfigForTest(t, func(c *Config) {
+		c.Pinning = PinningConfig{Enabled: true, ConfirmLookups: 3, ConfirmPeriod: 3600}
+	})
+	patchConfigForTest(t, func(c *Config) {
+		c.Probation = ProbationConfig{Enabled: true, Period: 3600}
+	})
+	rules := mustParsePolicyRules(t, testPolicyRules)
+	patchConfigForTest(t, func(c *Config) { c.rules = rules })
+	now := time.Now()
+
+	// A pinned entry whose DANE branch already shows the downgrade
+	polCache.Set("pinned.example", &CacheStruct{
+		Expirable: &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+		Dane:      PolicyBranch{TTL: 3600, ExpiresAt: now.Add(time.Hour)},
+		MtaSts:    PolicyBranch{TTL: 86400, ExpiresAt: now.Add(time.Hour)},
+		Pin: &PolicyPin{
+			Since:   now,
+			Dane:    PolicyBranch{Policy: "dane-only", TTL: 3600, ExpiresAt: now},
+			Policy:  "dane-only",
+			Lookups: 1,
+		},
+	})
+	c, _ := storeDomainResult("probation.example", nil, testDomainResult("", "", "policy_type=sts"), 1)
+	storeDomainResult("probation.example", c, testDomainResult("dane-only", "", "policy_type=sts"), 1)
+	storeDomainResult("other.example", nil, testDomainResult("dane-only", "secure match=mx.other.example", "policy_type=sts"), 1)
+	storeDomainResult("shop.subsidiary.example", nil, testDomainResult("", "", "policy_type=sts"), 1)
+
+	for _, tt := range []struct{ query, want string }{
+		{"DANEONLY pinned.example", string(netstring.Marshal("OK dane-only"))},
+		{"DANEONLY probation.example", string(netstring.Marshal("OK dane"))},
+		{"DANEONLY other.example", string(netstring.Marshal("OK dane-only"))},
+		{"STSONLY other.example", string(netstring.Marshal("OK secure match=mx.other.example"))},
+		{"STSONLY shop.subsidiary.example", string(netstring.Marshal("OK encrypt"))},
+	} {
+		if got := runControlCommand(t, tt.query); got != tt.want {
+			t.Fatalf("%s = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestProfileFailurePolicy(t *testing.T) {
+	config = loadProfilesForTest(t, testProfilesConfig)
+	if got := string(replyForTest("failing.example", "TEMP")); got != string(NS_TEMP) {
+		t.Fatalf("QUERY failure = %q, want TEMP", got)
+	}
+	conn := newSecurityTestConn(nil, nil)
+	replySocketmap(conn, "network", "failing.example", "TEMP", "", 0, config.profiles["STRICT"])
+	if got := conn.output.String(); got != string(netstring.Marshal("OK encrypt")) {
+		t.Fatalf("STRICT failure = %q, want OK encrypt", got)
+	}
+}
+
+func TestLoadConfigRejectsInvalidProfiles(t *testing.T) {
+	initializeTestDefaultConfig(t)
+	for _, tt := range []struct{ name, body string }{
+		{"command name", "profiles:\n  query:\n    tlsrpt: true\n"},
+		{"control command name", "profiles:\n  DUMP:\n    tlsrpt: true\n"},
+		{"duplicate name", "profiles:\n  strict:\n    tlsrpt: true\n  STRICT:\n    tlsrpt: false\n"},
+		{"invalid branches", "profiles:\n  STRICT:\n    branches: tlsa\n"},
+		{"invalid mode", "profiles:\n  STRICT:\n    mode: audit\n"},
+		{"invalid failure policy", "profiles:\n  STRICT:\n    failure-policy:\n      default: secure\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte("server:\n  address: 127.0.0.1:8642\n"+tt.body), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadConfig(path); err == nil {
+				t.Fatal("expected invalid profile to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,588 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v4"
+)
+
+// RULE_POLICIES are what a rule may select: the policy of the DANE or
+// MTA-STS branch, a fixed policy, no policy, a temporary failure, or the
+// default selection.
+var RULE_POLICIES = []string{"dane", "mta-sts", "encrypt", "may", "none", "temp", "default"}
+
+// RULE_POLICY_LEVELS orders policies for level(), weakest first.
+var RULE_POLICY_LEVELS = []string{"none", "may", "encrypt", "secure", "dane", "dane-only"}
+
+// policyRule selects the policy of a domain whose branches match When. An
+// empty When matches every domain.
+type policyRule struct {
+	cond   ruleExpr
+	Name   string `yaml:"name"`
+	When   string `yaml:"when"`
+	Policy string `yaml:"policy"`
+}
+
+// policyRules are evaluated in order, the first matching rule decides.
+type policyRules struct {
+	Rules []policyRule `yaml:"rules"`
+}
+
+// ruleEnv holds the branch data of a domain that rule expressions see.
+// Policies are named by their first word, "none" without a policy.
+type ruleEnv struct {
+	domain         string
+	policy         string // default selection
+	source         string // branch of the default selection
+	dane           string
+	mtaSts         string
+	daneValidation string
+	ttl            int64
+	daneTTL        int64
+	mtaStsTTL      int64
+}
+
+func rulePolicyName(policy string) string {
+	if policy == "" {
+		return "none"
+	}
+	return strings.ToLower(firstWord(policy))
+}
+
+func newRuleEnv(domain string, c *CacheStruct, policy string, ttl uint32, source string, now time.Time) *ruleEnv {
+	return &ruleEnv{
+		domain:         domain,
+		policy:         rulePolicyName(policy),
+		source:         source,
+		dane:           rulePolicyName(liveBranchPolicy(c.Dane, now)),
+		mtaSts:         rulePolicyName(liveBranchPolicy(c.MtaSts, now)),
+		daneValidation: c.Dane.Validation,
+		ttl:            int64(ttl),
+		daneTTL:        int64(c.Dane.RemainingTTL(now)),
+		mtaStsTTL:      int64(c.MtaSts.RemainingTTL(now)),
+	}
+}
+
+// liveBranchPolicy returns the policy of branch, or none once it expired.
+func liveBranchPolicy(branch PolicyBranch, now time.Time) string {
+	if branch.RemainingTTL(now) == 0 {
+		return ""
+	}
+	return branch.Policy
+}
+
+func loadPolicyRules(filename string) (*policyRules, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, CONFIG_MAX_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > CONFIG_MAX_SIZE {
+		return nil, fmt.Errorf("rules file exceeds %d bytes", CONFIG_MAX_SIZE)
+	}
+	return parsePolicyRules(data)
+}
+
+func parsePolicyRules(data []byte) (*policyRules, error) {
+	var r policyRules
+	if err := yaml.Load(data, &r, yaml.WithKnownFields(true)); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(r.Rules))
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		rule.Name = strings.TrimSpace(rule.Name)
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+		rule.Policy = strings.ToLower(strings.TrimSpace(rule.Policy))
+		if !slices.Contains(RULE_POLICIES, rule.Policy) {
+			return nil, fmt.Errorf("rule %q: invalid policy %q", rule.Name, rule.Policy)
+		}
+		when := strings.TrimSpace(rule.When)
+		if when == "" {
+			when = "true"
+		}
+		cond, err := compileRuleExpr(when)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if cond.kind != ruleBool {
+			return nil, fmt.Errorf("rule %q: condition is not true or false", rule.Name)
+		}
+		rule.cond = cond
+	}
+	return &r, nil
+}
+
+// RuleTrace is a rule evaluated for a domain by RULESTEST.
+type RuleTrace struct {
+	Name    string `json:"name"`
+	Matched bool   `json:"matched"`
+	Applied bool   `json:"applied"` // false if the selected branch has no policy
+}
+
+// apply returns the policy selected by the first matching rule, or the
+// default selection policy, report and ttl with an empty rule name. A rule
+// selecting a branch without a policy, or an expired one, is passed over; one
+// selecting a branch is served with that branch's remaining TTL.
+func (r *policyRules) apply(env *ruleEnv, c *CacheStruct, policy string, report string, ttl uint32, now time.Time, trace *[]RuleTrace) (string, string, uint32, string) {
+	for i := range r.Rules {
+		rule := &r.Rules[i]
+		matched := rule.cond.boolean(env)
+		applied := matched
+		p, rpt, t := policy, report, ttl
+		if matched {
+			switch rule.Policy {
+			case "dane":
+				p, rpt, t = liveBranchPolicy(c.Dane, now), c.Dane.Report, c.Dane.RemainingTTL(now)
+				applied = p != ""
+			case "mta-sts":
+				p, rpt, t = liveBranchPolicy(c.MtaSts, now), c.MtaSts.Report, c.MtaSts.RemainingTTL(now)
+				applied = p != ""
+			case "encrypt", "may":
+				p, rpt = rule.Policy, ""
+			case "none":
+				p, rpt = "", ""
+			case "temp":
+				p, rpt = "TEMP", ""
+			}
+		}
+		if trace != nil {
+			*trace = append(*trace, RuleTrace{Name: rule.Name, Matched: matched, Applied: applied})
+		}
+		if applied {
+			return p, rpt, t, rule.Name
+		}
+	}
+	return policy, report, ttl, ""
+}
+
+// applyPolicyRules runs the rules configured in server.rules-file, if any,
+// on the policy selected for c. It also returns the name of the rule that
+// decided the policy, if one did.
+func applyPolicyRules(domain string, c *CacheStruct, policy string, report string, ttl uint32, source string, now time.Time) (string, string, uint32, string) {
+	return applyPolicyRulesTo(domain, c, c, policy, report, ttl, source, now)
+}
+
+// applyPolicyRulesTo is applyPolicyRules where rules selecting a branch take
+// it from selectable, c with branches that may not be served cleared.
+func applyPolicyRulesTo(domain string, c *CacheStruct, selectable *CacheStruct, policy string, report string, ttl uint32, source string, now time.Time) (string, string, uint32, string) {
+	rules := config.rules
+	if rules == nil || !c.hasBranches() {
+		return policy, report, ttl, ""
+	}
+	policy, report, ttl, name := rules.apply(newRuleEnv(domain, c, policy, ttl, source, now), selectable, policy, report, ttl, now, nil)
+	if name != "" {
+		slog.Debug("Policy rule matched", "domain", domain, "rule", name, "policy", rulePolicyName(policy))
+	}
+	return policy, report, ttl, name
+}
+
+// RulesTestResult is the reply to RULESTEST.
+type RulesTestResult struct {
+	Version   string         `json:"version"`
+	Domain    string         `json:"domain"`
+	Rule      string         `json:"rule,omitempty"`
+	Default   *InspectServed `json:"default,omitempty"`
+	Served    *InspectServed `json:"served,omitempty"`
+	Variables map[string]any `json:"variables,omitempty"`
+	Rules     []RuleTrace    `json:"rules"`
+	Cached    bool           `json:"cached"`
+}
+
+func rulesTestDomain(domain string, now time.Time) RulesTestResult {
+	c, found := polCache.Get(domain)
+	r := RulesTestResult{
+		Version: Version,
+		Domain:  domain,
+		Rules:   []RuleTrace{},
+		Cached:  found && c != nil,
+	}
+	if !r.Cached || !c.hasBranches() {
+		return r
+	}
+	policy, report, ttl, source, ok := selectCachedPolicySource(c, now)
+	if !ok {
+		return r
+	}
+	policy, report, ttl = applyPolicyProbation(c, policy, report, ttl, now)
+	r.Default = &InspectServed{Policy: policy, Report: report, TTL: ttl}
+	env := newRuleEnv(domain, c, policy, ttl, source, now)
+	r.Variables = env.variables()
+	if config.rules != nil {
+		policy, report, ttl, r.Rule = config.rules.apply(env, c, policy, report, ttl, now, &r.Rules)
+	}
+	policy, report = mapPolicy(&config.PolicyMapping, domain, policy, report)
+	r.Served = &InspectServed{Policy: policy, Report: report, TTL: ttl}
+	return r
+}
+
+func reportRulesTest(conn net.Conn, argument string) {
+	domain, ok := normalizePolicyKey(argument)
+	if !ok {
+		writeConnectionResponse(conn, NS_NOTFOUND)
+		return
+	}
+	b, err := json.Marshal(rulesTestDomain(domain, time.Now()))
+	if err != nil {
+		slog.Error("Could not marshal JSON", "error", err)
+		return
+	}
+	writeConnectionResponse(conn, append(b, '\n'))
+}
+
+// Rule expressions compare the variables of ruleEnv with string and number
+// literals, combined with !, && and || and parentheses. suffix(s) is true if
+// the domain (or next-hop host) is s or a subdomain of it, level(p) ranks a
+// policy name by RULE_POLICY_LEVELS.
+
+type ruleKind int
+
+const (
+	ruleBool ruleKind = iota
+	ruleString
+	ruleNumber
+)
+
+func (k ruleKind) String() string {
+	switch k {
+	case ruleString:
+		return "string"
+	case ruleNumber:
+		return "number"
+	}
+	return "boolean"
+}
+
+// ruleExpr is a compiled expression of kind, evaluated by the matching
+// function.
+type ruleExpr struct {
+	boolean func(*ruleEnv) bool
+	str     func(*ruleEnv) string
+	num     func(*ruleEnv) int64
+	kind    ruleKind
+}
+
+var ruleVariables = map[string]ruleExpr{
+	"domain":          {kind: ruleString, str: func(e *ruleEnv) string { return e.domain }},
+	"policy":          {kind: ruleString, str: func(e *ruleEnv) string { return e.policy }},
+	"source":          {kind: ruleString, str: func(e *ruleEnv) string { return e.source }},
+	"dane":            {kind: ruleString, str: func(e *ruleEnv) string { return e.dane }},
+	"mta_sts":         {kind: ruleString, str: func(e *ruleEnv) string { return e.mtaSts }},
+	"dane_validation": {kind: ruleString, str: func(e *ruleEnv) string { return e.daneValidation }},
+	"ttl":             {kind: ruleNumber, num: func(e *ruleEnv) int64 { return e.ttl }},
+	"dane_ttl":        {kind: ruleNumber, num: func(e *ruleEnv) int64 { return e.daneTTL }},
+	"mta_sts_ttl":     {kind: ruleNumber, num: func(e *ruleEnv) int64 { return e.mtaStsTTL }},
+}
+
+func (e *ruleEnv) variables() map[string]any {
+	vars := make(map[string]any, len(ruleVariables))
+	for name, v := range ruleVariables {
+		if v.kind == ruleString {
+			vars[name] = v.str(e)
+		} else {
+			vars[name] = v.num(e)
+		}
+	}
+	return vars
+}
+
+type ruleToken struct {
+	text string
+	pos  int
+	kind byte // 'i' identifier, 's' string, 'n' number, 'o' operator, 0 end
+}
+
+func lexRuleExpr(s string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{kind: 'i', text: s[i:j], pos: i})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, ruleToken{kind: 'n', text: s[i:j], pos: i})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			text, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d", i)
+			}
+			tokens = append(tokens, ruleToken{kind: 's', text: text, pos: i})
+			i = j + 1
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", ","} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			tokens = append(tokens, ruleToken{kind: 'o', text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, ruleToken{pos: len(s)}), nil
+}
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+func compileRuleExpr(s string) (ruleExpr, error) {
+	tokens, err := lexRuleExpr(s)
+	if err != nil {
+		return ruleExpr{}, err
+	}
+	p := &ruleParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return ruleExpr{}, err
+	}
+	if t := p.peek(); t.kind != 0 {
+		return ruleExpr{}, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+	}
+	return expr, nil
+}
+
+func (p *ruleParser) peek() ruleToken {
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) accept(op string) bool {
+	if t := p.peek(); t.kind == 'o' && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *ruleParser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %q at offset %d", op, t.pos)
+	}
+	return nil
+}
+
+func ruleOperand(op string, kind ruleKind, expr ruleExpr) error {
+	if expr.kind != kind {
+		return fmt.Errorf("%s needs a %s, got a %s", op, kind, expr.kind)
+	}
+	return nil
+}
+
+func (p *ruleParser) or() (ruleExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return left, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return right, err
+		}
+		if err := errors.Join(ruleOperand("||", ruleBool, left), ruleOperand("||", ruleBool, right)); err != nil {
+			return ruleExpr{}, err
+		}
+		l, r := left.boolean, right.boolean
+		left = ruleExpr{kind: ruleBool, boolean: func(e *ruleEnv) bool { return l(e) || r(e) }}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) and() (ruleExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return left, err
+	}
+	for p.accept("&&") {
+		right, err := p.unary()
+		if err != nil {
+			return right, err
+		}
+		if err := errors.Join(ruleOperand("&&", ruleBool, left), ruleOperand("&&", ruleBool, right)); err != nil {
+			return ruleExpr{}, err
+		}
+		l, r := left.boolean, right.boolean
+		left = ruleExpr{kind: ruleBool, boolean: func(e *ruleEnv) bool { return l(e) && r(e) }}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) unary() (ruleExpr, error) {
+	if p.accept("!") {
+		expr, err := p.unary()
+		if err != nil {
+			return expr, err
+		}
+		if err := ruleOperand("!", ruleBool, expr); err != nil {
+			return ruleExpr{}, err
+		}
+		f := expr.boolean
+		return ruleExpr{kind: ruleBool, boolean: func(e *ruleEnv) bool { return !f(e) }}, nil
+	}
+	return p.comparison()
+}
+
+func (p *ruleParser) comparison() (ruleExpr, error) {
+	left, err := p.primary()
+	if err != nil {
+		return left, err
+	}
+	t := p.peek()
+	if t.kind != 'o' || !slices.Contains([]string{"==", "!=", "<", "<=", ">", ">="}, t.text) {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.primary()
+	if err != nil {
+		return right, err
+	}
+	if left.kind != right.kind {
+		return ruleExpr{}, fmt.Errorf("cannot compare a %s with a %s at offset %d", left.kind, right.kind, t.pos)
+	}
+	switch left.kind {
+	case ruleNumber:
+		l, r := left.num, right.num
+		return ruleExpr{kind: ruleBool, boolean: func(e *ruleEnv) bool { return compareRuleValues(t.text, l(e), r(e)) }}, nil
+	case ruleString:
+		l, r := left.str, right.str
+		return ruleExpr{kind: ruleBool, boolean: func(e *ruleEnv) bool { return compareRuleValues(t.text, l(e), r(e)) }}, nil
+	}
+	if t.text != "==" && t.text != "!=" {
+		return ruleExpr{}, fmt.Errorf("%s needs numbers or strings at offset %d", t.text, t.pos)
+	}
+	l, r := left.boolean, right.boolean
+	return ruleExpr{kind: ruleBool, boolean: func(e *ruleEnv) bool { return (l(e) == r(e)) == (t.text == "==") }}, nil
+}
+
+func compareRuleValues[T int64 | string](op string, l T, r T) bool {
+	switch op {
+	case "==":
+		return l == r
+	case "!=":
+		return l != r
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	}
+	return l >= r
+}
+
+func (p *ruleParser) primary() (ruleExpr, error) {
+	t := p.peek()
+	p.pos++
+	switch t.kind {
+	case 's':
+		return ruleExpr{kind: ruleString, str: func(*ruleEnv) string { return t.text }}, nil
+	case 'n':
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return ruleExpr{}, fmt.Errorf("invalid number at offset %d", t.pos)
+		}
+		return ruleExpr{kind: ruleNumber, num: func(*ruleEnv) int64 { return n }}, nil
+	case 'o':
+		if t.text == "(" {
+			expr, err := p.or()
+			if err != nil {
+				return expr, err
+			}
+			return expr, p.expect(")")
+		}
+	case 'i':
+		switch t.text {
+		case "true", "false":
+			b := t.text == "true"
+			return ruleExpr{kind: ruleBool, boolean: func(*ruleEnv) bool { return b }}, nil
+		case "suffix", "level":
+			return p.call(t)
+		}
+		if v, ok := ruleVariables[t.text]; ok {
+			return v, nil
+		}
+		return ruleExpr{}, fmt.Errorf("unknown variable %q at offset %d", t.text, t.pos)
+	case 0:
+		return ruleExpr{}, fmt.Errorf("unexpected end of expression")
+	}
+	return ruleExpr{}, fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+func (p *ruleParser) call(fn ruleToken) (ruleExpr, error) {
+	if err := p.expect("("); err != nil {
+		return ruleExpr{}, err
+	}
+	arg, err := p.or()
+	if err != nil {
+		return arg, err
+	}
+	if err := p.expect(")"); err != nil {
+		return ruleExpr{}, err
+	}
+	if err := ruleOperand(fn.text+"()", ruleString, arg); err != nil {
+		return ruleExpr{}, err
+	}
+	s := arg.str
+	if fn.text == "level" {
+		return ruleExpr{kind: ruleNumber, num: func(e *ruleEnv) int64 {
+			return int64(slices.Index(RULE_POLICY_LEVELS, s(e)))
+		}}, nil
+	}
+	return ruleExpr{kind: ruleBool, boolean: func(e *ruleEnv) bool {
+		suffix := strings.Trim(strings.ToLower(s(e)), ".")
+		host := policyKeyHost(e.domain)
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}}, nil
+}
@@ -0,0 +1,157 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicyRules = `rules:
+  - name: banks-require-dane-and-mta-sts
+    when: suffix("bank.example") && (dane == "none" || mta_sts == "none")
+    policy: temp
+  - name: subsidiaries-at-least-encrypt
+    when: suffix("subsidiary.example") && level(policy) < level("encrypt")
+    policy: encrypt
+  - name: prefer-mta-sts
+    when: suffix("other.example") && source == "dane" && mta_sts_ttl > 3600
+    policy: mta-sts
+`
+
+func mustParsePolicyRules(t *testing.T, data string) *policyRules {
+	t.Helper()
+	rules, err := parsePolicyRules([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestPolicyRulesSelectServedPolicy(t *testing.T) {
+	useTestPolicyCache(t)
+	rules := mustParsePolicyRules(t, testPolicyRules)
+	patchConfigForTest(t, func(c *Config) { c.rules = rules })
+	now := time.Now()
+	for _, tt := range []struct {
+		domain       string
+		dane, mtaSts string
+		want         string
+	}{
+		{"mx.bank.example", "dane-only", "", "TEMP"},
+		{"bank.example", "dane-only", "secure match=mx.bank.example", "dane-only"},
+		{"shop.subsidiary.example", "", "", "encrypt"},
+		{"subsidiary.example", "dane-only", "", "dane-only"},
+		{"other.example", "dane-only", "secure match=mx.other.example", "secure match=mx.other.example"},
+		{"plain.example", "", "", ""},
+	} {
+		c, _ := storeDomainResult(tt.domain, nil, testDomainResult(tt.dane, tt.mtaSts, "policy_type=sts"), 1)
+		if policy, _, _, ok := selectServedPolicy(tt.domain, c, now); !ok || policy != tt.want {
+			t.Fatalf("%s served %q, want %q", tt.domain, policy, tt.want)
+		}
+	}
+	// TEMP selected by a rule is not exported to Postfix tables
+	if out := runControlCommand(t, "EXPORT"); strings.Contains(out, "TEMP") {
+		t.Fatalf("export contains a temporary failure: %q", out)
+	}
+}
+
+func TestRulesTestShowsMatchedRule(t *testing.T) {
+	useTestPolicyCache(t)
+	rules := mustParsePolicyRules(t, testPolicyRules)
+	patchConfigForTest(t, func(c *Config) { c.rules = rules })
+	storeDomainResult("shop.subsidiary.example", nil, testDomainResult("", "", "policy_type=sts"), 1)
+
+	var r RulesTestResult
+	if err := json.Unmarshal([]byte(runControlCommand(t, "RULESTEST Shop.Subsidiary.Example.")), &r); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Cached || r.Rule != "subsidiaries-at-least-encrypt" || r.Default == nil || r.Default.Policy != "" || r.Served == nil || r.Served.Policy != "encrypt" {
+		t.Fatalf("rules test = %+v", r)
+	}
+	if len(r.Rules) != 2 || r.Rules[0].Matched || !r.Rules[1].Matched || !r.Rules[1].Applied {
+		t.Fatalf("rules evaluated = %+v", r.Rules)
+	}
+	if r.Variables["domain"] != "shop.subsidiary.example" || r.Variables["policy"] != "none" {
+		t.Fatalf("variables = %+v", r.Variables)
+	}
+	if got := runControlCommand(t, "RULESTEST"); got != string(NS_NOTFOUND) {
+		t.Fatalf("RULESTEST without domain = %q", got)
+	}
+}
+
+func TestPolicyRulesPassOverExpiredBranches(t *testing.T) {
+	useTestPolicyCache(t)
+	rules := mustParsePolicyRules(t, `rules:
+  - name: prefer-mta-sts
+    policy: mta-sts
+`)
+	patchConfigForTest(t, func(c *Config) { c.rules = rules })
+	now := time.Now()
+	c, _ := storeDomainResult("other.example", nil, testDomainResult("dane-only", "secure match=mx.other.example", "policy_type=sts"), 1)
+	c.MtaSts.ExpiresAt = now.Add(10 * time.Minute)
+	if policy, _, ttl, ok := selectServedPolicy("other.example", c, now); !ok || policy != "secure match=mx.other.example" || ttl > 600 {
+		t.Fatalf("served %q with ttl %d, want MTA-STS with its remaining TTL", policy, ttl)
+	}
+
+	c.MtaSts.ExpiresAt = now.Add(-time.Second)
+	policy, _, ttl, ok := selectServedPolicy("other.example", c, now)
+	if !ok || policy != "dane-only" || ttl == 0 {
+		t.Fatalf("served %q with ttl %d, want DANE over the expired MTA-STS branch", policy, ttl)
+	}
+	env := newRuleEnv("other.example", c, policy, ttl, "dane", now)
+	if env.mtaSts != "none" || env.mtaStsTTL != 0 {
+		t.Fatalf("expired MTA-STS branch seen by rules as %q with ttl %d", env.mtaSts, env.mtaStsTTL)
+	}
+}
+
+func TestParsePolicyRulesRejectsInvalidRules(t *testing.T) {
+	for _, tt := range []struct{ name, body string }{
+		{"unknown variable", "rules:\n  - name: a\n    when: mx == \"x\"\n    policy: may\n"},
+		{"string compared with number", "rules:\n  - name: a\n    when: dane_ttl == \"x\"\n    policy: may\n"},
+		{"condition not boolean", "rules:\n  - name: a\n    when: dane\n    policy: may\n"},
+		{"unbalanced parenthesis", "rules:\n  - name: a\n    when: (true\n    policy: may\n"},
+		{"invalid policy", "rules:\n  - name: a\n    policy: secure\n"},
+		{"duplicate name", "rules:\n  - name: a\n    policy: may\n  - name: a\n    policy: none\n"},
+		{"unknown key", "rules:\n  - name: a\n    policy: may\n    then: none\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePolicyRules([]byte(tt.body)); err == nil {
+				t.Fatal("expected invalid rules to be rejected")
+			}
+		})
+	}
+}
+
+func TestLoadConfigReadsRulesFile(t *testing.T) {
+	initializeTestDefaultConfig(t)
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.yaml")
+	if err := os.WriteFile(rulesPath, []byte(testPolicyRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("server:\n  address: 127.0.0.1:8642\n  rules-file: "+rulesPath+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.rules == nil || len(cfg.rules.Rules) != 3 {
+		t.Fatalf("rules = %+v", cfg.rules)
+	}
+	if err := os.WriteFile(rulesPath, []byte("rules:\n  - name: a\n    policy: always\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(path); err == nil {
+		t.Fatal("expected an invalid rules file to be rejected")
+	}
+}
@@ -29,7 +29,6 @@ import (
 
 	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
 	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
-	"github.com/Zuplu/postfix-tlspol/internal/utils/valid"
 
 	"codeberg.org/miekg/dns"
 	"golang.org/x/sync/singleflight"
@@ -45,13 +44,23 @@ type CacheStruct struct {
 	MtaSts  PolicyBranch
 	TTL     uint32
 	Counter uint32
+	// LastQueried is when Postfix last asked for the domain. Newer cache hits
+	// are kept in cacheLastQueried until the hit counters are flushed.
+	LastQueried time.Time
+	Pin         *PolicyPin // downgrade held back by pinning, never modified in place
+	Probation   *PolicyProbation
+	// History holds the last POLICY_HISTORY_MAX changes of the served
+	// policy. It is replaced, never modified in place.
+	History []PolicyChange
 }
 
 type PolicyBranch struct {
-	ExpiresAt time.Time
-	Policy    string
-	Report    string
-	TTL       uint32
+	ExpiresAt  time.Time
+	Policy     string
+	Report     string
+	Resolver   string // resolver that answered the lookup
+	Validation string // how DNSSEC was validated, see DNS_VALIDATION_AD
+	TTL        uint32
 }
 
 func (p PolicyBranch) HasData() bool {
@@ -163,8 +172,12 @@ func discardCachedPolicyState(haveLock bool, key string, c *CacheStruct) {
 		cleanupCacheHitCounterIfUnused(haveLock, key)
 		return
 	}
+	entry := statsOnlyCacheEntry(counter)
+	if c != nil {
+		recordPolicyDiscard(c, entry, time.Now())
+	}
 	polCache.Update(haveLock, key, func(*CacheStruct, bool) (*CacheStruct, bool) {
-		return statsOnlyCacheEntry(counter), true
+		return entry, true
 	})
 	cleanupCacheHitCounterIfUnused(haveLock, key)
 }
@@ -180,8 +193,8 @@ func cachedEntryLocked(key string) (*CacheStruct, bool) {
 }
 
 func discardCachedPolicyStateIfCurrent(key string, expected *CacheStruct) (*CacheStruct, bool) {
-	polCache.Lock()
-	defer polCache.Unlock()
+	polCache.LockKey(key)
+	defer polCache.UnlockKey(key)
 	current, found := cachedEntryLocked(key)
 	if !found || current != expected {
 		return current, false
@@ -191,8 +204,8 @@ func discardCachedPolicyStateIfCurrent(key string, expected *CacheStruct) (*Cach
 }
 
 func removeCacheEntryIfCurrent(key string, expected *CacheStruct) (*CacheStruct, bool) {
-	polCache.Lock()
-	defer polCache.Unlock()
+	polCache.LockKey(key)
+	defer polCache.UnlockKey(key)
 	current, found := cachedEntryLocked(key)
 	if !found || current != expected {
 		return current, false
@@ -224,6 +237,7 @@ const (
 	CACHE_MAX_AGE               uint32 = 1800 // max age for stale queries (only for prefetching, not served to postfix)
 	CACHE_MAX_ENTRIES                  = 50000
 	CACHE_PRUNE_TARGET                 = 45000
+	CACHE_SNAPSHOT_INTERVAL            = time.Hour // upper bound between journal compactions
 	REQUEST_TIMEOUT                    = 2 * time.Second
 	POLICY_ATTEMPTS                    = 3
 	POLICY_RETRY_BASE                  = 250 * time.Millisecond
@@ -264,6 +278,7 @@ var (
 	activeConnections sync.Map
 	cachePruneMu      sync.Mutex
 	cacheHitCounters  sync.Map
+	cacheLastQueried  sync.Map // domain -> unix nanoseconds of the latest cache hit
 	showVersion       = false
 	showLicense       = false
 	configFile        string
@@ -278,8 +293,21 @@ func init() {
 	flag.StringVar(&configFile, "config", "/etc/postfix-tlspol/config.yaml", "Path to the config.yaml")
 	flag.String("query", "", "Query a domain")
 	flag.Bool("dump", false, "Dump cache with query counter")
+	flag.String("format", "text", "Output format for -dump: text, json or csv")
 	flag.Bool("export", false, "Dump cache in postfix hash format")
 	flag.Bool("purge", false, "Manually clear the cache")
+	flag.String("inspect", "", "Show the cached state of a domain")
+	flag.String("refresh", "", "Look up a domain again and update its cache entry")
+	flag.String("history", "", "Show the recent policy changes of a domain")
+	flag.String("rules-test", "", "Show which policy rule applies to a cached domain")
+	flag.String("purge-domain", "", "Remove a domain, or all subdomains with *.domain, from the cache")
+	flag.String("cache-export", "", "Export all cache entries as JSON lines to a file (- for stdout)")
+	flag.String("cache-import", "", "Import cache entries from a JSON lines file (- for stdin)")
+	flag.String("import-mode", CACHE_IMPORT_MERGE, "How -cache-import treats existing entries: merge or replace")
+	flag.String("warm", "", "Look up the domains of a domain list, EXPORT file or postqueue -j output (- for stdin)")
+	flag.Int("warm-rate", WARM_DEFAULT_RATE, "Domains per second looked up by -warm")
+	flag.Bool("prefetch-status", false, "List upcoming prefetches with due time, retries and grace deadline")
+	flag.Int("prefetch-limit", PREFETCH_STATUS_DEFAULT_LIMIT, "Maximum number of prefetches listed by -prefetch-status")
 }
 
 func StartDaemon(v string, licenseText string) error {
@@ -332,13 +360,42 @@ func StartDaemon(v string, licenseText string) error {
 	if err := readEnv(); err != nil {
 		return err
 	}
-	polCache = cache.New[*CacheStruct](config.Server.CacheFile, time.Duration(600*time.Second))
+	cacheKey, err := config.Server.GetCacheKey()
+	if err != nil {
+		return err
+	}
+	if cacheKey != nil {
+		slog.Info("Cache file authentication enabled")
+	}
+	if config.Server.Mode == SERVER_MODE_SHADOW {
+		slog.Warn("Shadow mode enabled, evaluated policies are not returned to Postfix", "baseline", config.Server.ShadowBaseline)
+	}
+	for name, profile := range config.profiles {
+		if profile.mode == SERVER_MODE_SHADOW {
+			slog.Info("Shadow mode enabled for profile", "profile", name, "baseline", profile.shadowBaseline)
+		}
+	}
+	polCache, err = cache.New[*CacheStruct](config.Server.CacheFile, CACHE_SNAPSHOT_INTERVAL, cache.WithHMACKey(cacheKey))
+	if err != nil {
+		return fmt.Errorf("open cache: %w", err)
+	}
+	seedCachePopularity(polCache.Items(false))
 	_ = tidyCache()
+	configurePrefetchBudget(config.Prefetch)
 	daemonCtx, cancelDaemon := context.WithCancel(context.Background())
 	bgCtx = daemonCtx
 	defer cancelDaemon()
 	listenForSignals(daemonCtx, cancelDaemon)
 
+	var eventWg sync.WaitGroup
+	if events := newEventDispatcher(config.Events); events != nil {
+		activeEventDispatcher.Store(events)
+		eventWg.Add(1)
+		go func() {
+			defer eventWg.Done()
+			events.run(daemonCtx)
+		}()
+	}
 	var prefetchWg sync.WaitGroup
 	prefetchWg.Add(1)
 	go func() {
@@ -350,6 +407,7 @@ func StartDaemon(v string, licenseText string) error {
 	closeActiveConnections()
 	connectionWg.Wait()
 	prefetchWg.Wait()
+	eventWg.Wait()
 	_ = tidyCache()
 	cacheErr := polCache.CloseWithError()
 	return errors.Join(serverErr, cacheErr)
@@ -786,31 +844,19 @@ func startServer() error {
 	return nil
 }
 
-func tryCachedPolicy(conn net.Conn, domain string, withTlsRpt bool) (*CacheStruct, bool) {
+func tryCachedPolicy(conn net.Conn, domain string, profile *queryProfile) (*CacheStruct, bool) {
 	c, found := polCache.Get(domain)
 	if found {
-		policy, report, ttl, ok := selectCachedPolicy(c, time.Now())
+		policy, report, ttl, ok := profile.selectPolicy(domain, c, time.Now())
 		if ok {
-			var delivered bool
-			switch policy {
-			case "":
-				slog.Info("No policy found", "origin", "cache", "domain", domain, "ttl", ttl)
-				delivered = writeConnectionResponse(conn, NS_NOTFOUND)
-			default:
-				slog.Info("Evaluated policy", "origin", "cache", "domain", domain, "policy", firstWord(policy), "ttl", ttl)
-				var res string
-				if withTlsRpt {
-					res = policy + " " + report
-				} else {
-					res = policy
-				}
-				delivered = writeSocketmapReply(conn, "OK "+res)
-			}
-			if delivered {
-				observePolicy(policy)
-			}
+			replySocketmap(conn, "cache", domain, policy, report, ttl, profile)
 			observeCacheRequest(true)
+			now := time.Now()
+			wasIdle := prefetchIdle(domain, c, now)
 			addCacheHitCounter(domain)
+			if wasIdle {
+				scheduleCachedPolicyPrefetch(domain, c, now)
+			}
 			return c, true
 		}
 	}
@@ -820,6 +866,23 @@ func tryCachedPolicy(conn net.Conn, domain string, withTlsRpt bool) (*CacheStruc
 func addCacheHitCounter(domain string) {
 	counter, _ := cacheHitCounters.LoadOrStore(domain, &atomic.Uint32{})
 	counter.(*atomic.Uint32).Add(1)
+	cachePopularity.add(domain, 1)
+	cacheLastQueried.Store(domain, time.Now().UnixNano())
+}
+
+// cacheEntryLastQueried returns when domain was last queried, including cache
+// hits not yet flushed into c.
+func cacheEntryLastQueried(domain string, c *CacheStruct) time.Time {
+	var last time.Time
+	if c != nil {
+		last = c.LastQueried
+	}
+	if pending, ok := cacheLastQueried.Load(domain); ok {
+		if t := time.Unix(0, pending.(int64)); t.After(last) {
+			last = t
+		}
+	}
+	return last
 }
 
 func drainCacheHitCounter(domain string) uint32 {
@@ -858,14 +921,20 @@ func flushCacheHitCounters(haveLock bool) {
 			cleanupCacheHitCounterIfUnused(haveLock, domain)
 			return true
 		}
+		pending, hasPending := cacheLastQueried.Load(domain)
 		polCache.Update(haveLock, domain, func(c *CacheStruct, found bool) (*CacheStruct, bool) {
 			if !found || c == nil {
 				return nil, false
 			}
 			updated := cloneCacheStruct(c)
 			updated.Counter += delta
+			updated.LastQueried = cacheEntryLastQueried(domain, c)
 			return updated, true
 		})
+		if hasPending {
+			// Newer hits replaced the value and are flushed next time
+			cacheLastQueried.CompareAndDelete(domain, pending)
+		}
 		cleanupCacheHitCounterIfUnused(haveLock, domain)
 		return true
 	})
@@ -899,36 +968,73 @@ func cleanupCacheHitCounterIfUnused(haveLock bool, domain string) {
 	}
 	if counter.Load() == 0 {
 		cacheHitCounters.Delete(domain)
+		cacheLastQueried.Delete(domain)
 	}
 }
 
 func selectCachedPolicy(c *CacheStruct, now time.Time) (string, string, uint32, bool) {
+	policy, report, ttl, _, ok := selectCachedPolicySource(c, now)
+	return policy, report, ttl, ok
+}
+
+// selectServedPolicy is selectCachedPolicy with the opportunistic form of a
+// policy on probation and the policy rules of domain applied.
+func selectServedPolicy(domain string, c *CacheStruct, now time.Time) (string, string, uint32, bool) {
+	policy, report, ttl, _, ok := selectServedPolicySource(domain, c, now)
+	return policy, report, ttl, ok
+}
+
+// selectServedPolicySource is selectServedPolicy that also names where the
+// served policy came from: the branch as in selectCachedPolicySource,
+// "probation" if the opportunistic form of a policy on probation is served,
+// or "rule" if a rule decided it.
+func selectServedPolicySource(domain string, c *CacheStruct, now time.Time) (string, string, uint32, string, bool) {
+	cached, report, ttl, branch, ok := selectCachedPolicySource(c, now)
+	if !ok {
+		return cached, report, ttl, branch, false
+	}
+	source := branch
+	policy, report, ttl := applyPolicyProbation(c, cached, report, ttl, now)
+	if policy != cached {
+		source = "probation"
+	}
+	ruled, report, ttl, rule := applyPolicyRules(domain, c, policy, report, ttl, branch, now)
+	if rule != "" && ruled != policy {
+		source = "rule"
+	}
+	return ruled, report, ttl, source, true
+}
+
+// selectCachedPolicySource is selectCachedPolicy that also names the branch
+// the policy was taken from: "dane", "mta-sts" or "legacy" for entries
+// written before branches were cached.
+func selectCachedPolicySource(c *CacheStruct, now time.Time) (string, string, uint32, string, bool) {
 	if c == nil {
-		return "", "", 0, false
+		return "", "", 0, "", false
 	}
 	if !c.hasBranches() {
 		if c.Expirable == nil || c.Expirable.RemainingTTL(now) == 0 {
-			return "", "", 0, false
+			return "", "", 0, "", false
 		}
 		if c.Policy == "dane" || c.Policy == "dane-only" {
-			return c.Policy, c.Report, c.Expirable.RemainingTTL(now), true
+			return c.Policy, c.Report, c.Expirable.RemainingTTL(now), "legacy", true
 		}
-		return "", "", 0, false
+		return "", "", 0, "", false
 	}
 
 	daneTTL := c.Dane.RemainingTTL(now)
 	mtaStsTTL := c.MtaSts.RemainingTTL(now)
 	if daneTTL == 0 {
-		return "", "", 0, false
+		return "", "", 0, "", false
 	}
 	if c.Dane.Policy != "" {
-		return c.Dane.Policy, c.Dane.Report, daneTTL, true
+		return c.Dane.Policy, c.Dane.Report, daneTTL, "dane", true
 	}
 	if mtaStsTTL != 0 {
 		ttl := minPositive(daneTTL, mtaStsTTL)
-		return c.MtaSts.Policy, c.MtaSts.Report, ttl, true
+		return c.MtaSts.Policy, c.MtaSts.Report, ttl, "mta-sts", true
 	}
-	return "", "", 0, false
+	return "", "", 0, "", false
 }
 
 func minPositive(a uint32, b uint32) uint32 {
@@ -941,6 +1047,24 @@ func minPositive(a uint32, b uint32) uint32 {
 	return min(a, b)
 }
 
+// policyTTLType maps a policy to its cache.ttl key.
+func policyTTLType(policy string) string {
+	switch p := firstWord(policy); p {
+	case "":
+		return "none"
+	case "TEMP":
+		return "temp"
+	default:
+		return p
+	}
+}
+
+// clampPolicyTTL applies the cache.ttl bounds of the policy's type.
+func clampPolicyTTL(policy string, ttl uint32) uint32 {
+	lo, hi := config.Cache.TTL.bounds(policyTTLType(policy))
+	return min(max(ttl, lo), hi)
+}
+
 func normalizePolicyTTL(policy string, ttl uint32) (uint32, bool) {
 	if policy == "TEMP" {
 		return 0, false
@@ -948,12 +1072,13 @@ func normalizePolicyTTL(policy string, ttl uint32) (uint32, bool) {
 	if policy == "" && ttl == 0 {
 		ttl = CACHE_NOTFOUND_TTL
 	}
-	if ttl < CACHE_MIN_TTL {
-		ttl = CACHE_MIN_TTL
-	} else if ttl > CACHE_MAX_TTL {
-		ttl = CACHE_MAX_TTL
-	}
-	return ttl, true
+	return clampPolicyTTL(policy, ttl), true
+}
+
+// tempRetryInterval is how long a temporarily failed MTA-STS fetch is not
+// repeated, within the cache.ttl.temp bounds.
+func tempRetryInterval() time.Duration {
+	return time.Duration(clampPolicyTTL("TEMP", uint32(MTA_STS_FETCH_RETRY_INTERVAL/time.Second))) * time.Second
 }
 
 func branchFromResult(policy string, report string, ttl uint32) PolicyBranch {
@@ -975,9 +1100,13 @@ func mtaStsBranchFromResult(policy string, report string, ttl uint32) PolicyBran
 	if policy == "" && ttl == 0 {
 		ttl = CACHE_NOTFOUND_TTL
 	}
-	if ttl > CACHE_MAX_TTL {
-		ttl = CACHE_MAX_TTL
+	lo, hi := config.Cache.TTL.bounds(policyTTLType(policy))
+	if policy == "" && config.Cache.TTL.None.Min == nil {
+		// MTA-STS "none" results keep their own TTL unless a minimum is
+		// configured, as before cache.ttl existed
+		lo = 0
 	}
+	ttl = min(max(ttl, lo), hi)
 	return PolicyBranch{
 		Policy: policy,
 		Report: report,
@@ -1079,10 +1208,12 @@ type MtaStsPolicy struct {
 	TTL    uint32  `json:"ttl"`
 }
 type Result struct {
-	Version string       `json:"version"`
-	Domain  string       `json:"domain"`
-	Dane    DanePolicy   `json:"dane"`
-	MtaSts  MtaStsPolicy `json:"mta-sts"`
+	Probation *InspectProbation `json:"probation,omitempty"` // of the cached entry
+	Version   string            `json:"version"`
+	Domain    string            `json:"domain"`
+	Unicode   string            `json:"unicode,omitempty"` // of an internationalized domain
+	Dane      DanePolicy        `json:"dane"`
+	MtaSts    MtaStsPolicy      `json:"mta-sts"`
 }
 
 func replyJson(ctx context.Context, conn net.Conn, domain string) {
@@ -1112,6 +1243,7 @@ func replyJson(ctx context.Context, conn net.Conn, domain string) {
 	r := Result{
 		Version: Version,
 		Domain:  domain,
+		Unicode: domainToUnicode(domain),
 		Dane: DanePolicy{
 			Policy: dPol,
 			TTL:    dTTL,
@@ -1124,6 +1256,9 @@ func replyJson(ctx context.Context, conn net.Conn, domain string) {
 			Time:   tc.Sub(ta).Truncate(time.Millisecond).Seconds(),
 		},
 	}
+	if c, found := polCache.Get(domain); found {
+		r.Probation = inspectProbation(c, time.Now())
+	}
 
 	b, err := json.Marshal(r)
 	if err != nil {
@@ -1134,19 +1269,40 @@ func replyJson(ctx context.Context, conn net.Conn, domain string) {
 	writeConnectionResponse(conn, append(b, '\n'))
 }
 
-func replySocketmap(conn net.Conn, domain string, policy string, report string, ttl uint32, withTlsRpt bool) {
+// replySocketmap answers a query with the policy evaluated from origin,
+// "cache" or "network", or in shadow mode with the shadow baseline.
+func replySocketmap(conn net.Conn, origin string, domain string, policy string, report string, ttl uint32, profile *queryProfile) {
+	if profile.mode == SERVER_MODE_SHADOW {
+		replyShadowBaseline(conn, origin, domain, policy, ttl, profile.shadowBaseline)
+		return
+	}
+	if policy != "TEMP" {
+		resetLookupFailures(domain)
+	}
 	var delivered bool
 	switch policy {
 	case "":
-		slog.Info("No policy found", "origin", "network", "domain", domain, "ttl", ttl)
+		slog.Info("No policy found", "origin", origin, "domain", domain, "ttl", ttl)
 		delivered = writeConnectionResponse(conn, NS_NOTFOUND)
 	case "TEMP":
-		slog.Warn("Evaluating policy failed temporarily", "origin", "network", "domain", domain, "ttl", ttl)
-		delivered = writeConnectionResponse(conn, NS_TEMP)
+		fallback, failures := failureFallback(profile.failurePolicyConfig(), domain)
+		slog.Warn("Evaluating policy failed temporarily", "origin", origin, "domain", domain, "ttl", ttl, "failures", failures, "failure_policy", fallback)
+		switch fallback {
+		case "notfound":
+			delivered = writeConnectionResponse(conn, NS_NOTFOUND)
+		case "encrypt", "may":
+			delivered = writeSocketmapReply(conn, "OK "+fallback)
+		default:
+			delivered = writeConnectionResponse(conn, NS_TEMP)
+		}
+		if delivered {
+			observeFailureFallback(fallback)
+		}
+		return
 	default:
-		slog.Info("Evaluated policy", "origin", "network", "domain", domain, "policy", firstWord(policy), "ttl", ttl)
-		res := policy
-		if withTlsRpt {
+		slog.Info("Evaluated policy", "origin", origin, "domain", domain, "policy", firstWord(policy), "ttl", ttl)
+		res, report := mapPolicy(profile.policyMappingConfig(), domain, policy, report)
+		if profile.tlsRpt {
 			res = res + " " + report
 		}
 		delivered = writeSocketmapReply(conn, "OK "+res)
@@ -1156,6 +1312,26 @@ func replySocketmap(conn net.Conn, domain string, policy string, report string,
 	}
 }
 
+// replyShadowBaseline logs and counts the evaluated policy and gives Postfix
+// the shadow baseline instead, or no policy without one.
+func replyShadowBaseline(conn net.Conn, origin string, domain string, policy string, ttl uint32, baseline string) {
+	var delivered bool
+	if baseline == "" {
+		delivered = writeConnectionResponse(conn, NS_NOTFOUND)
+	} else {
+		delivered = writeSocketmapReply(conn, "OK "+baseline)
+	}
+	if !delivered {
+		return
+	}
+	observeShadowPolicy(policy)
+	evaluated := firstWord(policy)
+	if evaluated == "" {
+		evaluated = "none"
+	}
+	slog.Info("Shadow policy", "origin", origin, "domain", domain, "policy", evaluated, "ttl", ttl, "served", firstWord(baseline))
+}
+
 func writeConnectionResponse(conn net.Conn, response []byte) bool {
 	if err := writeConnection(conn, response); err != nil {
 		slog.Debug("Could not write connection response", "error", err)
@@ -1327,35 +1503,79 @@ func handleSocketmapConnection(conn net.Conn, reader *bufio.Reader) {
 			writeConnectionResponse(conn, NS_PERM)
 			return
 		}
-		withTlsRpt := config.Server.TlsRpt
+		profile := defaultQueryProfile(config.Server.TlsRpt)
 		switch cmd {
 		case "QUERYWITHTLSRPT": // QUERYwithTLSRPT
-			withTlsRpt = true
+			profile.tlsRpt = true
 			addMetricQuery()
 		case "QUERY":
 			addMetricQuery()
 		case "JSON":
 		case "DUMP":
-			dumpCachedPolicies(conn, false)
+			if hasArgument {
+				dumpCachedPoliciesAs(conn, argument)
+			} else {
+				dumpCachedPolicies(conn, false)
+			}
 			return
 		case "EXPORT":
 			dumpCachedPolicies(conn, true)
 			return
 		case "PURGE":
-			purgeCache(conn)
+			if hasArgument {
+				purgeCacheDomains(conn, argument)
+			} else {
+				purgeCache(conn)
+			}
 			return
-		default:
-			slog.Warn("Unknown command", "query", query)
-			writeConnectionResponse(conn, NS_PERM)
+		case "INSPECT", "REFRESH":
+			if !hasArgument {
+				writeConnectionResponse(conn, NS_NOTFOUND)
+				return
+			}
+			inspectCachedDomain(conn, argument, cmd == "REFRESH")
+			return
+		case "CACHEEXPORT":
+			exportCache(conn)
+			return
+		case "CACHEIMPORT":
+			importCache(conn, reader, argument)
 			return
+		case "WARM":
+			warmCacheFromConnection(conn, reader, argument)
+			return
+		case "PREFETCH":
+			reportPrefetchStatus(conn, argument)
+			return
+		case "HISTORY":
+			if !hasArgument {
+				writeConnectionResponse(conn, NS_NOTFOUND)
+				return
+			}
+			reportPolicyHistory(conn, argument)
+			return
+		case "RULESTEST":
+			if !hasArgument {
+				writeConnectionResponse(conn, NS_NOTFOUND)
+				return
+			}
+			reportRulesTest(conn, argument)
+			return
+		default:
+			if profile = config.profiles[cmd]; profile == nil {
+				slog.Warn("Unknown command", "query", query)
+				writeConnectionResponse(conn, NS_PERM)
+				return
+			}
+			addMetricQuery()
 		}
 		if !hasArgument { // empty query
 			writeConnectionResponse(conn, NS_NOTFOUND)
 			continue
 		}
 
-		domain := normalizeDomain(argument)
-		if !valid.IsDNSName(domain) || strings.HasPrefix(domain, ".") {
+		domain, ok := normalizePolicyKey(argument)
+		if !ok {
 			writeConnectionResponse(conn, NS_NOTFOUND)
 			continue
 		}
@@ -1367,7 +1587,7 @@ func handleSocketmapConnection(conn net.Conn, reader *bufio.Reader) {
 			continue
 		}
 
-		c, found := tryCachedPolicy(conn, domain, withTlsRpt)
+		c, found := tryCachedPolicy(conn, domain, profile)
 		if found {
 			continue
 		}
@@ -1375,26 +1595,58 @@ func handleSocketmapConnection(conn net.Conn, reader *bufio.Reader) {
 
 		result := refreshDomain(domain, c)
 
-		replySocketmap(conn, domain, result.Policy, result.Report, result.TTL, withTlsRpt)
-
-		if result.TTL != 0 || result.Dane.HasData() || result.MtaSts.HasData() ||
-			(c != nil && (result.DaneAttempted || result.MtaStsAttempted)) {
-			now := time.Now()
-			cs := mergeCacheResult(c, result, now)
-			cs.Counter += drainCacheHitCounter(domain) + 1
-			polCache.Set(domain, cs)
-			enforceCacheLimit()
-			if _, _, _, ok := selectCachedPolicy(cs, now); ok {
-				resetCachedPolicyPrefetchFailures(domain)
+		policy, report, ttl := result.Policy, result.Report, result.TTL
+		if cs, stored := storeDomainResult(domain, c, result, 1); stored && (cs.Pin != nil || cs.Probation != nil || config.rules != nil || profile.branches != PROFILE_BRANCHES_BOTH) {
+			// Serve the pinned policy, not the downgrade that was just held
+			// back, the opportunistic form of a policy on probation, the
+			// policy selected by a rule, or the branch of the profile
+			served, servedReport, servedTTL, ok := profile.selectPolicy(domain, cs, time.Now())
+			if ok || profile.branches == PROFILE_BRANCHES_BOTH {
+				policy, report, ttl = served, servedReport, servedTTL
+			} else if policy != "TEMP" {
+				policy, report, ttl = "", "", 0
 			}
-			scheduleCachedPolicyPrefetch(domain, cs, now)
 		}
+		replySocketmap(conn, "network", domain, policy, report, ttl, profile)
 	}
 }
 
+// storeDomainResult merges a lookup result into the cached entry c, adds hits
+// to its counter and schedules the next prefetch. It reports whether the
+// result was cached.
+func storeDomainResult(domain string, c *CacheStruct, result domainResult, hits uint32) (*CacheStruct, bool) {
+	if result.TTL == 0 && !result.Dane.HasData() && !result.MtaSts.HasData() &&
+		(c == nil || !result.DaneAttempted && !result.MtaStsAttempted) {
+		return c, false
+	}
+	now := time.Now()
+	cs := holdPolicyDowngrade(domain, c, mergeCacheResult(c, result, now), now)
+	cachePopularity.add(domain, hits)
+	// Lookups requested with the REFRESH and WARM commands bypass admission
+	if c == nil && hits > 0 && !admitCacheEntry(domain, cs) {
+		observeCacheEviction("admission")
+		return c, false
+	}
+	updatePolicyProbation(domain, c, cs, now)
+	recordPolicyHistory(domain, c, cs, "lookup", now)
+	notifyPolicyChange(domain, c, cs, "lookup", now)
+	cs.Counter += drainCacheHitCounter(domain) + hits
+	cs.LastQueried = cacheEntryLastQueried(domain, cs)
+	if hits > 0 || cs.LastQueried.IsZero() {
+		cs.LastQueried = now
+	}
+	polCache.Set(domain, cs)
+	enforceCacheLimit()
+	if _, _, _, ok := selectCachedPolicy(cs, now); ok {
+		resetCachedPolicyPrefetchFailures(domain)
+	}
+	scheduleCachedPolicyPrefetch(domain, cs, now)
+	return cs, true
+}
+
 func canonicalSocketmapCommand(command string) string {
 	switch command {
-	case "QUERYWITHTLSRPT", "QUERY", "JSON", "DUMP", "EXPORT", "PURGE":
+	case "QUERYWITHTLSRPT", "QUERY", "JSON", "DUMP", "EXPORT", "PURGE", "CACHEEXPORT", "CACHEIMPORT", "INSPECT", "REFRESH", "WARM", "PREFETCH", "HISTORY", "RULESTEST":
 		return command
 	}
 	return strings.ToUpper(command)
@@ -1402,7 +1654,7 @@ func canonicalSocketmapCommand(command string) string {
 
 func isControlCommand(cmd string) bool {
 	switch cmd {
-	case "JSON", "DUMP", "EXPORT", "PURGE":
+	case "JSON", "DUMP", "EXPORT", "PURGE", "CACHEEXPORT", "CACHEIMPORT", "INSPECT", "REFRESH", "WARM", "PREFETCH", "HISTORY", "RULESTEST":
 		return true
 	default:
 		return false
@@ -1445,6 +1697,7 @@ var prefetchDomainOnce = prefetchDomainOnceImpl
 type queryBranchOptions struct {
 	renewBefore uint32
 	prefetch    bool
+	allowance   *prefetchAllowance
 }
 
 type policyLookupLogContextKey struct{}
@@ -1453,8 +1706,13 @@ func withPrefetchPolicyLookupLogging(ctx context.Context) context.Context {
 	return context.WithValue(ctx, policyLookupLogContextKey{}, true)
 }
 
+func isPrefetchLookup(ctx context.Context) bool {
+	prefetch, _ := ctx.Value(policyLookupLogContextKey{}).(bool)
+	return prefetch
+}
+
 func policyLookupLogLevel(ctx context.Context) slog.Level {
-	if prefetch, _ := ctx.Value(policyLookupLogContextKey{}).(bool); prefetch {
+	if isPrefetchLookup(ctx) {
 		return slog.LevelDebug
 	}
 	return slog.LevelWarn
@@ -1464,8 +1722,9 @@ func logPolicyLookupFailure(ctx context.Context, message string, args ...any) {
 	slog.Log(ctx, policyLookupLogLevel(ctx), message, args...)
 }
 
+// normalizeDomain lowercases domain and converts its U-labels to A-labels.
 func normalizeDomain(domain string) string {
-	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	return domainToASCII(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), "."))
 }
 
 func queryDomain(domain string) domainResult {
@@ -1490,14 +1749,15 @@ func refreshDomainOnceImpl(domain string, c *CacheStruct) domainResult {
 	return queryDomainBranches(domain, c, time.Now())
 }
 
-func prefetchDomain(domain string, c *CacheStruct) domainResult {
-	return prefetchDomainOnce(domain, c)
+func prefetchDomain(domain string, c *CacheStruct, allowance *prefetchAllowance) domainResult {
+	return prefetchDomainOnce(domain, c, allowance)
 }
 
-func prefetchDomainOnceImpl(domain string, c *CacheStruct) domainResult {
+func prefetchDomainOnceImpl(domain string, c *CacheStruct, allowance *prefetchAllowance) domainResult {
 	return queryDomainBranchesWithOptions(domain, c, time.Now(), queryBranchOptions{
 		renewBefore: PREFETCH_INTERVAL,
 		prefetch:    true,
+		allowance:   allowance,
 	})
 }
 
@@ -1537,6 +1797,9 @@ func queryDomainBranchesWithOptions(domain string, c *CacheStruct, now time.Time
 	if opts.prefetch {
 		ctx = withPrefetchPolicyLookupLogging(ctx)
 	}
+	if opts.allowance != nil {
+		ctx = withPrefetchAllowance(ctx, opts.allowance)
+	}
 	var wg sync.WaitGroup
 	var (
 		danePolicy        string
@@ -1557,7 +1820,9 @@ func queryDomainBranchesWithOptions(domain string, c *CacheStruct, now time.Time
 		daneForQuery = branchForQuerySuppression(daneForSelection, opts.renewBefore)
 	}
 
-	queryDane := shouldQueryDane(c, daneForQuery, mtaStsForQuery, now, opts.renewBefore)
+	resolver := currentResolverIdentity()
+	queryDane := shouldQueryDane(c, daneForQuery, mtaStsForQuery, now, opts.renewBefore) ||
+		c != nil && daneNeedsRevalidation(c.Dane, resolver)
 	queryMtaSts := shouldQueryMtaSts(c, daneForQuery, mtaStsForQuery, now, opts.renewBefore)
 
 	switch {
@@ -1593,6 +1858,8 @@ func queryDomainBranchesWithOptions(domain string, c *CacheStruct, now time.Time
 			mtaStsForSelected = candidate
 		}
 	}
+	refreshedDane = withResolverProvenance(refreshedDane, resolver)
+	refreshedMtaSts = withResolverProvenance(refreshedMtaSts, resolver)
 	policy, report, ttl := selectedPolicyFromBranches(daneForSelection, mtaStsForSelected, daneTemp)
 	return domainResult{
 		Policy:          policy,
@@ -1639,7 +1906,7 @@ func shouldQueryMtaSts(c *CacheStruct, daneForSelection PolicyBranch, mtaStsForS
 	if mtaStsForSelection.HasData() {
 		return false
 	}
-	if c != nil && !c.MtaStsLastAttempt.IsZero() && now.Before(c.MtaStsLastAttempt.Add(MTA_STS_FETCH_RETRY_INTERVAL)) {
+	if c != nil && !c.MtaStsLastAttempt.IsZero() && now.Before(c.MtaStsLastAttempt.Add(tempRetryInterval())) {
 		return false
 	}
 	if c != nil && c.Dane.Policy != "" && beforeBranchRecheck(c.MtaStsLastAttempt, now, renewBefore) {
@@ -1659,10 +1926,11 @@ func dumpCachedPolicies(conn net.Conn, export bool) {
 	}()
 	now := time.Now()
 	for i, entry := range items {
-		policy, _, remainingTTL, ok := selectCachedPolicy(entry.Value, now)
-		if !ok || policy == "" || remainingTTL < PREFETCH_INTERVAL+1 {
+		policy, _, remainingTTL, ok := selectServedPolicy(entry.Key, entry.Value, now)
+		if !ok || policy == "" || policy == "TEMP" || remainingTTL < PREFETCH_INTERVAL+1 {
 			continue
 		}
+		policy, _ = mapPolicy(&config.PolicyMapping, entry.Key, policy, "")
 		var err error
 		if export {
 			_, err = fmt.Fprintf(writer, "%-28s %s\n", entry.Key, policy)
@@ -1718,6 +1986,7 @@ func tidyCache() []cache.Entry[*CacheStruct] {
 		current, removed := removeCacheEntryIfCurrent(entry.Key, entry.Value)
 		if removed {
 			pruned++
+			observeCacheEviction("capacity")
 			cacheHitCounters.Delete(entry.Key)
 			unscheduleCachedPolicyPrefetch(entry.Key)
 		} else if current != nil {
@@ -1746,12 +2015,6 @@ func enforceCacheLimit() {
 	}
 }
 
-type cacheEvictionScore struct {
-	counter   uint32
-	ttl       uint32
-	hasPolicy bool
-}
-
 type cacheCounterSorter struct {
 	entries  []cache.Entry[*CacheStruct]
 	counters []uint32
@@ -1782,50 +2045,6 @@ func sortCacheEntriesByCounter(entries []cache.Entry[*CacheStruct]) []uint32 {
 	return counters
 }
 
-type cacheEntrySorter struct {
-	entries []cache.Entry[*CacheStruct]
-	scores  []cacheEvictionScore
-}
-
-func (s cacheEntrySorter) Len() int {
-	return len(s.entries)
-}
-
-func (s cacheEntrySorter) Less(i int, j int) bool {
-	if s.scores[i].hasPolicy != s.scores[j].hasPolicy {
-		return !s.scores[i].hasPolicy
-	}
-	if s.scores[i].counter != s.scores[j].counter {
-		return s.scores[i].counter < s.scores[j].counter
-	}
-	if s.scores[i].ttl != s.scores[j].ttl {
-		return s.scores[i].ttl < s.scores[j].ttl
-	}
-	return s.entries[i].Key < s.entries[j].Key
-}
-
-func (s cacheEntrySorter) Swap(i int, j int) {
-	s.entries[i], s.entries[j] = s.entries[j], s.entries[i]
-	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
-}
-
-func partitionCacheEntriesForLimit(entries []cache.Entry[*CacheStruct], now time.Time, maxEntries int, targetEntries int) ([]cache.Entry[*CacheStruct], []cache.Entry[*CacheStruct]) {
-	if len(entries) <= maxEntries {
-		return entries, nil
-	}
-	scores := make([]cacheEvictionScore, len(entries))
-	for i, entry := range entries {
-		scores[i] = cacheEvictionScore{
-			counter:   cacheEntryCounter(entry.Key, entry.Value),
-			ttl:       entry.Value.RemainingTTL(now),
-			hasPolicy: cacheStructHasPolicy(entry.Value),
-		}
-	}
-	sort.Sort(cacheEntrySorter{entries: entries, scores: scores})
-	evictCount := len(entries) - targetEntries
-	return entries[evictCount:], entries[:evictCount]
-}
-
 func firstWord(s string) string {
 	for i := 0; i < len(s); i++ {
 		if s[i] == ' ' {
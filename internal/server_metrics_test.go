@@ -17,6 +17,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -159,6 +160,8 @@ func clearCacheHitCountersForTest() {
 		cacheHitCounters.Delete(key)
 		return true
 	})
+	cacheLastQueried.Clear()
+	cachePopularity = newPopularitySketch(CACHE_MAX_ENTRIES)
 }
 
 func (a staticAddr) Network() string {
@@ -349,6 +352,8 @@ func TestBuildMetricsTextIncludesExpectedMetrics(t *testing.T) {
 	metricPrefetchOK.Store(5)
 	metricPrefetchFail.Store(3)
 	metricPrefetchDrop.Store(1)
+	metricEvictCapacity.Store(6)
+	metricEvictAdmission.Store(2)
 
 	metrics := buildMetricsText()
 	for _, expected := range []string{
@@ -357,12 +362,21 @@ func TestBuildMetricsTextIncludesExpectedMetrics(t *testing.T) {
 		"postfix_tlspol_policy_total{policy=\"dane-only\"} 3",
 		"postfix_tlspol_policy_total{policy=\"secure\"} 4",
 		"postfix_tlspol_policy_total{policy=\"no-policy\"} 9",
+		"postfix_tlspol_shadow_policy_total{policy=\"temp\"} ",
+		"postfix_tlspol_failure_fallbacks_total{policy=\"notfound\"} ",
 		"postfix_tlspol_cache_requests_total{result=\"hit\"} 10",
 		"postfix_tlspol_cache_requests_total{result=\"miss\"} 2",
 		"postfix_tlspol_cache_entries 0",
 		"postfix_tlspol_prefetch_total{result=\"success\"} 5",
 		"postfix_tlspol_prefetch_total{result=\"failure\"} 3",
 		"postfix_tlspol_prefetch_total{result=\"discard\"} 1",
+		"postfix_tlspol_cache_evictions_total{reason=\"capacity\"} 6",
+		"postfix_tlspol_cache_evictions_total{reason=\"admission\"} 2",
+		"postfix_tlspol_prefetch_queue_length 0",
+		"postfix_tlspol_prefetch_overdue 0",
+		"postfix_tlspol_policy_events_total{event=\"downgrade\"} ",
+		"postfix_tlspol_event_delivery_failures_total{sink=\"webhook\"} ",
+		"postfix_tlspol_prefetch_batch_duration_seconds_bucket{le=\"+Inf\"} ",
 		"postfix_tlspol_go_goroutines ",
 	} {
 		if !strings.Contains(metrics, expected) {
@@ -754,7 +768,7 @@ func TestPolicyCacheClosePersistsCacheDB(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "cache.db")
 	now := time.Now()
 
-	c1 := cache.New[*CacheStruct](tmpFile, time.Hour)
+	c1 := newTestPolicyCache(t, tmpFile)
 	c1.Set("example.org", &CacheStruct{
 		Expirable: &cache.Expirable{ExpiresAt: now.Add(5 * time.Minute)},
 		Policy:    "dane",
@@ -772,7 +786,7 @@ func TestPolicyCacheClosePersistsCacheDB(t *testing.T) {
 		t.Fatalf("expected cache.db to be saved on close: %v", err)
 	}
 
-	c2 := cache.New[*CacheStruct](tmpFile, time.Hour)
+	c2 := newTestPolicyCache(t, tmpFile)
 	defer c2.Close()
 
 	got, ok := c2.Get("example.org")
@@ -793,7 +807,7 @@ func TestTidyCacheRemovesExpiredNoPolicyAndOldStalePolicy(t *testing.T) {
 	}()
 
 	config.Server.CacheFile = filepath.Join(t.TempDir(), "cache.db")
-	polCache = cache.New[*CacheStruct](config.Server.CacheFile, time.Hour)
+	polCache = newTestPolicyCache(t, config.Server.CacheFile)
 	defer polCache.Close()
 
 	now := time.Now()
@@ -913,7 +927,7 @@ func TestSortCacheEntriesByCounter(t *testing.T) {
 
 func TestCacheMaintenancePreservesConcurrentReplacement(t *testing.T) {
 	oldPolCache := polCache
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	defer func() {
 		polCache.Close()
 		polCache = oldPolCache
@@ -1011,7 +1025,7 @@ func TestTryCachedPolicyDoesNotRewriteCacheEntry(t *testing.T) {
 	}()
 
 	config.Server.CacheFile = filepath.Join(t.TempDir(), "cache.db")
-	polCache = cache.New[*CacheStruct](config.Server.CacheFile, time.Hour)
+	polCache = newTestPolicyCache(t, config.Server.CacheFile)
 	defer polCache.Close()
 
 	original := &CacheStruct{
@@ -1032,7 +1046,7 @@ func TestTryCachedPolicyDoesNotRewriteCacheEntry(t *testing.T) {
 		close(done)
 	}()
 
-	updated, ok := tryCachedPolicy(c1, "example.com", false)
+	updated, ok := tryCachedPolicy(c1, "example.com", defaultQueryProfile(false))
 	c1.Close()
 	c2.Close()
 	<-done
@@ -1061,7 +1075,7 @@ func TestTryCachedPolicyDoesNotRewriteCacheEntry(t *testing.T) {
 func TestCacheHitCounterCleanupRequiresZeroAndNoCachedPolicy(t *testing.T) {
 	oldPolCache := polCache
 	clearCacheHitCountersForTest()
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	defer func() {
 		polCache.Close()
 		polCache = oldPolCache
@@ -1103,7 +1117,7 @@ func TestCacheHitCounterCleanupRequiresZeroAndNoCachedPolicy(t *testing.T) {
 func TestTidyCacheRemovesUnusedHitCounterAfterPolicyDiscard(t *testing.T) {
 	oldPolCache := polCache
 	clearCacheHitCountersForTest()
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	defer func() {
 		polCache.Close()
 		polCache = oldPolCache
@@ -1132,7 +1146,7 @@ func TestTidyCacheRemovesUnusedHitCounterAfterPolicyDiscard(t *testing.T) {
 func TestPurgeCacheRemovesFlushedHitCounters(t *testing.T) {
 	oldPolCache := polCache
 	clearCacheHitCountersForTest()
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	defer func() {
 		polCache.Close()
 		polCache = oldPolCache
@@ -1445,7 +1459,7 @@ func TestPrefetchDomainRenewsNearExpiryMtaStsBranch(t *testing.T) {
 	}
 
 	mtaStsCalls.Store(0)
-	prefetch := prefetchDomainOnceImpl("example.com", cached)
+	prefetch := prefetchDomainOnceImpl("example.com", cached, nil)
 	if mtaStsCalls.Load() != 1 || !prefetch.MtaStsAttempted || !prefetch.MtaSts.HasData() {
 		t.Fatalf("expected prefetch to renew near-expiry MTA-STS, calls=%d result=%+v", mtaStsCalls.Load(), prefetch)
 	}
@@ -1511,7 +1525,7 @@ func TestPrefetchDomainRetainsUnexpiredMtaStsWhenLivePolicyUnavailable(t *testin
 			checkMtaStsPolicy = func(context.Context, string, bool) (string, string, uint32) {
 				return tt.policy, "", tt.ttl
 			}
-			result := prefetchDomainOnceImpl("example.com", cached)
+			result := prefetchDomainOnceImpl("example.com", cached, nil)
 			if result.Policy != cached.MtaSts.Policy || result.Report != cached.MtaSts.Report {
 				t.Fatalf("expected cached policy to remain selected, got %+v", result)
 			}
@@ -1524,7 +1538,7 @@ func TestPrefetchDomainRetainsUnexpiredMtaStsWhenLivePolicyUnavailable(t *testin
 	checkMtaStsPolicy = func(context.Context, string, bool) (string, string, uint32) {
 		return "", "", 600 // A valid mode=none/testing policy has a nonzero max_age.
 	}
-	result := prefetchDomainOnceImpl("example.com", cached)
+	result := prefetchDomainOnceImpl("example.com", cached, nil)
 	if result.Policy != "" || !result.MtaSts.HasData() || result.MtaSts.TTL != 600 {
 		t.Fatalf("expected valid no-enforcement policy to replace cached branch, got %+v", result)
 	}
@@ -1976,7 +1990,7 @@ func TestPrefetchDuePoliciesExtendsNearExpiryMtaSts(t *testing.T) {
 	oldSemaphore := semaphore
 	origDane := checkDanePolicy
 	origMtaSts := checkMtaStsPolicy
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	scheduler := newPrefetchScheduler()
 	activePrefetchScheduler.Store(scheduler)
 	semaphore = make(chan struct{}, 1)
@@ -2039,7 +2053,7 @@ func TestPrefetchDuePoliciesBacksOffNearExpiryMtaStsFailure(t *testing.T) {
 	oldSemaphore := semaphore
 	origDane := checkDanePolicy
 	origMtaSts := checkMtaStsPolicy
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	scheduler := newPrefetchScheduler()
 	activePrefetchScheduler.Store(scheduler)
 	semaphore = make(chan struct{}, 1)
@@ -2145,7 +2159,7 @@ func TestPrefetchRetryBackoffAndDiscardDeadline(t *testing.T) {
 
 func TestScheduleFailedPolicyPrefetchDiscardsCacheAfterRetryWindow(t *testing.T) {
 	oldPolCache := polCache
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	defer func() {
 		polCache.Close()
 		polCache = oldPolCache
@@ -2185,7 +2199,7 @@ func TestScheduleFailedPolicyPrefetchDiscardsCacheAfterRetryWindow(t *testing.T)
 
 func TestScheduleFailedPolicyPrefetchPreservesStatsOnDiscard(t *testing.T) {
 	oldPolCache := polCache
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	defer func() {
 		polCache.Close()
 		polCache = oldPolCache
@@ -2226,7 +2240,7 @@ func TestScheduleFailedPolicyPrefetchPreservesStatsOnDiscard(t *testing.T) {
 
 func TestScheduleFailedPolicyPrefetchKeepsFormerDaneDuringGrace(t *testing.T) {
 	oldPolCache := polCache
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	defer func() {
 		polCache.Close()
 		polCache = oldPolCache
@@ -2272,7 +2286,7 @@ func TestScheduleFailedPolicyPrefetchKeepsFormerDaneDuringGrace(t *testing.T) {
 
 func TestScheduleFailedPolicyPrefetchClearsFormerDaneAfterGrace(t *testing.T) {
 	oldPolCache := polCache
-	polCache = cache.New[*CacheStruct](filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	polCache = newTestPolicyCache(t, filepath.Join(t.TempDir(), "cache.db"))
 	defer func() {
 		polCache.Close()
 		polCache = oldPolCache
@@ -2316,3 +2330,82 @@ func TestScheduleFailedPolicyPrefetchClearsFormerDaneAfterGrace(t *testing.T) {
 		t.Fatalf("expected selected policy to switch to cached MTA-STS, got %q", stored.Policy)
 	}
 }
+
+func TestIdleDomainsStopPrefetchingUntilQueriedAgain(t *testing.T) {
+	useTestPolicyCache(t)
+	original := config
+	t.Cleanup(func() { config = original })
+	config.Prefetch.IdleWindow = 3600
+
+	now := time.Now()
+	oldScheduler := activePrefetchScheduler.Load()
+	scheduler := newPrefetchSchedulerAt(now, 7)
+	activePrefetchScheduler.Store(scheduler)
+	t.Cleanup(func() { activePrefetchScheduler.Store(oldScheduler) })
+
+	entry := func(lastQueried time.Time) *CacheStruct {
+		return &CacheStruct{
+			Expirable:   &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+			Policy:      "dane-only",
+			TTL:         3600,
+			Dane:        PolicyBranch{Policy: "dane-only", TTL: 3600, ExpiresAt: now.Add(time.Hour)},
+			LastQueried: lastQueried,
+		}
+	}
+	for domain, lastQueried := range map[string]time.Time{
+		"idle.example":   now.Add(-2 * time.Hour),
+		"active.example": now.Add(-10 * time.Minute),
+		"legacy.example": {},
+	} {
+		c := entry(lastQueried)
+		polCache.Set(domain, c)
+		scheduleCachedPolicyPrefetch(domain, c, now)
+	}
+	if _, _, ok := scheduler.status("idle.example"); ok {
+		t.Fatal("expected idle domain not to be scheduled")
+	}
+	for _, domain := range []string{"active.example", "legacy.example"} {
+		if _, _, ok := scheduler.status(domain); !ok {
+			t.Fatalf("expected %s to be scheduled", domain)
+		}
+	}
+
+	conn := newSecurityTestConn(nil, &net.UnixAddr{Name: "@", Net: "unix"})
+	if _, found := tryCachedPolicy(conn, "idle.example", defaultQueryProfile(false)); !found {
+		t.Fatal("expected idle domain to be served from cache")
+	}
+	if _, _, ok := scheduler.status("idle.example"); !ok {
+		t.Fatal("expected a cache hit to resume prefetching")
+	}
+	flushCacheHitCounters(false)
+	if c, _ := polCache.Get("idle.example"); time.Since(c.LastQueried) > time.Minute {
+		t.Fatalf("expected last query time to be flushed, got %s", c.LastQueried)
+	}
+}
+
+func TestDeferExcessKeepsPopularDomains(t *testing.T) {
+	clearCacheHitCountersForTest()
+	t.Cleanup(clearCacheHitCountersForTest)
+	now := time.Now()
+	scheduler := newPrefetchSchedulerAt(now, 9)
+	cachePopularity.add("popular.example", 8)
+	cachePopularity.add("warm.example", 3)
+
+	due := scheduler.batchAtOrAfter(now)
+	for _, domain := range []string{"cold.example", "warm.example", "popular.example"} {
+		scheduler.schedule(domain, due)
+	}
+	keys := scheduler.popDue(due)
+	if !slices.Equal(keys, []string{"popular.example", "warm.example", "cold.example"}) {
+		t.Fatalf("expected items due together to pop by popularity, got %v", keys)
+	}
+
+	kept := scheduler.deferExcess([]string{"cold.example", "warm.example", "popular.example"}, 2, now)
+	if !slices.Equal(kept, []string{"popular.example", "warm.example"}) {
+		t.Fatalf("unexpected kept domains %v", kept)
+	}
+	next, _, ok := scheduler.status("cold.example")
+	if !ok || !next.After(now) || next.Before(now.Add(PREFETCH_SLOT_INTERVAL)) {
+		t.Fatalf("expected least popular domain in the next batch, got %s (%v)", next, ok)
+	}
+}
@@ -76,7 +76,7 @@ func TestHandleSocketmapRejectsInvalidJSONDomain(t *testing.T) {
 }
 
 func TestHandleSocketmapRejectsRemoteControlCommands(t *testing.T) {
-	for _, query := range []string{"JSON example.com", "DUMP", "EXPORT", "PURGE"} {
+	for _, query := range []string{"JSON example.com", "DUMP", "EXPORT", "PURGE", "CACHEEXPORT", "CACHEIMPORT merge", "INSPECT example.com", "REFRESH example.com", "PURGE example.com", "WARM", "DUMP JSON", "PREFETCH", "HISTORY example.com", "RULESTEST example.com"} {
 		t.Run(strings.Fields(query)[0], func(t *testing.T) {
 			conn := newSecurityTestConn(nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 12345})
 			handleSocketmapConnection(conn, bufio.NewReader(bytes.NewReader(netstring.Marshal(query))))
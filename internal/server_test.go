@@ -9,6 +9,9 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
 )
 
 func init() {
@@ -58,6 +61,33 @@ func liveNetworkTestsEnabled() bool {
 	return os.Getenv("TLSPOL_LIVE_TESTS") != "0"
 }
 
+func newTestPolicyCache(t *testing.T, path string) *cache.Cache[*CacheStruct] {
+	t.Helper()
+	c, err := cache.New[*CacheStruct](path, time.Hour)
+	if err != nil {
+		t.Fatalf("open policy cache: %v", err)
+	}
+	return c
+}
+
+// patchConfigForTest changes the configuration with patch until t ends.
+func patchConfigForTest(t *testing.T, patch func(*Config)) {
+	t.Helper()
+	original := config
+	t.Cleanup(func() { config = original })
+	patch(&config)
+}
+
+// testDomainResult is the result of looking up both branches of a domain.
+func testDomainResult(danePolicy string, mtaStsPolicy string, mtaStsReport string) domainResult {
+	return domainResult{
+		Dane:            branchFromResult(danePolicy, "", 3600),
+		MtaSts:          branchFromResult(mtaStsPolicy, mtaStsReport, 86400),
+		DaneAttempted:   true,
+		MtaStsAttempted: true,
+	}
+}
+
 func TestLiveNetworkTestsEnabled(t *testing.T) {
 	for _, test := range []struct {
 		name  string
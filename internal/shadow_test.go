@@ -0,0 +1,55 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+)
+
+func TestShadowModeRepliesBaselineAndCountsEvaluatedPolicy(t *testing.T) {
+	useTestPolicyCache(t)
+	patchConfigForTest(t, func(c *Config) {
+		c.Server.Mode = SERVER_MODE_SHADOW
+		c.Server.ShadowBaseline = ""
+	})
+	polCache.Set("shadow.example", pinTestEntry(time.Now()))
+	served := metricDaneOnlyTotal.Load()
+	shadowed := metricShadowDaneOnly.Load()
+
+	conn := newSecurityTestConn(nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25})
+	handleSocketmapConnection(conn, bufio.NewReader(bytes.NewReader(netstring.Marshal("QUERY shadow.example"))))
+	if !bytes.Equal(conn.output.Bytes(), NS_NOTFOUND) {
+		t.Fatalf("shadow reply = %q, want NOTFOUND", conn.output.Bytes())
+	}
+	if got := metricShadowDaneOnly.Load(); got != shadowed+1 {
+		t.Fatalf("shadow dane-only count = %d, want %d", got, shadowed+1)
+	}
+	if got := metricDaneOnlyTotal.Load(); got != served {
+		t.Fatalf("served dane-only count changed in shadow mode: %d -> %d", served, got)
+	}
+}
+
+func TestShadowModeRepliesConfiguredBaselineForTempFailures(t *testing.T) {
+	patchConfigForTest(t, func(c *Config) {
+		c.Server.Mode = SERVER_MODE_SHADOW
+		c.Server.ShadowBaseline = "may"
+	})
+	temp := metricShadowTemp.Load()
+	conn := newSecurityTestConn(nil, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25})
+	replySocketmap(conn, "network", "failing.example", "TEMP", "", 0, defaultQueryProfile(true))
+	if want := netstring.Marshal("OK may"); !bytes.Equal(conn.output.Bytes(), want) {
+		t.Fatalf("shadow reply = %q, want %q", conn.output.Bytes(), want)
+	}
+	if got := metricShadowTemp.Load(); got != temp+1 {
+		t.Fatalf("shadow temp count = %d, want %d", got, temp+1)
+	}
+}
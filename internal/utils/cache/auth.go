@@ -0,0 +1,97 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// Authenticated snapshots start with snapshotMagic, followed by the
+// generation and an HMAC-SHA256 over magic, generation and the gzip body.
+const (
+	snapshotMagic     = "TLSPOLC1"
+	snapshotHeaderLen = len(snapshotMagic) + 8 + sha256.Size
+	journalMACLen     = sha256.Size
+	journalAuthFlag   = 1 << 31
+)
+
+var (
+	ErrSnapshotUnauthenticated = errors.New("cache: snapshot is not authenticated")
+	ErrSnapshotTampered        = errors.New("cache: snapshot authentication failed")
+	ErrJournalUnauthenticated  = errors.New("cache: journal is not authenticated")
+	ErrJournalTampered         = errors.New("cache: journal authentication failed")
+)
+
+type Option func(*options)
+
+type options struct {
+	hmacKey  []byte
+	readOnly bool
+}
+
+// WithHMACKey authenticates the snapshot and journal with key. Files that are
+// unauthenticated or fail verification are rejected on load.
+func WithHMACKey(key []byte) Option {
+	return func(o *options) {
+		if len(key) != 0 {
+			o.hmacKey = append([]byte(nil), key...)
+		}
+	}
+}
+
+func (c *Cache[T]) newMAC() hash.Hash {
+	return hmac.New(sha256.New, c.hmacKey)
+}
+
+func (c *Cache[T]) snapshotHeader(generation uint64) []byte {
+	header := make([]byte, snapshotHeaderLen)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic):], generation)
+	return header
+}
+
+// verifySnapshot checks an authenticated snapshot and returns its generation
+// and gzip body.
+func (c *Cache[T]) verifySnapshot(data []byte) (uint64, []byte, error) {
+	if len(data) < snapshotHeaderLen || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, nil, ErrSnapshotTampered
+	}
+	generation := binary.BigEndian.Uint64(data[len(snapshotMagic):])
+	sum := data[len(snapshotMagic)+8 : snapshotHeaderLen]
+	body := data[snapshotHeaderLen:]
+	if c.hmacKey == nil {
+		return generation, body, nil
+	}
+	mac := c.newMAC()
+	mac.Write(data[:len(snapshotMagic)+8])
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return 0, nil, ErrSnapshotTampered
+	}
+	return generation, body, nil
+}
+
+// journalMAC authenticates a journal frame and chains it to the frames before
+// it by covering the snapshot generation the journal continues (its base),
+// the MAC of the previous frame and the payload. Frames can then neither be
+// dropped, reordered nor taken from another journal. The first frame carries
+// the base in its payload and has no previous MAC, so both are zero there.
+func journalMAC(key []byte, base uint64, prev []byte, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], base)
+	mac.Write(b[:])
+	if prev == nil {
+		prev = make([]byte, journalMACLen)
+	}
+	mac.Write(prev)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
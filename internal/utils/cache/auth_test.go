@@ -0,0 +1,231 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testHMACKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestAuthenticatedSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, time.Hour, WithHMACKey(testHMACKey))
+	c.Set("alpha", newTestValue(time.Now().Add(time.Minute), "A"))
+	if err := c.CloseWithError(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:len(snapshotMagic)]) != snapshotMagic {
+		t.Fatal("expected authenticated snapshot header")
+	}
+
+	reloaded := newTestCache(t, path, time.Hour, WithHMACKey(testHMACKey))
+	t.Cleanup(reloaded.Close)
+	if got, ok := reloaded.Get("alpha"); !ok || got.Payload != "A" {
+		t.Fatalf("expected authenticated entry after reload, got %+v ok=%v", got, ok)
+	}
+}
+
+func TestAuthenticatedSnapshotRejectsTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, time.Hour, WithHMACKey(testHMACKey))
+	c.Set("alpha", newTestValue(time.Now().Add(time.Minute), "A"))
+	if err := c.CloseWithError(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &Cache[*testValue]{filePath: path, hmacKey: testHMACKey}
+	if err := reloaded.load(); !errors.Is(err, ErrSnapshotTampered) {
+		t.Fatalf("expected tampered snapshot error, got %v", err)
+	}
+	if reloaded.Len() != 0 {
+		t.Fatal("tampered snapshot was loaded")
+	}
+	if _, err := os.Stat(path + ".rejected"); err != nil {
+		t.Fatalf("expected tampered snapshot to be moved aside: %v", err)
+	}
+}
+
+func TestAuthenticatedSnapshotRejectsForeignFiles(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"unauthenticated": nil,
+		"other key":       {WithHMACKey([]byte("fedcba9876543210fedcba9876543210"))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.db")
+			c := newTestCache(t, path, time.Hour, opts...)
+			c.Set("alpha", newTestValue(time.Now().Add(time.Minute), "A"))
+			if err := c.CloseWithError(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			reloaded := newTestCache(t, path, time.Hour, WithHMACKey(testHMACKey))
+			t.Cleanup(reloaded.Close)
+			if _, ok := reloaded.Get("alpha"); ok {
+				t.Fatal("foreign snapshot was loaded")
+			}
+			if _, err := os.Stat(path + ".rejected"); err != nil {
+				t.Fatalf("expected foreign snapshot to be moved aside: %v", err)
+			}
+		})
+	}
+}
+
+func TestAuthenticatedJournalRejectsForeignRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	keyed := newTestCache(t, path, time.Hour, WithHMACKey(testHMACKey))
+	keyed.Set("alpha", newTestValue(time.Now().Add(time.Minute), "A"))
+	if err := keyed.CloseWithError(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// Append an unauthenticated frame as a writer without the key would.
+	frame, _, err := encodeJournalFrame(journalFrame[*testValue]{Records: []journalRecord[*testValue]{{
+		Value:      newTestValue(time.Now().Add(time.Minute), "forged"),
+		Key:        "alpha",
+		Generation: 100,
+		Op:         journalSet,
+	}}}, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newTestCache(t, path, time.Hour, WithHMACKey(testHMACKey))
+	t.Cleanup(reloaded.Close)
+	if got, ok := reloaded.Get("alpha"); !ok || got.Payload != "A" {
+		t.Fatalf("expected snapshot value without forged journal record, got %+v ok=%v", got, ok)
+	}
+	if _, err := os.Stat(path + ".journal.rejected"); err != nil {
+		t.Fatalf("expected forged journal to be moved aside: %v", err)
+	}
+}
+
+// splitJournalFrames splits an authenticated journal into its frames.
+func splitJournalFrames(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	var frames [][]byte
+	for len(data) != 0 {
+		size := int(binary.BigEndian.Uint32(data[0:4]) &^ journalAuthFlag)
+		n := journalFrameHeaderLen + size + journalMACLen
+		frames = append(frames, data[:n])
+		data = data[n:]
+	}
+	return frames
+}
+
+func writeKeyedJournal(t *testing.T, path string, payloads ...string) [][]byte {
+	t.Helper()
+	c := newTestCache(t, path, time.Hour, WithHMACKey(testHMACKey))
+	t.Cleanup(c.Close)
+	for _, payload := range payloads {
+		c.Set("alpha", newTestValue(time.Now().Add(time.Minute), payload))
+		if err := c.flushJournal(); err != nil {
+			t.Fatalf("flush journal: %v", err)
+		}
+	}
+	data, err := os.ReadFile(c.journalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return splitJournalFrames(t, data)
+}
+
+func TestAuthenticatedJournalRejectsReorderedFrames(t *testing.T) {
+	dir := t.TempDir()
+	frames := writeKeyedJournal(t, filepath.Join(dir, "a", "cache.db"), "A", "B", "C")
+	other := writeKeyedJournal(t, filepath.Join(dir, "b", "cache.db"), "X", "Y", "Z")
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 journal frames, got %d", len(frames))
+	}
+	for name, journal := range map[string][][]byte{
+		"intact":    frames,
+		"dropped":   {frames[0], frames[2]},
+		"reordered": {frames[0], frames[2], frames[1]},
+		"spliced":   {frames[0], other[1], frames[2]},
+	} {
+		path := filepath.Join(dir, name+".journal")
+		if err := os.WriteFile(path, bytes.Join(journal, nil), 0600); err != nil {
+			t.Fatal(err)
+		}
+		j, err := readJournal[*testValue](path, testHMACKey)
+		if name == "intact" {
+			if err != nil || len(j.Records) != 3 {
+				t.Fatalf("intact journal: records=%d err=%v", len(j.Records), err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrJournalTampered) {
+			t.Fatalf("%s journal: expected tampered error, got %v", name, err)
+		}
+	}
+}
+
+func TestAuthenticatedJournalRejectsUnauthenticatedBase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	frames := writeKeyedJournal(t, path, "A")
+	frame, _, err := encodeJournalFrame(journalFrame[*testValue]{Base: 1000}, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, journal := range map[string][][]byte{
+		"first": {frame, frames[0]},
+		"later": {frames[0], frame},
+	} {
+		journalPath := path + "." + name
+		if err := os.WriteFile(journalPath, bytes.Join(journal, nil), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readJournal[*testValue](journalPath, testHMACKey); !errors.Is(err, ErrJournalUnauthenticated) {
+			t.Fatalf("%s base frame without MAC: expected unauthenticated error, got %v", name, err)
+		}
+	}
+}
+
+func TestAuthenticatedJournalChainsAfterCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, time.Hour, WithHMACKey(testHMACKey))
+	t.Cleanup(c.Close)
+	c.Set("alpha", newTestValue(time.Now().Add(time.Minute), "A"))
+	if err := c.Save(false); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	c.Set("beta", newTestValue(time.Now().Add(time.Minute), "B"))
+	if err := c.flushJournal(); err != nil {
+		t.Fatalf("flush journal: %v", err)
+	}
+	j, err := readJournal[*testValue](c.journalPath(), testHMACKey)
+	if err != nil || j.Base != 1 || len(j.Records) != 1 {
+		t.Fatalf("expected one record after base 1, got base=%d records=%d err=%v", j.Base, len(j.Records), err)
+	}
+}
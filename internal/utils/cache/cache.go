@@ -6,15 +6,20 @@
 package cache
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/maphash"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -55,20 +60,38 @@ func (e *Expirable) RemainingTTL(t ...time.Time) uint32 {
 	return uint32(ttl)
 }
 
+// Cache is a persistent map sharded by key hash. Each shard has its own lock,
+// so readers and writers of different keys do not block each other. Methods
+// taking haveLock expect the caller to hold the shard of the key (LockKey) or
+// the whole cache (Lock, or RLock for Items and Save).
 type Cache[T Cacheable] struct {
-	closeErr            error
-	data                map[string]T
-	quit                chan struct{}
-	filePath            string
-	wg                  sync.WaitGroup
-	savePeriod          time.Duration
-	generation          uint64
-	persistedGeneration uint64
-	sync.RWMutex
+	closeErr               error
+	quit                   chan struct{}
+	journal                *os.File
+	lock                   *os.File
+	filePath               string
+	hmacKey                []byte
+	pending                []journalRecord[T]
+	journaled              []journalRecord[T]
+	wg                     sync.WaitGroup
+	savePeriod             time.Duration
+	persistedGeneration    uint64
+	journalMAC             []byte // of the last journal frame, chains the next one
+	journalBase            uint64
+	journalSize            int64
+	snapshotSize           int64
+	seed                   maphash.Seed
+	shards                 [shardCount]shard[T]
+	generation             atomic.Uint64
+	cleanGeneration        atomic.Uint64
+	size                   atomic.Int64
+	shardsOnce             sync.Once
 	closeOnce              sync.Once
 	persistMu              sync.Mutex
-	dirty                  bool
+	journalMu              sync.Mutex
 	hasPersistedGeneration bool
+	journalBroken          bool
+	readOnly               bool
 }
 
 type Entry[T Cacheable] struct {
@@ -76,91 +99,117 @@ type Entry[T Cacheable] struct {
 	Key   string
 }
 
-func New[T Cacheable](filePath string, savePeriod time.Duration) *Cache[T] {
+// New locks filePath for this instance, loads the snapshot, replays its
+// journal and starts background persistence. Mutations are journaled every
+// few seconds; the journal is compacted into a new snapshot once it outgrows
+// the snapshot or savePeriod has passed. New fails with ErrLocked if another
+// instance holds the lock. Load errors are logged and start an empty cache,
+// except in ReadOnly mode, where they are returned.
+func New[T Cacheable](filePath string, savePeriod time.Duration, opts ...Option) (*Cache[T], error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
 	c := &Cache[T]{
-		data:       make(map[string]T),
 		filePath:   filePath,
+		hmacKey:    o.hmacKey,
+		readOnly:   o.readOnly,
 		savePeriod: savePeriod,
 		quit:       make(chan struct{}),
 	}
+	if c.readOnly {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	if err := c.acquireLock(); err != nil {
+		return nil, err
+	}
 	if err := c.load(); err != nil {
 		slog.Error("cache: error loading persisted data", "error", err)
-		c.dirty = true
-		c.generation++
+		c.generation.Add(1)
 	}
 	c.wg.Add(1)
 	go c.periodicSave()
-	return c
+	return c, nil
 }
 
 func (c *Cache[T]) Set(key string, value T) {
-	c.Lock()
-	defer c.Unlock()
-	c.data[key] = value
-	c.dirty = true
-	c.generation++
+	s := c.shardFor(key)
+	s.Lock()
+	defer s.Unlock()
+	c.setLocked(s, key, value)
+}
+
+func (c *Cache[T]) setLocked(s *shard[T], key string, value T) {
+	if _, ok := s.data[key]; !ok {
+		c.size.Add(1)
+	}
+	s.data[key] = value
+	c.recordLocked(journalSet, key, value)
 }
 
 func (c *Cache[T]) Update(haveLock bool, key string, fn func(T, bool) (T, bool)) {
+	s := c.shardFor(key)
 	if !haveLock {
-		c.Lock()
-		defer c.Unlock()
+		s.Lock()
+		defer s.Unlock()
 	}
-	val, ok := c.data[key]
+	val, ok := s.data[key]
 	next, update := fn(val, ok)
 	if !update {
 		return
 	}
-	c.data[key] = next
-	c.dirty = true
-	c.generation++
+	c.setLocked(s, key, next)
 }
 
 func (c *Cache[T]) Get(key string) (T, bool) {
-	c.RLock()
-	defer c.RUnlock()
-	val, ok := c.data[key]
+	s := c.shardFor(key)
+	s.RLock()
+	defer s.RUnlock()
+	val, ok := s.data[key]
 	return val, ok
 }
 
 func (c *Cache[T]) Remove(haveLock bool, key string) {
+	s := c.shardFor(key)
 	if !haveLock {
-		c.Lock()
-		defer c.Unlock()
+		s.Lock()
+		defer s.Unlock()
 	}
-	if _, ok := c.data[key]; !ok {
+	if _, ok := s.data[key]; !ok {
 		return
 	}
-	delete(c.data, key)
-	c.dirty = true
-	c.generation++
+	delete(s.data, key)
+	c.size.Add(-1)
+	var zero T
+	c.recordLocked(journalRemove, key, zero)
 }
 
 func (c *Cache[T]) Purge() error {
 	c.Lock()
-	c.data = make(map[string]T)
-	c.dirty = true
-	c.generation++
+	c.replaceDataLocked(nil)
+	var zero T
+	c.recordLocked(journalPurge, "", zero)
 	c.Unlock()
 	return c.Save(false)
 }
 
+// Items returns all entries. Without haveLock, each shard is copied under its
+// own read lock, so the result is consistent per key but not across shards.
 func (c *Cache[T]) Items(haveLock bool) []Entry[T] {
-	if !haveLock {
-		c.RLock()
-		defer c.RUnlock()
-	}
-	entries := make([]Entry[T], 0, len(c.data))
-	for k, v := range c.data {
-		entries = append(entries, Entry[T]{Key: k, Value: v})
-	}
+	entries := make([]Entry[T], 0, c.Len())
+	c.eachShard(haveLock, func(s *shard[T]) {
+		for k, v := range s.data {
+			entries = append(entries, Entry[T]{Key: k, Value: v})
+		}
+	})
 	return entries
 }
 
 func (c *Cache[T]) Len() int {
-	c.RLock()
-	defer c.RUnlock()
-	return len(c.data)
+	return int(c.size.Load())
 }
 
 func (c *Cache[T]) Close() {
@@ -174,18 +223,31 @@ func (c *Cache[T]) CloseWithError() error {
 	c.closeOnce.Do(func() {
 		close(c.quit)
 		c.wg.Wait()
+		if c.readOnly {
+			return
+		}
 		c.closeErr = c.Save(false)
+		c.closeJournal()
+		c.releaseLock()
 	})
 	return c.closeErr
 }
 
 func (c *Cache[T]) periodicSave() {
 	defer c.wg.Done()
-	ticker := time.NewTicker(c.savePeriod)
+	ticker := time.NewTicker(min(c.savePeriod, journalSyncInterval))
 	defer ticker.Stop()
+	lastCompaction := time.Now()
 	for {
 		select {
 		case <-ticker.C:
+			if err := c.flushJournal(); err != nil {
+				slog.Error("cache: error writing journal", "error", err)
+			}
+			if !c.journalNeedsCompaction() && time.Since(lastCompaction) < c.savePeriod {
+				continue
+			}
+			lastCompaction = time.Now()
 			if err := c.Save(false); err != nil {
 				slog.Error("cache: error saving cache", "error", err)
 			}
@@ -203,71 +265,61 @@ func (c *Cache[T]) ForceSave(haveLock bool) error {
 	return c.save(haveLock, true)
 }
 
+// save snapshots the shards one by one. Records that race with the copy
+// have a generation above the one read before it and stay in the journal, so
+// replaying them over the snapshot restores the exact state.
 func (c *Cache[T]) save(haveLock bool, force bool) error {
-	var (
-		snapshot   map[string]T
-		generation uint64
-	)
-	if haveLock {
-		if !force && !c.dirty {
-			return nil
-		}
-		snapshot, generation = c.snapshotLocked()
-	} else {
-		c.RLock()
-		if !force && !c.dirty {
-			c.RUnlock()
-			return nil
-		}
-		snapshot, generation = c.snapshotLocked()
-		c.RUnlock()
+	if c.readOnly {
+		return ErrReadOnly
 	}
-
-	if err := c.persistSnapshot(snapshot, generation, force); err != nil {
-		return err
-	}
-
-	if haveLock {
-		if c.generation == generation {
-			c.dirty = false
-		}
+	generation := c.generation.Load()
+	if !force && c.cleanGeneration.Load() == generation {
 		return nil
 	}
+	snapshot := c.snapshotMap(haveLock)
+	pending := c.takePending()
 
-	c.Lock()
-	if c.generation == generation {
-		c.dirty = false
+	if err := c.compact(snapshot, pending, generation, force); err != nil {
+		return err
 	}
-	c.Unlock()
+	c.markClean(generation)
 	return nil
 }
 
 func (c *Cache[T]) persistSnapshot(data map[string]T, generation uint64, force bool) error {
+	return c.compact(data, nil, generation, force)
+}
+
+// compact writes the snapshot taken at generation and restarts the journal
+// from it. Pending records are journaled first, so the journal stays complete
+// if the process stops between the snapshot and the journal rewrite.
+func (c *Cache[T]) compact(data map[string]T, pending []journalRecord[T], generation uint64, force bool) error {
 	c.persistMu.Lock()
 	defer c.persistMu.Unlock()
 
+	if err := c.appendJournalLocked(pending); err != nil {
+		slog.Error("cache: error writing journal", "error", err)
+	}
 	if c.hasPersistedGeneration {
 		if generation < c.persistedGeneration || generation == c.persistedGeneration && !force {
 			return nil
 		}
 	}
-	if err := c.writeSnapshot(data); err != nil {
+	if err := c.restoreJournalLocked(); err != nil {
+		return fmt.Errorf("cache: restore journal: %w", err)
+	}
+	if err := c.writeSnapshot(data, generation); err != nil {
 		return err
 	}
 	c.persistedGeneration = generation
 	c.hasPersistedGeneration = true
-	return nil
-}
-
-func (c *Cache[T]) snapshotLocked() (map[string]T, uint64) {
-	snapshot := make(map[string]T, len(c.data))
-	for k, v := range c.data {
-		snapshot[k] = v
+	if err := c.rewriteJournalLocked(generation); err != nil {
+		return fmt.Errorf("cache: compact journal: %w", err)
 	}
-	return snapshot, c.generation
+	return nil
 }
 
-func (c *Cache[T]) writeSnapshot(data map[string]T) error {
+func (c *Cache[T]) writeSnapshot(data map[string]T, generation uint64) error {
 	dir := filepath.Dir(c.filePath)
 	if dir != "." {
 		if err := os.MkdirAll(dir, 0755); err != nil {
@@ -287,7 +339,21 @@ func (c *Cache[T]) writeSnapshot(data map[string]T) error {
 		}
 	}()
 
-	g, err := gzip.NewWriterLevel(tmp, gzip.BestSpeed)
+	var (
+		w   io.Writer = tmp
+		mac hash.Hash
+	)
+	if c.hmacKey != nil {
+		header := c.snapshotHeader(generation)
+		if _, err := tmp.Write(header); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+		mac = c.newMAC()
+		mac.Write(header[:len(snapshotMagic)+8])
+		w = io.MultiWriter(tmp, mac)
+	}
+	g, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
 	if err != nil {
 		_ = tmp.Close()
 		return err
@@ -301,10 +367,21 @@ func (c *Cache[T]) writeSnapshot(data map[string]T) error {
 		_ = tmp.Close()
 		return err
 	}
+	if mac != nil {
+		if _, err := tmp.WriteAt(mac.Sum(nil), int64(len(snapshotMagic)+8)); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
 	if err := tmp.Sync(); err != nil {
 		_ = tmp.Close()
 		return err
 	}
+	info, err := tmp.Stat()
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
 	if err := tmp.Close(); err != nil {
 		return err
 	}
@@ -312,6 +389,7 @@ func (c *Cache[T]) writeSnapshot(data map[string]T) error {
 		return err
 	}
 	removeTmp = false
+	c.snapshotSize = info.Size()
 	return syncDirectory(dir)
 }
 
@@ -325,40 +403,120 @@ func syncDirectory(path string) error {
 }
 
 func (c *Cache[T]) load() error {
+	base, records, err := c.loadJournal()
+	if errors.Is(err, ErrJournalUnauthenticated) || errors.Is(err, ErrJournalTampered) {
+		slog.Error("cache: rejected journal", "path", c.journalPath(), "error", err)
+		if !c.readOnly {
+			c.quarantine(c.journalPath())
+		}
+		base, records, err = 0, nil, nil
+		c.journaled = nil
+		c.journalSize = 0
+		c.journalBase = 0
+		c.journalMAC = nil
+	}
+	if err != nil {
+		return err
+	}
+	generation := base
+	if len(records) != 0 {
+		generation = max(generation, records[len(records)-1].Generation)
+	}
+	c.generation.Store(max(c.generation.Load(), generation))
+
+	stored, snapshotGeneration, found, err := c.readSnapshot()
+	if errors.Is(err, ErrSnapshotUnauthenticated) || errors.Is(err, ErrSnapshotTampered) {
+		if !c.readOnly {
+			c.quarantine(c.filePath)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		stored = make(map[string]T)
+	}
+	base = max(base, snapshotGeneration)
+	stored, applied := replayJournal(stored, base, records)
+	if applied != 0 {
+		slog.Info("cache: replayed journal", "records", applied)
+	}
+	c.Lock()
+	c.replaceDataLocked(stored)
+	c.generation.Store(max(c.generation.Load(), base))
+	if applied == 0 {
+		c.cleanGeneration.Store(c.generation.Load())
+	}
+	if found || len(records) != 0 {
+		c.persistedGeneration = base
+		c.hasPersistedGeneration = true
+	}
+	c.Unlock()
+	return nil
+}
+
+// quarantine moves a rejected file aside so it can be inspected instead of
+// being overwritten by the next save.
+func (c *Cache[T]) quarantine(path string) {
+	rejected := path + ".rejected"
+	if err := os.Rename(path, rejected); err != nil {
+		slog.Error("cache: could not move rejected file aside", "path", path, "error", err)
+		return
+	}
+	slog.Error("cache: moved rejected file aside", "path", rejected)
+}
+
+func (c *Cache[T]) readSnapshot() (map[string]T, uint64, bool, error) {
 	f, err := os.Open(c.filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return nil, 0, false, nil
 		}
-		return err
+		return nil, 0, false, err
 	}
 	defer f.Close()
-	g, err := gzip.NewReader(f)
+	if info, err := f.Stat(); err == nil {
+		c.snapshotSize = info.Size()
+	}
+	br := bufio.NewReader(f)
+	var (
+		src        io.Reader = br
+		generation uint64
+	)
+	if magic, err := br.Peek(len(snapshotMagic)); err == nil && string(magic) == snapshotMagic {
+		// Verify before decoding so that foreign data never reaches gob.
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		var body []byte
+		generation, body, err = c.verifySnapshot(data)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		src = bytes.NewReader(body)
+	} else if c.hmacKey != nil {
+		return nil, 0, false, ErrSnapshotUnauthenticated
+	}
+	g, err := gzip.NewReader(src)
 	if err != nil {
-		return err
+		return nil, 0, false, err
 	}
 	defer g.Close()
 	dec := gob.NewDecoder(g)
 	var stored map[string]T
 	if err := dec.Decode(&stored); err != nil {
-		return err
+		return nil, 0, false, err
 	}
 	var trailing any
 	if err := dec.Decode(&trailing); err != nil && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("cache: invalid trailing gob data: %w", err)
+		return nil, 0, false, fmt.Errorf("cache: invalid trailing gob data: %w", err)
 	} else if err == nil {
-		return errors.New("cache: multiple gob values in snapshot")
+		return nil, 0, false, errors.New("cache: multiple gob values in snapshot")
 	}
 	if _, err := io.Copy(io.Discard, g); err != nil {
-		return fmt.Errorf("cache: invalid compressed snapshot: %w", err)
-	}
-	if stored == nil {
-		stored = make(map[string]T)
+		return nil, 0, false, fmt.Errorf("cache: invalid compressed snapshot: %w", err)
 	}
-	c.Lock()
-	c.data = stored
-	c.dirty = false
-	c.hasPersistedGeneration = true
-	c.Unlock()
-	return nil
+	return stored, generation, true, nil
 }
@@ -36,6 +36,15 @@ func newTestValue(expiresAt time.Time, payload string) *testValue {
 	}
 }
 
+func newTestCache(t testing.TB, path string, savePeriod time.Duration, opts ...Option) *Cache[*testValue] {
+	t.Helper()
+	c, err := New[*testValue](path, savePeriod, opts...)
+	if err != nil {
+		t.Fatalf("open cache: %v", err)
+	}
+	return c
+}
+
 func TestExpirableAge(t *testing.T) {
 	t.Parallel()
 
@@ -130,7 +139,7 @@ func TestCacheSetGetRemoveItemsPurge(t *testing.T) {
 	t.Parallel()
 
 	tmpFile := filepath.Join(t.TempDir(), "cache.gz")
-	c := New[*testValue](tmpFile, time.Hour)
+	c := newTestCache(t, tmpFile, time.Hour)
 	t.Cleanup(c.Close)
 
 	now := time.Now().UTC()
@@ -175,16 +184,14 @@ func TestCacheSetGetRemoveItemsPurge(t *testing.T) {
 
 func TestCachePurgeReportsPersistenceFailure(t *testing.T) {
 	c := &Cache[*testValue]{
-		data: map[string]*testValue{
-			"alpha": newTestValue(time.Now().Add(time.Minute), "A"),
-		},
 		filePath: t.TempDir(), // Renaming a snapshot over an existing directory must fail.
 	}
+	c.Set("alpha", newTestValue(time.Now().Add(time.Minute), "A"))
 	if err := c.Purge(); err == nil {
 		t.Fatal("expected purge persistence failure")
 	}
-	if len(c.data) != 0 || !c.dirty {
-		t.Fatalf("expected failed persistent purge to remain active and dirty, data=%v dirty=%v", c.data, c.dirty)
+	if c.Len() != 0 || !c.isDirty() {
+		t.Fatalf("expected failed persistent purge to remain active and dirty, len=%d dirty=%v", c.Len(), c.isDirty())
 	}
 }
 
@@ -207,12 +214,12 @@ func TestCacheLoadRejectsCorruptGzipTrailer(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	c := &Cache[*testValue]{data: make(map[string]*testValue), filePath: path}
+	c := &Cache[*testValue]{filePath: path}
 	if err := c.load(); err == nil {
 		t.Fatal("expected corrupt gzip trailer to be rejected")
 	}
-	if len(c.data) != 0 {
-		t.Fatalf("corrupt snapshot modified live cache: %v", c.data)
+	if c.Len() != 0 {
+		t.Fatalf("corrupt snapshot modified live cache: %v", c.snapshotMap(false))
 	}
 }
 
@@ -222,21 +229,21 @@ func TestCacheRepairsCorruptSnapshotOnClose(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	c := New[*testValue](path, time.Hour)
+	c := newTestCache(t, path, time.Hour)
 	if err := c.CloseWithError(); err != nil {
 		t.Fatalf("repair corrupt snapshot: %v", err)
 	}
-	reloaded := &Cache[*testValue]{data: make(map[string]*testValue), filePath: path}
+	reloaded := &Cache[*testValue]{filePath: path}
 	if err := reloaded.load(); err != nil {
 		t.Fatalf("load repaired snapshot: %v", err)
 	}
-	if len(reloaded.data) != 0 {
-		t.Fatalf("repaired snapshot is not empty: %v", reloaded.data)
+	if reloaded.Len() != 0 {
+		t.Fatalf("repaired snapshot is not empty: %v", reloaded.snapshotMap(false))
 	}
 }
 
 func TestCacheCloseWithErrorReportsPersistenceFailure(t *testing.T) {
-	c := New[*testValue](t.TempDir(), time.Hour)
+	c := newTestCache(t, t.TempDir(), time.Hour)
 	c.Set("alpha", newTestValue(time.Now().Add(time.Minute), "A"))
 	firstErr := c.CloseWithError()
 	if firstErr == nil {
@@ -265,7 +272,7 @@ func TestCacheLoadNormalizesNilMap(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	c := &Cache[*testValue]{data: make(map[string]*testValue), filePath: path}
+	c := &Cache[*testValue]{filePath: path}
 	if err := c.load(); err != nil {
 		t.Fatalf("load nil map: %v", err)
 	}
@@ -281,7 +288,7 @@ func TestCacheSaveAndLoadRoundTrip(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "cache.gz")
 	now := time.Now().UTC()
 
-	c1 := New[*testValue](tmpFile, time.Hour)
+	c1 := newTestCache(t, tmpFile, time.Hour)
 	c1.Set("alpha", newTestValue(now.Add(30*time.Second), "A"))
 	c1.Set("beta", newTestValue(now.Add(45*time.Second), "B"))
 	if err := c1.Save(false); err != nil {
@@ -289,7 +296,7 @@ func TestCacheSaveAndLoadRoundTrip(t *testing.T) {
 	}
 	c1.Close()
 
-	c2 := New[*testValue](tmpFile, time.Hour)
+	c2 := newTestCache(t, tmpFile, time.Hour)
 	t.Cleanup(c2.Close)
 
 	gotA, ok := c2.Get("alpha")
@@ -329,7 +336,7 @@ func TestCacheRejectsStaleSnapshotWrite(t *testing.T) {
 		t.Fatalf("persist stale snapshot: %v", err)
 	}
 
-	loaded := New[*testValue](tmpFile, time.Hour)
+	loaded := newTestCache(t, tmpFile, time.Hour)
 	t.Cleanup(loaded.Close)
 	if _, ok := loaded.Get("new"); !ok {
 		t.Fatal("newer snapshot was overwritten")
@@ -345,7 +352,7 @@ func TestCacheClosePersistsDirtyEntries(t *testing.T) {
 	tmpFile := filepath.Join(t.TempDir(), "cache.db")
 	now := time.Now().UTC()
 
-	c1 := New[*testValue](tmpFile, time.Hour)
+	c1 := newTestCache(t, tmpFile, time.Hour)
 	c1.Set("alpha", newTestValue(now.Add(30*time.Second), "A"))
 	c1.Close()
 
@@ -353,7 +360,7 @@ func TestCacheClosePersistsDirtyEntries(t *testing.T) {
 		t.Fatalf("expected cache file to be created on close: %v", err)
 	}
 
-	c2 := New[*testValue](tmpFile, time.Hour)
+	c2 := newTestCache(t, tmpFile, time.Hour)
 	t.Cleanup(c2.Close)
 
 	got, ok := c2.Get("alpha")
@@ -369,7 +376,7 @@ func TestCacheSaveCreatesParentDirectory(t *testing.T) {
 	t.Parallel()
 
 	tmpFile := filepath.Join(t.TempDir(), "nested", "cache.db")
-	c := New[*testValue](tmpFile, time.Hour)
+	c := newTestCache(t, tmpFile, time.Hour)
 	t.Cleanup(c.Close)
 
 	c.Set("alpha", newTestValue(time.Now().Add(30*time.Second), "A"))
@@ -386,7 +393,7 @@ func TestCacheSaveSkipsWhenNotDirty(t *testing.T) {
 	t.Parallel()
 
 	tmpFile := filepath.Join(t.TempDir(), "cache.gz")
-	c := New[*testValue](tmpFile, time.Hour)
+	c := newTestCache(t, tmpFile, time.Hour)
 	t.Cleanup(c.Close)
 
 	// Should not fail and should do nothing when not dirty.
@@ -398,11 +405,11 @@ func TestCacheSaveSkipsWhenNotDirty(t *testing.T) {
 func TestCacheRemoveMissingDoesNotMarkDirty(t *testing.T) {
 	t.Parallel()
 
-	c := New[*testValue](filepath.Join(t.TempDir(), "cache.gz"), time.Hour)
+	c := newTestCache(t, filepath.Join(t.TempDir(), "cache.gz"), time.Hour)
 	t.Cleanup(c.Close)
 
 	c.Remove(false, "missing")
-	if c.dirty {
+	if c.isDirty() {
 		t.Fatal("removing a missing key marked the cache dirty")
 	}
 }
@@ -411,7 +418,7 @@ func TestCacheForceSaveWritesWhenNotDirty(t *testing.T) {
 	t.Parallel()
 
 	tmpFile := filepath.Join(t.TempDir(), "cache.db")
-	c := New[*testValue](tmpFile, time.Hour)
+	c := newTestCache(t, tmpFile, time.Hour)
 	t.Cleanup(c.Close)
 
 	c.Set("alpha", newTestValue(time.Now().Add(30*time.Second), "A"))
@@ -426,7 +433,7 @@ func TestCacheForceSaveWritesWhenNotDirty(t *testing.T) {
 		t.Fatalf("force save failed: %v", err)
 	}
 
-	c2 := New[*testValue](tmpFile, time.Hour)
+	c2 := newTestCache(t, tmpFile, time.Hour, ReadOnly())
 	defer c2.Close()
 
 	got, ok := c2.Get("alpha")
@@ -442,7 +449,7 @@ func TestCacheConcurrentSetGet(t *testing.T) {
 	t.Parallel()
 
 	tmpFile := filepath.Join(t.TempDir(), "cache.gz")
-	c := New[*testValue](tmpFile, time.Hour)
+	c := newTestCache(t, tmpFile, time.Hour)
 	t.Cleanup(c.Close)
 
 	const workers = 16
@@ -478,7 +485,7 @@ func TestCacheCloseIsSafeAfterUse(t *testing.T) {
 	t.Parallel()
 
 	tmpFile := filepath.Join(t.TempDir(), "cache.gz")
-	c := New[*testValue](tmpFile, 10*time.Millisecond)
+	c := newTestCache(t, tmpFile, 10*time.Millisecond)
 
 	c.Set("x", newTestValue(time.Now().Add(5*time.Second), "X"))
 	c.Set("y", newTestValue(time.Now().Add(5*time.Second), "Y"))
@@ -491,7 +498,7 @@ func TestCacheCloseIsSafeAfterUse(t *testing.T) {
 	c.Close()
 
 	// Ensure persisted content can still be read.
-	c2 := New[*testValue](tmpFile, time.Hour)
+	c2 := newTestCache(t, tmpFile, time.Hour)
 	defer c2.Close()
 
 	if _, ok := c2.Get("x"); !ok {
@@ -516,7 +523,7 @@ func BenchmarkWriteSnapshot(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if err := c.writeSnapshot(data); err != nil {
+		if err := c.writeSnapshot(data, uint64(i)); err != nil {
 			b.Fatal(err)
 		}
 	}
@@ -524,7 +531,7 @@ func BenchmarkWriteSnapshot(b *testing.B) {
 
 func TestSaveSnapshotDoesNotBlockReaders(t *testing.T) {
 	cacheFile := filepath.Join(t.TempDir(), "cache.gz")
-	c := New[*testValue](cacheFile, time.Hour)
+	c := newTestCache(t, cacheFile, time.Hour)
 	defer c.Close()
 	c.Set("example", newTestValue(time.Now().Add(time.Hour), "value"))
 
@@ -554,3 +561,48 @@ func TestSaveSnapshotDoesNotBlockReaders(t *testing.T) {
 		t.Fatalf("save cache: %v", err)
 	}
 }
+
+func TestShardedCacheConcurrentWritesSurviveReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.gz")
+	c := newTestCache(t, path, time.Hour)
+	expiresAt := time.Now().Add(time.Hour)
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				key := "key-" + strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				c.Set(key, newTestValue(expiresAt, key))
+				if i%3 == 0 {
+					c.Remove(false, key)
+				}
+				if i%50 == 0 {
+					if err := c.Save(false); err != nil {
+						t.Errorf("save: %v", err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	want := c.snapshotMap(false)
+	if c.Len() != len(want) || len(c.Items(false)) != len(want) {
+		t.Fatalf("Len=%d Items=%d, want %d", c.Len(), len(c.Items(false)), len(want))
+	}
+	if err := c.CloseWithError(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reloaded := newTestCache(t, path, time.Hour)
+	defer reloaded.Close()
+	if reloaded.Len() != len(want) {
+		t.Fatalf("reloaded %d entries, want %d", reloaded.Len(), len(want))
+	}
+	for key := range want {
+		if v, ok := reloaded.Get(key); !ok || v.Payload != key {
+			t.Fatalf("reloaded %s = %+v, %v", key, v, ok)
+		}
+	}
+}
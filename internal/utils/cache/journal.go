@@ -0,0 +1,403 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	journalSyncInterval   = 2 * time.Second
+	journalMinCompactSize = 1 << 20
+	journalMaxRecords     = 1 << 16
+	journalMaxFrameSize   = 64 << 20
+	journalFrameHeaderLen = 8
+)
+
+type journalOp uint8
+
+const (
+	journalSet journalOp = iota
+	journalRemove
+	journalPurge
+)
+
+// journalRecord is one Set/Remove/Purge mutation. Generation orders records
+// across concurrent flushes and compactions.
+type journalRecord[T Cacheable] struct {
+	Value      T
+	Key        string
+	Generation uint64
+	Op         journalOp
+}
+
+// journalFrame is the unit appended to the journal. The first frame of a
+// journal carries the generation of the snapshot it continues.
+type journalFrame[T Cacheable] struct {
+	Records []journalRecord[T]
+	Base    uint64
+}
+
+func (c *Cache[T]) journalPath() string {
+	return c.filePath + ".journal"
+}
+
+// recordLocked advances the generation and queues a mutation for the
+// journal. The caller holds the write lock of the key's shard, or of all
+// shards for a purge. Both happen under journalMu, so queued records are
+// ordered by generation even when shards are written concurrently.
+func (c *Cache[T]) recordLocked(op journalOp, key string, value T) {
+	c.journalMu.Lock()
+	defer c.journalMu.Unlock()
+	generation := c.generation.Add(1)
+	if c.readOnly {
+		return
+	}
+	c.pending = append(c.pending, journalRecord[T]{
+		Value:      value,
+		Key:        key,
+		Generation: generation,
+		Op:         op,
+	})
+}
+
+func (c *Cache[T]) takePending() []journalRecord[T] {
+	c.journalMu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.journalMu.Unlock()
+	return pending
+}
+
+// flushJournal appends queued mutations to the journal and syncs it.
+func (c *Cache[T]) flushJournal() error {
+	c.persistMu.Lock()
+	defer c.persistMu.Unlock()
+	return c.appendJournalLocked(c.takePending())
+}
+
+func (c *Cache[T]) appendJournalLocked(records []journalRecord[T]) error {
+	if len(records) == 0 {
+		return nil
+	}
+	c.journaled = append(c.journaled, records...)
+	if c.journalBroken {
+		return nil
+	}
+	base := c.journalBase
+	if c.journalMAC == nil {
+		base = 0 // first frame of a new journal
+	}
+	frame, mac, err := encodeJournalFrame(journalFrame[T]{Records: records}, c.hmacKey, base, c.journalMAC)
+	if err != nil {
+		c.journalBroken = true
+		return err
+	}
+	f, err := c.openJournalLocked()
+	if err != nil {
+		c.journalBroken = true
+		return err
+	}
+	n, err := f.Write(frame)
+	c.journalSize += int64(n)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// A torn frame makes later appends unreadable, so stop appending
+		// until the next compaction rewrites the journal.
+		c.journalBroken = true
+		_ = f.Close()
+		c.journal = nil
+		return err
+	}
+	c.journalMAC = mac
+	return nil
+}
+
+func (c *Cache[T]) openJournalLocked() (*os.File, error) {
+	if c.journal != nil {
+		return c.journal, nil
+	}
+	dir := filepath.Dir(c.filePath)
+	if dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(c.journalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	c.journal = f
+	c.journalSize = info.Size()
+	return f, nil
+}
+
+func (c *Cache[T]) closeJournal() {
+	c.persistMu.Lock()
+	defer c.persistMu.Unlock()
+	if c.journal != nil {
+		_ = c.journal.Close()
+		c.journal = nil
+	}
+}
+
+// journalNeedsCompaction reports whether the journal has outgrown the
+// snapshot it continues, or holds more records in memory than
+// journalMaxRecords.
+func (c *Cache[T]) journalNeedsCompaction() bool {
+	c.persistMu.Lock()
+	defer c.persistMu.Unlock()
+	return c.journalBroken || len(c.journaled) >= journalMaxRecords ||
+		c.journalSize >= max(int64(journalMinCompactSize), c.snapshotSize)
+}
+
+// restoreJournalLocked rewrites a broken journal with every record since the
+// persisted snapshot. It runs before a new snapshot replaces that one: if the
+// process stopped in between, replaying a journal that lacks records over the
+// new snapshot would bring back stale values.
+func (c *Cache[T]) restoreJournalLocked() error {
+	if !c.journalBroken {
+		return nil
+	}
+	return c.rewriteJournalLocked(c.persistedGeneration)
+}
+
+// rewriteJournalLocked replaces the journal with one that continues the
+// snapshot at base, keeping only records that are newer than it.
+func (c *Cache[T]) rewriteJournalLocked(base uint64) error {
+	kept := make([]journalRecord[T], 0)
+	for _, record := range c.journaled {
+		if record.Generation > base {
+			kept = append(kept, record)
+		}
+	}
+	frame, mac, err := encodeJournalFrame(journalFrame[T]{Records: kept, Base: base}, c.hmacKey, 0, nil)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(c.filePath)
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.journalPath())+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	removeTmp := true
+	defer func() {
+		if removeTmp {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	if _, err := tmp.Write(frame); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if c.journal != nil {
+		_ = c.journal.Close()
+		c.journal = nil
+	}
+	if err := os.Rename(tmpPath, c.journalPath()); err != nil {
+		return err
+	}
+	removeTmp = false
+	c.journaled = kept
+	c.journalSize = int64(len(frame))
+	c.journalBase = base
+	c.journalMAC = mac
+	c.journalBroken = false
+	return syncDirectory(dir)
+}
+
+// encodeJournalFrame frames a gob payload with its length and CRC. With a
+// key, the length carries journalAuthFlag and an HMAC chained to prev follows
+// the payload, see journalMAC. It also returns the HMAC.
+func encodeJournalFrame[T Cacheable](frame journalFrame[T], key []byte, base uint64, prev []byte) ([]byte, []byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, journalFrameHeaderLen))
+	if err := gob.NewEncoder(&buf).Encode(frame); err != nil {
+		return nil, nil, err
+	}
+	payload := buf.Bytes()[journalFrameHeaderLen:]
+	size := uint32(len(payload))
+	if size > journalMaxFrameSize {
+		return nil, nil, fmt.Errorf("cache: journal frame exceeds %d bytes", journalMaxFrameSize)
+	}
+	checksum := crc32.ChecksumIEEE(payload)
+	var mac []byte
+	if key != nil {
+		mac = journalMAC(key, base, prev, payload)
+		buf.Write(mac)
+		size |= journalAuthFlag
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[0:4], size)
+	binary.BigEndian.PutUint32(b[4:8], checksum)
+	return b, mac, nil
+}
+
+// journalContents is what readJournal found: the base generation, all intact
+// records, the size of the intact prefix and the HMAC of its last frame.
+type journalContents[T Cacheable] struct {
+	Records []journalRecord[T]
+	MAC     []byte
+	Base    uint64
+	Valid   int64
+	Torn    bool
+}
+
+// readJournal reads the intact frames of a journal. A torn or corrupt tail
+// ends the journal. With a key, every frame must carry an HMAC chained to the
+// frames before it; a frame without one, or failing verification, is an error.
+//
+//gocyclo:ignore
+func readJournal[T Cacheable](path string, key []byte) (journalContents[T], error) {
+	var j journalContents[T]
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+		return j, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var header [journalFrameHeaderLen]byte
+	for first := true; ; first = false {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return j, nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				j.Torn = true
+				return j, nil
+			}
+			return journalContents[T]{}, err
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		authenticated := size&journalAuthFlag != 0
+		size &^= journalAuthFlag
+		if size > journalMaxFrameSize {
+			j.Torn = true
+			return j, nil
+		}
+		frameLen := int(size)
+		if authenticated {
+			frameLen += journalMACLen
+		}
+		payload := make([]byte, frameLen)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				j.Torn = true
+				return j, nil
+			}
+			return journalContents[T]{}, err
+		}
+		payload, sum := payload[:size], payload[size:]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			j.Torn = true
+			return j, nil
+		}
+		if key != nil {
+			if !authenticated {
+				return journalContents[T]{}, ErrJournalUnauthenticated
+			}
+			if !hmac.Equal(journalMAC(key, j.Base, j.MAC, payload), sum) {
+				return journalContents[T]{}, ErrJournalTampered
+			}
+			j.MAC = sum
+		}
+		var frame journalFrame[T]
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&frame); err != nil {
+			if key != nil {
+				return journalContents[T]{}, ErrJournalTampered
+			}
+			j.Torn = true
+			return j, nil
+		}
+		if first {
+			j.Base = frame.Base
+		}
+		j.Records = append(j.Records, frame.Records...)
+		j.Valid += int64(journalFrameHeaderLen + frameLen)
+	}
+}
+
+// loadJournal reads the journal next to the snapshot and truncates a torn
+// tail so that later appends stay readable. In ReadOnly mode the tail may
+// still be written by the owning instance and is left alone.
+func (c *Cache[T]) loadJournal() (uint64, []journalRecord[T], error) {
+	path := c.journalPath()
+	j, err := readJournal[T](path, c.hmacKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if j.Torn && !c.readOnly {
+		slog.Warn("cache: discarding torn journal tail", "path", path, "valid_bytes", j.Valid)
+		if err := os.Truncate(path, j.Valid); err != nil {
+			return 0, nil, err
+		}
+	}
+	records := j.Records
+	slices.SortStableFunc(records, func(a, b journalRecord[T]) int {
+		switch {
+		case a.Generation < b.Generation:
+			return -1
+		case a.Generation > b.Generation:
+			return 1
+		}
+		return 0
+	})
+	c.journaled = records
+	c.journalSize = j.Valid
+	c.journalBase = j.Base
+	c.journalMAC = j.MAC
+	return j.Base, records, nil
+}
+
+func replayJournal[T Cacheable](data map[string]T, base uint64, records []journalRecord[T]) (map[string]T, int) {
+	applied := 0
+	for _, record := range records {
+		if record.Generation <= base {
+			continue
+		}
+		switch record.Op {
+		case journalSet:
+			data[record.Key] = record.Value
+		case journalRemove:
+			delete(data, record.Key)
+		case journalPurge:
+			data = make(map[string]T)
+		}
+		applied++
+	}
+	return data, applied
+}
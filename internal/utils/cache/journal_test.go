@@ -0,0 +1,206 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalReplaysMutationsWithoutSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, time.Hour)
+	t.Cleanup(c.Close)
+
+	expiresAt := time.Now().Add(time.Minute)
+	c.Set("alpha", newTestValue(expiresAt, "A"))
+	c.Set("beta", newTestValue(expiresAt, "B"))
+	c.Remove(false, "alpha")
+	c.Set("beta", newTestValue(expiresAt, "B2"))
+	if err := c.flushJournal(); err != nil {
+		t.Fatalf("flush journal: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected no snapshot before compaction, stat error = %v", err)
+	}
+
+	// Simulate a crash: load the files while the first cache is still open.
+	reloaded := &Cache[*testValue]{filePath: path}
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load journal: %v", err)
+	}
+	if _, ok := reloaded.snapshotMap(false)["alpha"]; ok {
+		t.Fatal("journaled removal was not replayed")
+	}
+	if got := reloaded.snapshotMap(false)["beta"]; got == nil || got.Payload != "B2" {
+		t.Fatalf("expected latest journaled value B2, got %+v", got)
+	}
+	if !reloaded.isDirty() || reloaded.generation.Load() != 4 {
+		t.Fatalf("expected dirty replay at generation 4, dirty=%v generation=%d", reloaded.isDirty(), reloaded.generation.Load())
+	}
+}
+
+func TestJournalReplaysPurgeOverSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, time.Hour)
+	t.Cleanup(c.Close)
+
+	expiresAt := time.Now().Add(time.Minute)
+	c.Set("alpha", newTestValue(expiresAt, "A"))
+	if err := c.Save(false); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	c.Lock()
+	c.replaceDataLocked(nil)
+	c.recordLocked(journalPurge, "", nil)
+	c.Unlock()
+	c.Set("beta", newTestValue(expiresAt, "B"))
+	if err := c.flushJournal(); err != nil {
+		t.Fatalf("flush journal: %v", err)
+	}
+
+	reloaded := &Cache[*testValue]{filePath: path}
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, ok := reloaded.snapshotMap(false)["alpha"]; ok {
+		t.Fatal("journaled purge did not clear the snapshot")
+	}
+	if _, ok := reloaded.snapshotMap(false)["beta"]; !ok {
+		t.Fatal("write after purge was not replayed")
+	}
+}
+
+func TestJournalCompactionSkipsSnapshottedRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, time.Hour)
+
+	expiresAt := time.Now().Add(time.Minute)
+	c.Set("alpha", newTestValue(expiresAt, "A"))
+	if err := c.flushJournal(); err != nil {
+		t.Fatalf("flush journal: %v", err)
+	}
+	if err := c.Save(false); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	j, err := readJournal[*testValue](c.journalPath(), nil)
+	if err != nil || j.Torn {
+		t.Fatalf("read compacted journal: torn=%v err=%v", j.Torn, err)
+	}
+	if j.Base != 1 || len(j.Records) != 0 {
+		t.Fatalf("expected empty journal based on generation 1, got base=%d records=%d", j.Base, len(j.Records))
+	}
+
+	c.Set("beta", newTestValue(expiresAt, "B"))
+	if err := c.CloseWithError(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	reloaded := newTestCache(t, path, time.Hour)
+	t.Cleanup(reloaded.Close)
+	for _, key := range []string{"alpha", "beta"} {
+		if _, ok := reloaded.Get(key); !ok {
+			t.Fatalf("expected %s after compaction and reload", key)
+		}
+	}
+	if reloaded.isDirty() {
+		t.Fatal("clean shutdown left journal records to replay")
+	}
+}
+
+func TestJournalTruncatesTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, time.Hour)
+	t.Cleanup(c.Close)
+
+	c.Set("alpha", newTestValue(time.Now().Add(time.Minute), "A"))
+	if err := c.flushJournal(); err != nil {
+		t.Fatalf("flush journal: %v", err)
+	}
+	info, err := os.Stat(c.journalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(c.journalPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 42, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &Cache[*testValue]{filePath: path}
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load torn journal: %v", err)
+	}
+	if _, ok := reloaded.snapshotMap(false)["alpha"]; !ok {
+		t.Fatal("intact journal prefix was not replayed")
+	}
+	truncated, err := os.Stat(c.journalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated.Size() != info.Size() {
+		t.Fatalf("expected torn tail to be truncated to %d bytes, got %d", info.Size(), truncated.Size())
+	}
+}
+
+func TestJournalNeedsCompactionAtMaxRecords(t *testing.T) {
+	c := newTestCache(t, filepath.Join(t.TempDir(), "cache.db"), time.Hour)
+	t.Cleanup(c.Close)
+	if c.journalNeedsCompaction() {
+		t.Fatal("empty journal needs compaction")
+	}
+	c.persistMu.Lock()
+	c.journaled = make([]journalRecord[*testValue], journalMaxRecords)
+	c.persistMu.Unlock()
+	if !c.journalNeedsCompaction() {
+		t.Fatalf("journal with %d records in memory does not need compaction", journalMaxRecords)
+	}
+}
+
+func TestBrokenJournalIsRestoredBeforeSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, time.Hour)
+	t.Cleanup(c.Close)
+
+	expiresAt := time.Now().Add(time.Minute)
+	c.Set("alpha", newTestValue(expiresAt, "A"))
+	if err := c.flushJournal(); err != nil {
+		t.Fatalf("flush journal: %v", err)
+	}
+	c.persistMu.Lock()
+	c.journalBroken = true
+	c.persistMu.Unlock()
+	c.Set("alpha", newTestValue(expiresAt, "A2"))
+	if err := c.flushJournal(); err != nil {
+		t.Fatalf("flush journal: %v", err)
+	}
+
+	// Stop between the snapshot rename and the journal rewrite of compact.
+	generation := c.generation.Load()
+	c.persistMu.Lock()
+	err := c.restoreJournalLocked()
+	if err == nil {
+		err = c.writeSnapshot(c.snapshotMap(false), generation)
+	}
+	c.persistMu.Unlock()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	reloaded := &Cache[*testValue]{filePath: path}
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := reloaded.snapshotMap(false)["alpha"]; got == nil || got.Payload != "A2" {
+		t.Fatalf("expected A2 after replaying the journal over the new snapshot, got %+v", got)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrLocked   = errors.New("cache: cache file is in use by another instance")
+	ErrReadOnly = errors.New("cache: cache is read-only")
+)
+
+// ReadOnly opens the cache without taking the instance lock. Nothing is ever
+// written back, so tools can inspect the files of a running daemon.
+func ReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+func (c *Cache[T]) lockPath() string {
+	return c.filePath + ".lock"
+}
+
+// acquireLock takes an exclusive flock on the sidecar lock file, so that a
+// second instance fails instead of overwriting the snapshot of the first.
+func (c *Cache[T]) acquireLock() error {
+	path := c.lockPath()
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cache: open lock file: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		holder := lockHolder(f)
+		_ = f.Close()
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			return fmt.Errorf("cache: lock %s: %w", path, err)
+		}
+		if holder != "" {
+			return fmt.Errorf("%w: %s is held by pid %s", ErrLocked, path, holder)
+		}
+		return fmt.Errorf("%w: %s is held", ErrLocked, path)
+	}
+	// The pid is informational only; the flock itself is authoritative.
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	c.lock = f
+	return nil
+}
+
+func (c *Cache[T]) releaseLock() {
+	if c.lock != nil {
+		_ = c.lock.Close()
+		c.lock = nil
+	}
+}
+
+func lockHolder(f *os.File) string {
+	b, err := io.ReadAll(io.LimitReader(f, 32))
+	if err != nil {
+		return ""
+	}
+	pid := strings.TrimSpace(string(b))
+	if _, err := strconv.Atoi(pid); err != nil {
+		return ""
+	}
+	return pid
+}
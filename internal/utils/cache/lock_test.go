@@ -0,0 +1,56 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewFailsWhileAnotherInstanceHoldsTheLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c := newTestCache(t, path, time.Hour)
+
+	if _, err := New[*testValue](path, time.Hour); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked for second instance, got %v", err)
+	} else if !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Fatalf("expected lock holder in error, got %v", err)
+	}
+
+	c.Close()
+	reopened := newTestCache(t, path, time.Hour)
+	reopened.Close()
+}
+
+func TestReadOnlyCacheInspectsWithoutWriting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	owner := newTestCache(t, path, time.Hour)
+	t.Cleanup(owner.Close)
+	owner.Set("alpha", newTestValue(time.Now().Add(time.Minute), "A"))
+	if err := owner.flushJournal(); err != nil {
+		t.Fatalf("flush journal: %v", err)
+	}
+
+	ro := newTestCache(t, path, time.Hour, ReadOnly())
+	if got, ok := ro.Get("alpha"); !ok || got.Payload != "A" {
+		t.Fatalf("expected journaled entry in read-only cache, got %+v ok=%v", got, ok)
+	}
+	ro.Set("beta", newTestValue(time.Now().Add(time.Minute), "B"))
+	if err := ro.Save(false); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from save, got %v", err)
+	}
+	if err := ro.CloseWithError(); err != nil {
+		t.Fatalf("close read-only cache: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("read-only cache wrote a snapshot, stat error = %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package cache
+
+import (
+	"hash/maphash"
+	"math/rand/v2"
+	"sync"
+)
+
+const shardCount = 64 // power of two
+
+// shard owns the keys whose hash selects it. Mutations of different shards
+// only contend on the short journal queue lock.
+type shard[T Cacheable] struct {
+	data map[string]T
+	sync.RWMutex
+}
+
+func (c *Cache[T]) initShards() {
+	c.seed = maphash.MakeSeed()
+	for i := range c.shards {
+		c.shards[i].data = make(map[string]T)
+	}
+}
+
+func (c *Cache[T]) shardFor(key string) *shard[T] {
+	c.shardsOnce.Do(c.initShards)
+	return &c.shards[maphash.String(c.seed, key)&(shardCount-1)]
+}
+
+// LockKey write-locks the shard holding key. While it is held, Update and
+// Remove may be called for key with haveLock set.
+func (c *Cache[T]) LockKey(key string) {
+	c.shardFor(key).Lock()
+}
+
+func (c *Cache[T]) UnlockKey(key string) {
+	c.shardFor(key).Unlock()
+}
+
+// Lock write-locks every shard, in order, for operations that must see or
+// change the whole cache at once. Any haveLock argument may then be set.
+func (c *Cache[T]) Lock() {
+	c.shardsOnce.Do(c.initShards)
+	for i := range c.shards {
+		c.shards[i].Lock()
+	}
+}
+
+func (c *Cache[T]) Unlock() {
+	for i := len(c.shards) - 1; i >= 0; i-- {
+		c.shards[i].Unlock()
+	}
+}
+
+// RLock read-locks every shard, in order. Items and Save may then be called
+// with haveLock set.
+func (c *Cache[T]) RLock() {
+	c.shardsOnce.Do(c.initShards)
+	for i := range c.shards {
+		c.shards[i].RLock()
+	}
+}
+
+func (c *Cache[T]) RUnlock() {
+	for i := len(c.shards) - 1; i >= 0; i-- {
+		c.shards[i].RUnlock()
+	}
+}
+
+// eachShard calls fn for every shard, read-locking each one in turn unless
+// the caller already holds the whole cache.
+func (c *Cache[T]) eachShard(haveLock bool, fn func(*shard[T])) {
+	c.shardsOnce.Do(c.initShards)
+	for i := range c.shards {
+		s := &c.shards[i]
+		if !haveLock {
+			s.RLock()
+		}
+		fn(s)
+		if !haveLock {
+			s.RUnlock()
+		}
+	}
+}
+
+// Sample returns up to n entries, starting at a random shard. Map iteration
+// order is random as well, so this is a cheap sample for admission checks.
+func (c *Cache[T]) Sample(n int) []Entry[T] {
+	c.shardsOnce.Do(c.initShards)
+	entries := make([]Entry[T], 0, n)
+	start := rand.IntN(shardCount)
+	for i := 0; i < shardCount && len(entries) < n; i++ {
+		s := &c.shards[(start+i)&(shardCount-1)]
+		s.RLock()
+		for k, v := range s.data {
+			if len(entries) == n {
+				break
+			}
+			entries = append(entries, Entry[T]{Key: k, Value: v})
+		}
+		s.RUnlock()
+	}
+	return entries
+}
+
+// snapshotMap copies all shards into one map. Without haveLock each shard is
+// copied under its own read lock, so writers to other shards are not blocked.
+func (c *Cache[T]) snapshotMap(haveLock bool) map[string]T {
+	snapshot := make(map[string]T, c.Len())
+	c.eachShard(haveLock, func(s *shard[T]) {
+		for k, v := range s.data {
+			snapshot[k] = v
+		}
+	})
+	return snapshot
+}
+
+// replaceDataLocked distributes data over the shards. The caller holds Lock.
+func (c *Cache[T]) replaceDataLocked(data map[string]T) {
+	for i := range c.shards {
+		c.shards[i].data = make(map[string]T)
+	}
+	for k, v := range data {
+		c.shardFor(k).data[k] = v
+	}
+	c.size.Store(int64(len(data)))
+}
+
+func (c *Cache[T]) isDirty() bool {
+	return c.generation.Load() != c.cleanGeneration.Load()
+}
+
+// markClean records that everything up to generation has been persisted.
+func (c *Cache[T]) markClean(generation uint64) {
+	for {
+		clean := c.cleanGeneration.Load()
+		if clean >= generation || c.cleanGeneration.CompareAndSwap(clean, generation) {
+			return
+		}
+	}
+}
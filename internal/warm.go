@@ -0,0 +1,212 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	WARM_DEFAULT_RATE       = 10 // domains per second
+	WARM_MAX_RATE           = 1000
+	WARM_MAX_DOMAINS        = 100000
+	WARM_CONCURRENCY        = 8
+	WARM_PROGRESS_INTERVAL  = time.Second
+	WARM_PROGRESS_LINE_HEAD = "PROGRESS "
+)
+
+// warmLine covers the JSON inputs accepted by WARM: lines written by
+// CACHEEXPORT carry a domain, `postqueue -j` lines carry recipients.
+type warmLine struct {
+	Domain     string `json:"domain"`
+	Recipients []struct {
+		Address string `json:"address"`
+	} `json:"recipients"`
+}
+
+func warmDomain(s string) (string, bool) {
+	if _, host, ok := strings.Cut(s, "@"); ok {
+		s = host
+	}
+	return normalizePolicyKey(s)
+}
+
+// readWarmDomains collects the unique domains of a plain domain list, an
+// EXPORT or CACHEEXPORT file, or `postqueue -j` output. Plain lines use their
+// first field, which may also be an email address; '#' starts a comment.
+func readWarmDomains(r io.Reader, beforeLine func() error) ([]string, int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), CACHE_IMPORT_MAX_LINE)
+	var (
+		domains []string
+		invalid int
+		line    int
+	)
+	seen := make(map[string]struct{})
+	add := func(s string) error {
+		domain, ok := warmDomain(s)
+		if !ok {
+			invalid++
+			return nil
+		}
+		if _, dup := seen[domain]; dup {
+			return nil
+		}
+		if len(domains) >= WARM_MAX_DOMAINS {
+			return fmt.Errorf("more than %d domains", WARM_MAX_DOMAINS)
+		}
+		seen[domain] = struct{}{}
+		domains = append(domains, domain)
+		return nil
+	}
+	for {
+		if beforeLine != nil {
+			if err := beforeLine(); err != nil {
+				return nil, 0, err
+			}
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line++
+		raw := strings.TrimSpace(scanner.Text())
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+		var candidates []string
+		if strings.HasPrefix(raw, "{") {
+			var l warmLine
+			if err := json.Unmarshal([]byte(raw), &l); err != nil {
+				return nil, 0, &cacheImportError{line: line, err: err}
+			}
+			if l.Domain != "" {
+				candidates = append(candidates, l.Domain)
+			}
+			for _, rcpt := range l.Recipients {
+				candidates = append(candidates, rcpt.Address)
+			}
+			if len(candidates) == 0 {
+				invalid++
+			}
+		} else {
+			candidates = append(candidates, strings.Fields(raw)[0])
+		}
+		for _, candidate := range candidates {
+			if err := add(candidate); err != nil {
+				return nil, 0, &cacheImportError{line: line, err: err}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, &cacheImportError{line: line + 1, err: err}
+	}
+	return domains, invalid, nil
+}
+
+func parseWarmRate(argument string) (int, error) {
+	argument = strings.TrimSpace(argument)
+	if argument == "" {
+		return WARM_DEFAULT_RATE, nil
+	}
+	rate, err := strconv.Atoi(argument)
+	if err != nil || rate < 1 || rate > WARM_MAX_RATE {
+		return 0, fmt.Errorf("invalid warm rate %q, must be between 1 and %d", argument, WARM_MAX_RATE)
+	}
+	return rate, nil
+}
+
+// warmCache looks up domains that have no usable cached policy, at most rate
+// per second, and stores the results like live queries do. progress is
+// called with the number of finished domains at most once per
+// WARM_PROGRESS_INTERVAL; returning false stops the warm-up.
+func warmCache(domains []string, rate int, progress func(done int) bool) (warmed, cached, failed int) {
+	var (
+		wg                     sync.WaitGroup
+		done, nWarmed, nFailed atomic.Int32
+		lastProgress           = time.Now()
+		stopped                bool
+		sem                    = make(chan struct{}, WARM_CONCURRENCY)
+		ticker                 = time.NewTicker(time.Second / time.Duration(rate))
+	)
+	defer ticker.Stop()
+	for _, domain := range domains {
+		if bgCtx.Err() != nil || stopped {
+			break
+		}
+		if c, found := polCache.Get(domain); found {
+			if _, _, _, ok := selectCachedPolicy(c, time.Now()); ok {
+				cached++
+				done.Add(1)
+				continue
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-bgCtx.Done():
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(domain string) {
+			defer func() {
+				<-sem
+				done.Add(1)
+				wg.Done()
+			}()
+			c, _ := polCache.Get(domain)
+			result := queryDomain(domain)
+			_, stored := storeDomainResult(domain, c, result, 0)
+			if result.Policy == "TEMP" {
+				nFailed.Add(1)
+			} else if stored {
+				nWarmed.Add(1)
+			}
+		}(domain)
+		if time.Since(lastProgress) >= WARM_PROGRESS_INTERVAL {
+			lastProgress = time.Now()
+			stopped = !progress(int(done.Load()))
+		}
+	}
+	wg.Wait()
+	return int(nWarmed.Load()), cached, int(nFailed.Load())
+}
+
+func warmCacheFromConnection(conn net.Conn, reader *bufio.Reader, argument string) {
+	rate, err := parseWarmRate(argument)
+	if err != nil {
+		fmt.Fprintf(conn, "ERROR: %v\n", err)
+		return
+	}
+	domains, invalid, err := readWarmDomains(reader, func() error {
+		return conn.SetReadDeadline(time.Now().Add(SOCKETMAP_IO_TIMEOUT))
+	})
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		slog.Warn("Rejected cache warm-up list", "error", err)
+		fmt.Fprintf(conn, "ERROR: %v\n", err)
+		return
+	}
+	slog.Info("Warming cache", "domains", len(domains), "invalid", invalid, "rate", rate)
+	total := len(domains)
+	warmed, cached, failed := warmCache(domains, rate, func(done int) bool {
+		_, err := fmt.Fprintf(conn, "%s%d/%d\n", WARM_PROGRESS_LINE_HEAD, done, total)
+		return err == nil
+	})
+	if err := polCache.Save(false); err != nil {
+		slog.Error("Could not persist warmed cache entries", "error", err)
+	}
+	slog.Info("Warmed cache", "warmed", warmed, "cached", cached, "failed", failed, "invalid", invalid)
+	fmt.Fprintf(conn, "OK warmed=%d cached=%d failed=%d invalid=%d\n", warmed, cached, failed, invalid)
+}
@@ -0,0 +1,90 @@
+/*
+ * MIT License
+ * Copyright (c) 2024-2026 Zuplu
+ */
+
+package tlspol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Zuplu/postfix-tlspol/internal/utils/cache"
+	"github.com/Zuplu/postfix-tlspol/internal/utils/netstring"
+)
+
+func TestReadWarmDomainsAcceptsListsExportsAndQueue(t *testing.T) {
+	input := strings.Join([]string{
+		"# plain list",
+		"Example.org.",
+		"user@mail.example.net",
+		"export.example                dane-only",
+		`{"domain":"cache.example","policy":"dane","ttl":60,"counter":1}`,
+		`{"queue_name":"deferred","queue_id":"4ABC","sender":"a@local","recipients":[{"address":"b@example.org"},{"address":"c@queue.example","delay_reason":"timeout"}]}`,
+		"bad@domain@",
+		"[192.0.2.1]",
+		"[SMTP.partner.example]:587",
+		"user@bücher.de",
+		"",
+	}, "\n")
+	domains, invalid, err := readWarmDomains(strings.NewReader(input), nil)
+	if err != nil {
+		t.Fatalf("readWarmDomains: %v", err)
+	}
+	want := []string{"example.org", "mail.example.net", "export.example", "cache.example", "queue.example", "[smtp.partner.example]:587", "xn--bcher-kva.de"}
+	if !slices.Equal(domains, want) || invalid != 2 {
+		t.Fatalf("got domains=%v invalid=%d, want %v and 2", domains, invalid, want)
+	}
+
+	if _, _, err := readWarmDomains(strings.NewReader("ok.example\n{broken\n"), nil); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected line 2 error, got %v", err)
+	}
+}
+
+func TestWarmCommandStoresLookups(t *testing.T) {
+	useTestPolicyCache(t)
+	originalDane, originalMtaSts := checkDanePolicy, checkMtaStsPolicy
+	t.Cleanup(func() {
+		checkDanePolicy, checkMtaStsPolicy = originalDane, originalMtaSts
+	})
+	var lookups atomic.Int32
+	checkDanePolicy = func(_ context.Context, domain string, _ bool) (string, uint32) {
+		lookups.Add(1)
+		if domain == "temp.example" {
+			return "TEMP", 0
+		}
+		return "dane-only", 600
+	}
+	checkMtaStsPolicy = func(context.Context, string, bool) (string, string, uint32) {
+		return "", "", 0
+	}
+	now := time.Now()
+	polCache.Set("cached.example", &CacheStruct{
+		Expirable: &cache.Expirable{ExpiresAt: now.Add(time.Hour)},
+		Dane:      PolicyBranch{Policy: "dane", TTL: 3600, ExpiresAt: now.Add(time.Hour)},
+	})
+
+	conn := newSecurityTestConn(nil, &net.UnixAddr{Name: "@", Net: "unix"})
+	input := append(netstring.Marshal("WARM 1000"), "cold.example\ncached.example\ntemp.example\n"...)
+	handleSocketmapConnection(conn, bufio.NewReader(bytes.NewReader(input)))
+	if got := conn.output.String(); !strings.HasSuffix(got, "OK warmed=1 cached=1 failed=1 invalid=0\n") {
+		t.Fatalf("unexpected warm response %q", got)
+	}
+	if c, ok := polCache.Get("cold.example"); !ok || c.Dane.Policy != "dane-only" {
+		t.Fatalf("warm-up did not store cold.example: %+v", c)
+	}
+	if lookups.Load() != 2 {
+		t.Fatalf("looked up %d domains, want 2", lookups.Load())
+	}
+
+	if got := runControlCommand(t, "WARM 0"); !strings.HasPrefix(got, "ERROR:") {
+		t.Fatalf("invalid rate response = %q", got)
+	}
+}